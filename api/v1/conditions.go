@@ -0,0 +1,118 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Condition types reported in CRUDStatus.Conditions.
+const (
+	ConditionImageReady          = "ImageReady"
+	ConditionDatabaseReady       = "DatabaseReady"
+	ConditionDeploymentAvailable = "DeploymentAvailable"
+	ConditionIngressReady        = "IngressReady"
+	ConditionCertificateReady    = "CertificateReady"
+	// ConditionReady is True when every other condition is True.
+	ConditionReady = "Ready"
+	// ConditionMigrationFailed is True when the database migrations of a
+	// new image failed, in which case the previous image keeps serving.
+	ConditionMigrationFailed = "MigrationFailed"
+	// ConditionRolledBack reports the outcome of the last rollback request.
+	// It is not taken into account by ConditionReady.
+	ConditionRolledBack = "RolledBack"
+	// ConditionSchemaCompatible is False when the apiDescription would drop
+	// or convert data of the deployed one and destructive changes are not
+	// allowed, in which case it is not rolled out.
+	ConditionSchemaCompatible = "SchemaCompatible"
+	// ConditionRestoring is True while a CRUDRestore replaces the content of
+	// the database, during which the API is scaled down.
+	ConditionRestoring = "Restoring"
+	// ConditionStorageReady is True when the volumes of an in-cluster
+	// database have the requested size. It is False while they are being
+	// expanded or when the requested size is smaller, and is not taken into
+	// account by ConditionReady.
+	ConditionStorageReady = "StorageReady"
+	// ConditionUpgrading is True while the database is upgraded to another
+	// major version, during which the API is scaled down.
+	ConditionUpgrading = "Upgrading"
+	// ConditionFinalBackupFailed is True when the backup taken before the
+	// database of a deleted Snapshot CRUD is deleted failed. The deletion
+	// waits until the backup job is deleted, which retries it, or the
+	// deletionPolicy is changed to Retain or Delete.
+	ConditionFinalBackupFailed = "FinalBackupFailed"
+)
+
+// Condition describes one aspect of the state of a CRUD. It has the same
+// shape as metav1.Condition, which the apimachinery version in use does not
+// provide yet.
+type Condition struct {
+	// +kubebuilder:validation:Required
+	Type string `json:"type"`
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:Enum=True;False;Unknown
+	Status corev1.ConditionStatus `json:"status"`
+	// +kubebuilder:validation:Optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// +kubebuilder:validation:Required
+	LastTransitionTime metav1.Time `json:"lastTransitionTime"`
+	// Reason is a CamelCase reason for the last transition.
+	// +kubebuilder:validation:Required
+	Reason string `json:"reason"`
+	// +kubebuilder:validation:Optional
+	Message string `json:"message"`
+}
+
+// GetCondition returns the condition of the given type, or nil.
+func (s *CRUDStatus) GetCondition(conditionType string) *Condition {
+	for i := range s.Conditions {
+		if s.Conditions[i].Type == conditionType {
+			return &s.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// IsConditionTrue reports whether the condition of the given type is True.
+func (s *CRUDStatus) IsConditionTrue(conditionType string) bool {
+	cond := s.GetCondition(conditionType)
+	return cond != nil && cond.Status == corev1.ConditionTrue
+}
+
+// SetCondition adds or updates a condition. LastTransitionTime is only
+// moved when the status changes.
+func (s *CRUDStatus) SetCondition(cond Condition) {
+	existing := s.GetCondition(cond.Type)
+	if existing == nil {
+		if cond.LastTransitionTime.IsZero() {
+			cond.LastTransitionTime = metav1.Now()
+		}
+		s.Conditions = append(s.Conditions, cond)
+		return
+	}
+	if existing.Status != cond.Status {
+		existing.Status = cond.Status
+		existing.LastTransitionTime = cond.LastTransitionTime
+		if existing.LastTransitionTime.IsZero() {
+			existing.LastTransitionTime = metav1.Now()
+		}
+	}
+	existing.Reason = cond.Reason
+	existing.Message = cond.Message
+	existing.ObservedGeneration = cond.ObservedGeneration
+}
@@ -0,0 +1,43 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ = Describe("CRUDStatus conditions", func() {
+	It("only moves the transition time when the status changes", func() {
+		status := &CRUDStatus{}
+		then := metav1.NewTime(time.Now().Add(-time.Hour))
+		status.SetCondition(Condition{Type: ConditionReady, Status: corev1.ConditionFalse, Reason: "NotReady", LastTransitionTime: then})
+
+		status.SetCondition(Condition{Type: ConditionReady, Status: corev1.ConditionFalse, Reason: "StillNotReady"})
+		Expect(status.Conditions).To(HaveLen(1))
+		Expect(status.GetCondition(ConditionReady).Reason).To(Equal("StillNotReady"))
+		Expect(status.GetCondition(ConditionReady).LastTransitionTime).To(Equal(then))
+
+		status.SetCondition(Condition{Type: ConditionReady, Status: corev1.ConditionTrue, Reason: "Ready"})
+		Expect(status.IsConditionTrue(ConditionReady)).To(BeTrue())
+		Expect(status.GetCondition(ConditionReady).LastTransitionTime.After(then.Time)).To(BeTrue())
+	})
+})
@@ -0,0 +1,75 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// ChangedByAnnotation holds the user who last changed the spec of a CRUD.
+const ChangedByAnnotation = "api.crudgen.org/changed-by"
+
+// +kubebuilder:webhook:path=/mutate-api-crudgen-org-v1-crud-author,mutating=true,failurePolicy=fail,groups=api.crudgen.org,resources=cruds,verbs=create;update,versions=v1,name=mcrudauthor.kb.io
+
+// authorAnnotator sets ChangedByAnnotation to the requesting user whenever
+// the spec changes. Any other change keeps the previous value, so the
+// annotation cannot be set by hand.
+type authorAnnotator struct {
+	decoder *admission.Decoder
+}
+
+func (a *authorAnnotator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	crud := &CRUD{}
+	if err := a.decoder.Decode(req, crud); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	author := req.UserInfo.Username
+	if req.Operation == admissionv1beta1.Update {
+		old := &CRUD{}
+		if err := a.decoder.DecodeRaw(req.OldObject, old); err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		if equality.Semantic.DeepEqual(old.Spec, crud.Spec) {
+			author = old.Annotations[ChangedByAnnotation]
+		}
+	}
+
+	current, ok := crud.Annotations[ChangedByAnnotation]
+	if current == author && (ok || author == "") {
+		return admission.Allowed("")
+	}
+	switch {
+	case author == "":
+		delete(crud.Annotations, ChangedByAnnotation)
+	case crud.Annotations == nil:
+		crud.Annotations = map[string]string{ChangedByAnnotation: author}
+	default:
+		crud.Annotations[ChangedByAnnotation] = author
+	}
+	marshaled, err := json.Marshal(crud)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	return admission.PatchResponseFromRaw(req.Object.Raw, marshaled)
+}
@@ -0,0 +1,96 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"context"
+	"encoding/json"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+var _ = Describe("CRUD author webhook", func() {
+	var annotator *authorAnnotator
+
+	BeforeEach(func() {
+		decoder, err := admission.NewDecoder(testScheme())
+		Expect(err).NotTo(HaveOccurred())
+		annotator = &authorAnnotator{decoder: decoder}
+	})
+
+	raw := func(crud *CRUD) runtime.RawExtension {
+		data, err := json.Marshal(crud)
+		Expect(err).NotTo(HaveOccurred())
+		return runtime.RawExtension{Raw: data}
+	}
+
+	handle := func(operation admissionv1beta1.Operation, user string, crud, old *CRUD) admission.Response {
+		req := admission.Request{AdmissionRequest: admissionv1beta1.AdmissionRequest{
+			Operation: operation,
+			UserInfo:  authenticationv1.UserInfo{Username: user},
+			Object:    raw(crud),
+		}}
+		if old != nil {
+			req.OldObject = raw(old)
+		}
+		resp := annotator.Handle(context.Background(), req)
+		Expect(resp.Allowed).To(BeTrue())
+		return resp
+	}
+
+	authorPatch := func(resp admission.Response) interface{} {
+		for _, patch := range resp.Patches {
+			if patch.Path == "/metadata/annotations" {
+				return patch.Value.(map[string]interface{})[ChangedByAnnotation]
+			}
+			if patch.Path == "/metadata/annotations/api.crudgen.org~1changed-by" {
+				return patch.Value
+			}
+		}
+		return nil
+	}
+
+	It("records the creator", func() {
+		resp := handle(admissionv1beta1.Create, "alice", newTestCRUD("default", "todo", ""), nil)
+		Expect(authorPatch(resp)).To(Equal("alice"))
+	})
+
+	It("records the user changing the spec", func() {
+		old := newTestCRUD("default", "todo", "")
+		old.Annotations = map[string]string{ChangedByAnnotation: "alice"}
+		crud := old.DeepCopy()
+		crud.Spec.EnableTLS = true
+
+		resp := handle(admissionv1beta1.Update, "bob", crud, old)
+		Expect(authorPatch(resp)).To(Equal("bob"))
+	})
+
+	It("keeps the author when the spec does not change", func() {
+		old := newTestCRUD("default", "todo", "")
+		old.Annotations = map[string]string{ChangedByAnnotation: "alice"}
+		crud := old.DeepCopy()
+		crud.Annotations[ChangedByAnnotation] = "mallory"
+
+		resp := handle(admissionv1beta1.Update, "mallory", crud, old)
+		Expect(authorPatch(resp)).To(Equal("alice"))
+	})
+})
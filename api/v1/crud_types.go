@@ -18,35 +18,441 @@ package v1
 
 import (
 	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
 
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+
+	"github.com/crudgen-org/crudgen-orchestrator/pkg/apidescription"
 )
 
 // CRUDSpec defines the desired state of CRUD
 type CRUDSpec struct {
 	// +kubebuilder:validation:Required
 	APIDescription string `json:"apiDescription"`
-	// +kubebuilder:validation:Required
-	DomainPrefix string `json:"domainPrefix"`
+	// DomainPrefix is prepended to the root domain to build the API host.
+	// Defaults to the name of the CRUD.
+	// +kubebuilder:validation:Optional
+	DomainPrefix string `json:"domainPrefix,omitempty"`
 	// +kubebuilder:default:=true
 	EnableTLS bool `json:"enableTLS"`
+	// Resources of the API container.
+	// +kubebuilder:validation:Optional
+	Resources corev1.ResourceRequirements `json:"resources,omitempty"`
+	// +kubebuilder:validation:Optional
+	Autoscaling AutoscalingSpec `json:"autoscaling,omitempty"`
+	// +kubebuilder:validation:Optional
+	Database DatabaseSpec `json:"database,omitempty"`
+	// RevisionHistoryLimit is the number of deployed revisions kept for
+	// rollbacks. Defaults to 10.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=1
+	RevisionHistoryLimit *int32 `json:"revisionHistoryLimit,omitempty"`
+}
+
+// AutoscalingSpec configures the HorizontalPodAutoscaler of the API
+type AutoscalingSpec struct {
+	// +kubebuilder:validation:Minimum=1
+	MinReplicas *int32 `json:"minReplicas,omitempty"`
+	// +kubebuilder:validation:Minimum=1
+	MaxReplicas int32 `json:"maxReplicas,omitempty"`
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=100
+	TargetCPUUtilizationPercentage *int32 `json:"targetCPUUtilizationPercentage,omitempty"`
+}
+
+// DatabaseSpec defines the postgres database of the API
+type DatabaseSpec struct {
+	// Mode decides where the database runs. Defaults to InCluster. It
+	// cannot be changed once the CRUD is created.
+	// +kubebuilder:validation:Optional
+	Mode DatabaseMode `json:"mode,omitempty"`
+	// External is the server the database is created on in External mode.
+	// +kubebuilder:validation:Optional
+	External *ExternalDatabaseSpec `json:"external,omitempty"`
+	// Pool selects the DatabasePool the database is created on in Pool
+	// mode. Without a name, the pool with the most room among the ones
+	// matching the selector is picked.
+	// +kubebuilder:validation:Optional
+	Pool *DatabasePoolReference `json:"pool,omitempty"`
+	// Version is the postgres image tag, starting with the major version.
+	// Raising the major version of an in-cluster database dumps it and
+	// restores it into new volumes, keeping the previous ones to roll back
+	// to; other changes roll the statefulset in place. The operator may
+	// restrict the versions allowed, the highest one is the default.
+	Version string `json:"version,omitempty"`
+	// Replicas is the number of postgres instances of an in-cluster
+	// database: a primary and Replicas-1 hot standbys replicating from it.
+	// A standby is promoted when the primary fails. Defaults to 1.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=1
+	Replicas *int32 `json:"replicas,omitempty"`
+	// +kubebuilder:validation:Optional
+	Storage DatabaseStorageSpec `json:"storage,omitempty"`
+	// Resources of the postgres container.
+	// +kubebuilder:validation:Optional
+	Resources corev1.ResourceRequirements `json:"resources,omitempty"`
+	// DeletionPolicy decides what happens to the data when the CRUD is
+	// deleted. Defaults to Delete.
+	// +kubebuilder:validation:Optional
+	DeletionPolicy DeletionPolicy `json:"deletionPolicy,omitempty"`
+	// RotationPeriod rotates the database credentials periodically. A
+	// rotation can also be requested with the rotate-db-credentials
+	// annotation.
+	// +kubebuilder:validation:Optional
+	RotationPeriod *metav1.Duration `json:"rotationPeriod,omitempty"`
+	// Backup schedules logical backups of the database.
+	// +kubebuilder:validation:Optional
+	Backup *DatabaseBackupSpec `json:"backup,omitempty"`
+}
+
+// DatabaseBackupSpec schedules logical backups of the database
+type DatabaseBackupSpec struct {
+	// Schedule of the backups, in cron format.
+	// +kubebuilder:validation:Required
+	Schedule string `json:"schedule"`
+	// Retention is the number of backups kept. Defaults to 7.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=1
+	Retention *int32 `json:"retention,omitempty"`
+	// +kubebuilder:validation:Required
+	Destination BackupDestination `json:"destination"`
+}
+
+// BackupDestination is where the backups are stored. Exactly one of its
+// fields must be set.
+type BackupDestination struct {
+	// PersistentVolumeClaim stores the backups on an existing volume of the
+	// namespace of the CRUD.
+	// +kubebuilder:validation:Optional
+	PersistentVolumeClaim *PVCBackupDestination `json:"persistentVolumeClaim,omitempty"`
+	// S3 uploads the backups to an S3 compatible object storage.
+	// +kubebuilder:validation:Optional
+	S3 *S3BackupDestination `json:"s3,omitempty"`
+}
+
+// PVCBackupDestination stores the backups on a volume
+type PVCBackupDestination struct {
+	// +kubebuilder:validation:Required
+	ClaimName string `json:"claimName"`
+}
+
+// S3BackupDestination uploads the backups to an S3 compatible object storage
+type S3BackupDestination struct {
+	// Endpoint of the object storage. Defaults to AWS S3.
+	// +kubebuilder:validation:Optional
+	Endpoint string `json:"endpoint,omitempty"`
+	// +kubebuilder:validation:Required
+	Bucket string `json:"bucket"`
+	// Prefix is the directory of the bucket the backups are stored in.
+	// +kubebuilder:validation:Optional
+	Prefix string `json:"prefix,omitempty"`
+	// CredentialsSecret is the name of a secret of the namespace of the CRUD
+	// holding the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY keys.
+	// +kubebuilder:validation:Required
+	CredentialsSecret string `json:"credentialsSecret"`
+}
+
+// DatabaseMode describes where the database of a CRUD runs
+// +kubebuilder:validation:Enum=InCluster;External;Pool
+type DatabaseMode string
+
+const (
+	// DatabaseModeInCluster runs postgres in a StatefulSet of the CRUD.
+	DatabaseModeInCluster DatabaseMode = "InCluster"
+	// DatabaseModeExternal creates a database and a role for the CRUD on an
+	// existing server.
+	DatabaseModeExternal DatabaseMode = "External"
+	// DatabaseModePool creates a database and a role for the CRUD on the
+	// instance of a DatabasePool.
+	DatabaseModePool DatabaseMode = "Pool"
+)
+
+// DatabasePoolReference selects a DatabasePool
+type DatabasePoolReference struct {
+	// Name of the pool.
+	// +kubebuilder:validation:Optional
+	Name string `json:"name,omitempty"`
+	// Selector restricts the pools considered when no name is given.
+	// +kubebuilder:validation:Optional
+	Selector *metav1.LabelSelector `json:"selector,omitempty"`
+}
+
+// ExternalDatabaseSpec references an existing postgres server
+type ExternalDatabaseSpec struct {
+	// AdminSecret is the name of a secret of the namespace of the CRUD
+	// holding the host, port and the username and password of a role
+	// allowed to create databases and roles on the server. The port
+	// defaults to 5432. The role connects to the postgres database.
+	// +kubebuilder:validation:Required
+	AdminSecret string `json:"adminSecret"`
+}
+
+// DeletionPolicy describes what happens to the database of a deleted CRUD
+// +kubebuilder:validation:Enum=Delete;Retain;Snapshot
+type DeletionPolicy string
+
+const (
+	// DeletionPolicyDelete deletes the database volumes with the CRUD, or
+	// drops the database and its roles from the external server.
+	DeletionPolicyDelete DeletionPolicy = "Delete"
+	// DeletionPolicyRetain orphans the database volumes, or leaves the
+	// database on the external server, and the credentials secret.
+	DeletionPolicyRetain DeletionPolicy = "Retain"
+	// DeletionPolicySnapshot dumps the database to a retained volume and
+	// then deletes it as DeletionPolicyDelete does. If the dump fails, the
+	// deletion waits until the dump job is deleted, which retries it, or the
+	// policy is changed to Retain or Delete.
+	DeletionPolicySnapshot DeletionPolicy = "Snapshot"
+)
+
+// DatabasePort is the port postgres listens on.
+const DatabasePort = 5432
+
+// Keys of the database credentials secret. POSTGRES_USER is the owner of
+// the database; the API connects through DATABASE_URL as API_USER, which is
+// the owner until the credentials are first rotated. POSTGRES_HOST and
+// POSTGRES_PORT locate the server in External mode.
+const (
+	DatabaseUserKey     = "POSTGRES_USER"
+	DatabasePasswordKey = "POSTGRES_PASSWORD"
+	DatabaseNameKey     = "POSTGRES_DB"
+	DatabaseURLKey      = "DATABASE_URL"
+	DatabaseAPIUserKey  = "API_USER"
+	DatabaseHostKey     = "POSTGRES_HOST"
+	DatabasePortKey     = "POSTGRES_PORT"
+)
+
+// Keys of the admin secret of an external database server.
+const (
+	ExternalHostKey     = "host"
+	ExternalPortKey     = "port"
+	ExternalUsernameKey = "username"
+	ExternalPasswordKey = "password"
+)
+
+// RotateCredentialsAnnotation requests a rotation of the database
+// credentials whenever its value changes.
+const RotateCredentialsAnnotation = "api.crudgen.org/rotate-db-credentials"
+
+// RollbackToAnnotation requests a rollback to the revision with the given
+// number. The apiDescription of the revision is restored and its image is
+// rolled out again; the annotation is removed once handled.
+const RollbackToAnnotation = "api.crudgen.org/rollback-to"
+
+// AllowDestructiveChangesAnnotation, set to "true", allows rolling out an
+// apiDescription that drops or converts data of the deployed one, rollbacks
+// included. It is removed once such a description has been rolled out. A
+// rollback sets it itself once the tables it drops are checked empty.
+const AllowDestructiveChangesAnnotation = "api.crudgen.org/allow-destructive-changes"
+
+// CRUDFinalizer holds the deletion of a CRUD until its database has been
+// handled according to the deletion policy.
+const CRUDFinalizer = "api.crudgen.org/finalizer"
+
+// DatabaseStorageSpec defines the volume of the database
+type DatabaseStorageSpec struct {
+	// Size of the volume claimed for the database. The volume is expanded
+	// online when the size grows, provided its storage class allows volume
+	// expansion. It cannot shrink.
+	Size *resource.Quantity `json:"size,omitempty"`
+	// StorageClassName of the volume claimed for the database. Defaults to
+	// the class the orchestrator is configured with, or to the default class
+	// of the cluster. It cannot be changed once the CRUD is created.
+	// +kubebuilder:validation:Optional
+	StorageClassName *string `json:"storageClassName,omitempty"`
 }
 
 // CRUDStatus defines the observed state of CRUD
 type CRUDStatus struct {
 	// +kubebuilder:default:=false
 	// +kubebuilder:validation:Optional
-	ImageReady         bool   `json:"imageReady"`
-	Image              string `json:"image,omitempty"`
-	Port               int32  `json:"port,omitempty"`
+	ImageReady bool   `json:"imageReady"`
+	Image      string `json:"image,omitempty"`
+	// Port is the port Image listens on, always set by the orchestrator:
+	// the one the image was built with, or without a builder the
+	// deploy_strategy.port of the apiDescription.
+	Port int32 `json:"port,omitempty"`
+	// APIDescriptionHash is the hash of the canonical apiDescription Image
+	// was built from. An image built from another description is not rolled
+	// out. Without a builder, the system setting Image and ImageReady may
+	// leave it empty, the image is then rolled out as it is.
 	APIDescriptionHash string `json:"apiDescriptionHash,omitempty"`
 	// +kubebuilder:validation:Optional
 	Deployed bool `json:"deployed"`
+	// +kubebuilder:validation:Optional
+	Database DatabaseStatus `json:"database,omitempty"`
+	// Build is the state of the last image build started by the orchestrator.
+	// +kubebuilder:validation:Optional
+	Build BuildStatus `json:"build,omitempty"`
+	// Revision is the number of the revision currently rolled out.
+	// +kubebuilder:validation:Optional
+	Revision int64 `json:"revision,omitempty"`
+	// SchemaChanges lists the changes of the apiDescription from the
+	// revision currently rolled out.
+	// +kubebuilder:validation:Optional
+	SchemaChanges []SchemaChange `json:"schemaChanges,omitempty"`
+	// ObservedGeneration is the generation of the spec the status was
+	// computed from.
+	// +kubebuilder:validation:Optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// +kubebuilder:validation:Optional
+	// +listType=map
+	// +listMapKey=type
+	Conditions []Condition `json:"conditions,omitempty"`
+}
+
+// DatabaseStatus defines the observed state of the database
+type DatabaseStatus struct {
+	// CredentialsRotationTime is when the credentials were last rotated.
+	// +kubebuilder:validation:Optional
+	CredentialsRotationTime *metav1.Time `json:"credentialsRotationTime,omitempty"`
+	// RotationRequest is the last value of the rotate-db-credentials
+	// annotation that was acted upon.
+	// +kubebuilder:validation:Optional
+	RotationRequest string `json:"rotationRequest,omitempty"`
+	// LastBackupTime is when the last successful backup completed.
+	// +kubebuilder:validation:Optional
+	LastBackupTime *metav1.Time `json:"lastBackupTime,omitempty"`
+	// Server is the external server the database was created on.
+	// +kubebuilder:validation:Optional
+	Server string `json:"server,omitempty"`
+	// Pool is the DatabasePool the database was allocated on.
+	// +kubebuilder:validation:Optional
+	Pool string `json:"pool,omitempty"`
+	// Primary is the pod running the primary of an in-cluster database.
+	// +kubebuilder:validation:Optional
+	Primary string `json:"primary,omitempty"`
+	// Version is the postgres version the in-cluster database runs.
+	// +kubebuilder:validation:Optional
+	Version string `json:"version,omitempty"`
+	// VolumeClaim is the name of the volume claim template holding the data
+	// of the in-cluster database, a new one being used after each major
+	// upgrade.
+	// +kubebuilder:validation:Optional
+	VolumeClaim string `json:"volumeClaim,omitempty"`
+	// Upgrade follows the last major version upgrade.
+	// +kubebuilder:validation:Optional
+	Upgrade *DatabaseUpgradeStatus `json:"upgrade,omitempty"`
+}
+
+// DatabaseUpgradePhase is the state of a major version upgrade.
+type DatabaseUpgradePhase string
+
+const (
+	// DatabaseUpgradeDumping dumps the database of the previous version,
+	// with the API scaled down.
+	DatabaseUpgradeDumping DatabaseUpgradePhase = "Dumping"
+	// DatabaseUpgradeRestoring restores the dump into the new version.
+	DatabaseUpgradeRestoring DatabaseUpgradePhase = "Restoring"
+	DatabaseUpgradeSucceeded DatabaseUpgradePhase = "Succeeded"
+	// DatabaseUpgradeFailed is reached when the dump or the restore fails;
+	// the database is back on the previous version.
+	DatabaseUpgradeFailed DatabaseUpgradePhase = "Failed"
+	// DatabaseUpgradeRolledBack is reached when the version is set back to
+	// the previous one after an upgrade.
+	DatabaseUpgradeRolledBack DatabaseUpgradePhase = "RolledBack"
+)
+
+// DatabaseUpgradeStatus describes a major version upgrade of an in-cluster
+// database.
+type DatabaseUpgradeStatus struct {
+	// +kubebuilder:validation:Required
+	From string `json:"from"`
+	// +kubebuilder:validation:Required
+	To string `json:"to"`
+	// +kubebuilder:validation:Required
+	Phase DatabaseUpgradePhase `json:"phase"`
+	// +kubebuilder:validation:Optional
+	Message string `json:"message,omitempty"`
+	// +kubebuilder:validation:Optional
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+	// +kubebuilder:validation:Optional
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+	// RollbackVolumeClaim is the volume claim template of the volumes
+	// holding the data of From. They are kept until the next upgrade, and
+	// setting the version back to From while the phase is Succeeded rolls
+	// back to them. Changes made since the upgrade are lost then.
+	// +kubebuilder:validation:Optional
+	RollbackVolumeClaim string `json:"rollbackVolumeClaim,omitempty"`
+}
+
+// Running reports whether the upgrade holds the API scaled down.
+func (s *DatabaseUpgradeStatus) Running() bool {
+	return s != nil && (s.Phase == DatabaseUpgradeDumping || s.Phase == DatabaseUpgradeRestoring)
+}
+
+// MajorVersion returns the major version a postgres image tag starts with,
+// or -1.
+func MajorVersion(version string) int {
+	end := strings.IndexFunc(version, func(r rune) bool { return r < '0' || r > '9' })
+	if end < 0 {
+		end = len(version)
+	}
+	major, err := strconv.Atoi(version[:end])
+	if err != nil {
+		return -1
+	}
+	return major
+}
+
+// BuildPhase is the state of an image build.
+type BuildPhase string
+
+const (
+	BuildRunning   BuildPhase = "Running"
+	BuildSucceeded BuildPhase = "Succeeded"
+	BuildFailed    BuildPhase = "Failed"
+)
+
+// BuildStatus defines the observed state of the image build
+type BuildStatus struct {
+	// APIDescriptionHash is the hash of the description being built.
+	// +kubebuilder:validation:Optional
+	APIDescriptionHash string `json:"apiDescriptionHash,omitempty"`
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Enum=Running;Succeeded;Failed
+	Phase BuildPhase `json:"phase,omitempty"`
+	// Message holds the tail of the logs of a failed build.
+	// +kubebuilder:validation:Optional
+	Message string `json:"message,omitempty"`
+	// StartTime is when the build was submitted. A builder may give up on a
+	// build running for too long, which is then submitted again.
+	// +kubebuilder:validation:Optional
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+}
+
+// SchemaChangeKind classifies a change of the apiDescription by its effect
+// on the data.
+// +kubebuilder:validation:Enum=Additive;Compatible;Destructive
+type SchemaChangeKind string
+
+const (
+	SchemaChangeAdditive    SchemaChangeKind = "Additive"
+	SchemaChangeCompatible  SchemaChangeKind = "Compatible"
+	SchemaChangeDestructive SchemaChangeKind = "Destructive"
+)
+
+// SchemaChange is a change of the apiDescription
+type SchemaChange struct {
+	// +kubebuilder:validation:Required
+	Kind SchemaChangeKind `json:"kind"`
+	// Path locates the change in the apiDescription.
+	// +kubebuilder:validation:Required
+	Path string `json:"path"`
+	// +kubebuilder:validation:Optional
+	Message string `json:"message,omitempty"`
 }
 
 // +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
 // +kubebuilder:printcolumn:name="Image",type="string",JSONPath=".status.image"
-// +kubebuilder:printcolumn:name="Ready",type="boolean",JSONPath=".status.imageReady"
+// +kubebuilder:printcolumn:name="Ready",type="string",JSONPath=".status.conditions[?(@.type==\"Ready\")].status"
+// +kubebuilder:printcolumn:name="ImageReady",type="boolean",JSONPath=".status.imageReady"
 // +kubebuilder:printcolumn:name="Deployed",type="boolean",JSONPath=".status.deployed"
 // +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
 
@@ -59,6 +465,11 @@ type CRUD struct {
 	Status CRUDStatus `json:"status,omitempty"`
 }
 
+// ParseAPIDescription parses and validates Spec.APIDescription.
+func (c *CRUD) ParseAPIDescription() (*apidescription.Description, field.ErrorList) {
+	return apidescription.Parse(c.Spec.APIDescription, field.NewPath("spec", "apiDescription"))
+}
+
 func (c *CRUD) LabelSelectors() map[string]string {
 	return map[string]string{
 		"api.crudgen.org/selector": c.Name,
@@ -72,6 +483,23 @@ func (c *CRUD) DatabaseLabel() map[string]string {
 	}
 }
 
+// DatabaseRoleLabel tells the instances of an in-cluster database which one
+// is the primary. The orchestrator sets it on the pods, the services select
+// them by it.
+const DatabaseRoleLabel = "api.crudgen.org/database-role"
+
+const (
+	DatabaseRolePrimary = "primary"
+	DatabaseRoleReplica = "replica"
+)
+
+// DatabaseRoleLabels returns the labels of the database pods having role.
+func (c *CRUD) DatabaseRoleLabels(role string) map[string]string {
+	labels := c.DatabaseLabel()
+	labels[DatabaseRoleLabel] = role
+	return labels
+}
+
 func (c *CRUD) ServiceName() string {
 	return c.Name
 }
@@ -88,16 +516,64 @@ func (c *CRUD) DatabaseServiceName() string {
 	return fmt.Sprintf("%s-database", c.Name)
 }
 
+func (c *CRUD) DatabaseReadOnlyServiceName() string {
+	return fmt.Sprintf("%s-database-ro", c.Name)
+}
+
 func (c *CRUD) DatabaseStatefulName() string {
 	return c.Name
 }
 
-func (c *CRUD) DatabaseConfigMapName() string {
-	return "pgconfig" // TODO fix this hard code
+func (c *CRUD) DatabaseImage() string {
+	return fmt.Sprintf("postgres:%s", c.Spec.Database.Version)
+}
+
+// DatabaseServerImage is the image of the in-cluster database, which only
+// moves to another major version once the data has been upgraded.
+func (c *CRUD) DatabaseServerImage() string {
+	if c.Status.Database.Version == "" {
+		return c.DatabaseImage()
+	}
+	return fmt.Sprintf("postgres:%s", c.Status.Database.Version)
 }
 
-func (c *CRUD) DatabaseHost() string {
-	return fmt.Sprintf("psql://objectrocket:orkb123@%s:5432/ordb", c.DatabaseServiceName())
+// DatabaseVolumeClaimName is the volume claim template of the in-cluster
+// database.
+func (c *CRUD) DatabaseVolumeClaimName() string {
+	if c.Status.Database.VolumeClaim == "" {
+		return "ordb"
+	}
+	return c.Status.Database.VolumeClaim
+}
+
+func (c *CRUD) BackupCronJobName() string {
+	return fmt.Sprintf("%s-backup", c.Name)
+}
+
+func (c *CRUD) FinalBackupName() string {
+	return fmt.Sprintf("%s-final-backup", c.Name)
+}
+
+func (c *CRUD) DatabaseSecretName() string {
+	return fmt.Sprintf("%s-db-credentials", c.Name)
+}
+
+// InCluster reports whether the database runs in a StatefulSet of the
+// CRUD, rather than on a server the CRUD only has a database on.
+func (c *CRUD) InCluster() bool {
+	return c.Spec.Database.Mode == "" || c.Spec.Database.Mode == DatabaseModeInCluster
+}
+
+// DatabaseURL is the connection URL handed to the API as DATABASE_URL.
+// address is the host and port of the server.
+func (c *CRUD) DatabaseURL(address, user, password, database string) string {
+	u := url.URL{
+		Scheme: "psql",
+		User:   url.UserPassword(user, password),
+		Host:   address,
+		Path:   "/" + database,
+	}
+	return u.String()
 }
 
 // +kubebuilder:object:root=true
@@ -0,0 +1,424 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/utils/pointer"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// DomainPrefixField is the field index used to find CRUDs by domain prefix.
+const DomainPrefixField = "spec.domainPrefix"
+
+const (
+	defaultCPURequest            = "100m"
+	defaultMemoryRequest         = "128Mi"
+	defaultMemoryLimit           = "512Mi"
+	defaultMinReplicas           = 1
+	defaultMaxReplicas           = 10
+	defaultTargetCPUUtilization  = 80
+	defaultDatabaseVersion       = "13"
+	defaultDatabaseStorageSize   = "3G"
+	defaultDatabaseCPURequest    = "250m"
+	defaultDatabaseMemoryRequest = "256Mi"
+	defaultDatabaseMemoryLimit   = "1Gi"
+	defaultRevisionHistoryLimit  = 10
+	defaultBackupRetention       = 7
+	defaultS3Endpoint            = "https://s3.amazonaws.com"
+)
+
+var (
+	// AllowedDatabaseVersions are the postgres versions CRUDs may be created
+	// with or moved to, any when empty. It is set from the configuration of
+	// the operator.
+	AllowedDatabaseVersions []string
+
+	crudlog = logf.Log.WithName("crud-resource")
+	// crudReader is used to check that domain prefixes are unique. The
+	// validator interface gives no access to the manager, so it is set once
+	// in SetupWebhookWithManager.
+	crudReader client.Reader
+)
+
+// databaseVersionDefault is the version of the CRUDs created without one:
+// the highest major version allowed, the first one listed among equal
+// major versions.
+func databaseVersionDefault() string {
+	if len(AllowedDatabaseVersions) == 0 {
+		return defaultDatabaseVersion
+	}
+	version := AllowedDatabaseVersions[0]
+	for _, v := range AllowedDatabaseVersions[1:] {
+		if MajorVersion(v) > MajorVersion(version) {
+			version = v
+		}
+	}
+	return version
+}
+
+func (c *CRUD) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	err := mgr.GetFieldIndexer().IndexField(context.Background(), &CRUD{}, DomainPrefixField, func(obj runtime.Object) []string {
+		return []string{obj.(*CRUD).Spec.DomainPrefix}
+	})
+	if err != nil {
+		return err
+	}
+	crudReader = mgr.GetClient()
+
+	decoder, err := admission.NewDecoder(mgr.GetScheme())
+	if err != nil {
+		return err
+	}
+	mgr.GetWebhookServer().Register("/mutate-api-crudgen-org-v1-crud-author",
+		&webhook.Admission{Handler: &authorAnnotator{decoder: decoder}})
+
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(c).
+		Complete()
+}
+
+// +kubebuilder:webhook:path=/mutate-api-crudgen-org-v1-crud,mutating=true,failurePolicy=fail,groups=api.crudgen.org,resources=cruds,verbs=create;update,versions=v1,name=mcrud.kb.io
+
+var _ webhook.Defaulter = &CRUD{}
+
+// Default implements webhook.Defaulter so a webhook will be registered for the type
+func (c *CRUD) Default() {
+	crudlog.Info("default", "name", c.Name, "namespace", c.Namespace)
+
+	c.SetDefaults()
+}
+
+// SetDefaults fills in every unset field of the spec. It is also called by
+// the reconciler so that a CRUD admitted without the webhook behaves the same.
+func (c *CRUD) SetDefaults() {
+	spec := &c.Spec
+
+	if spec.DomainPrefix == "" {
+		spec.DomainPrefix = c.Name
+	}
+
+	if spec.Resources.Requests == nil {
+		spec.Resources.Requests = corev1.ResourceList{
+			corev1.ResourceCPU:    resource.MustParse(defaultCPURequest),
+			corev1.ResourceMemory: resource.MustParse(defaultMemoryRequest),
+		}
+	}
+	if spec.Resources.Limits == nil {
+		spec.Resources.Limits = corev1.ResourceList{
+			corev1.ResourceMemory: resource.MustParse(defaultMemoryLimit),
+		}
+	}
+
+	if spec.Autoscaling.MinReplicas == nil {
+		spec.Autoscaling.MinReplicas = pointer.Int32Ptr(defaultMinReplicas)
+	}
+	if spec.Autoscaling.MaxReplicas == 0 {
+		spec.Autoscaling.MaxReplicas = defaultMaxReplicas
+		if *spec.Autoscaling.MinReplicas > defaultMaxReplicas {
+			spec.Autoscaling.MaxReplicas = *spec.Autoscaling.MinReplicas
+		}
+	}
+	if spec.Autoscaling.TargetCPUUtilizationPercentage == nil {
+		spec.Autoscaling.TargetCPUUtilizationPercentage = pointer.Int32Ptr(defaultTargetCPUUtilization)
+	}
+
+	if spec.Database.Version == "" {
+		spec.Database.Version = databaseVersionDefault()
+	}
+	if spec.Database.Replicas == nil {
+		spec.Database.Replicas = pointer.Int32Ptr(1)
+	}
+	if spec.Database.Storage.Size == nil {
+		size := resource.MustParse(defaultDatabaseStorageSize)
+		spec.Database.Storage.Size = &size
+	}
+	if spec.Database.Resources.Requests == nil {
+		spec.Database.Resources.Requests = corev1.ResourceList{
+			corev1.ResourceCPU:    resource.MustParse(defaultDatabaseCPURequest),
+			corev1.ResourceMemory: resource.MustParse(defaultDatabaseMemoryRequest),
+		}
+	}
+	if spec.Database.Resources.Limits == nil {
+		spec.Database.Resources.Limits = corev1.ResourceList{
+			corev1.ResourceMemory: resource.MustParse(defaultDatabaseMemoryLimit),
+		}
+	}
+	if spec.Database.Mode == "" {
+		spec.Database.Mode = DatabaseModeInCluster
+	}
+	if spec.Database.DeletionPolicy == "" {
+		spec.Database.DeletionPolicy = DeletionPolicyDelete
+	}
+	if backup := spec.Database.Backup; backup != nil {
+		if backup.Retention == nil {
+			backup.Retention = pointer.Int32Ptr(defaultBackupRetention)
+		}
+		backup.Destination.SetDefaults()
+	}
+	if spec.RevisionHistoryLimit == nil {
+		spec.RevisionHistoryLimit = pointer.Int32Ptr(defaultRevisionHistoryLimit)
+	}
+}
+
+// SetDefaults sets the default values of the destination, shared by the
+// backups of a CRUD and the sources of restores.
+func (d *BackupDestination) SetDefaults() {
+	if s3 := d.S3; s3 != nil && s3.Endpoint == "" {
+		s3.Endpoint = defaultS3Endpoint
+	}
+}
+
+// +kubebuilder:webhook:verbs=create;update,path=/validate-api-crudgen-org-v1-crud,mutating=false,failurePolicy=fail,groups=api.crudgen.org,resources=cruds,versions=v1,name=vcrud.kb.io
+
+var _ webhook.Validator = &CRUD{}
+
+// ValidateCreate implements webhook.Validator so a webhook will be registered for the type
+func (c *CRUD) ValidateCreate() error {
+	crudlog.Info("validate create", "name", c.Name, "namespace", c.Namespace)
+
+	allErrs := c.validate()
+	allErrs = append(allErrs, c.validateDatabaseVersion(nil)...)
+	return c.toInvalid(allErrs)
+}
+
+// ValidateUpdate implements webhook.Validator so a webhook will be registered for the type
+//
+// Updates that leave the spec alone, such as removing a finalizer or adding a
+// request annotation, are not validated: a CRUD admitted before a rule was
+// added must still be deletable and operable.
+func (c *CRUD) ValidateUpdate(old runtime.Object) error {
+	crudlog.Info("validate update", "name", c.Name, "namespace", c.Namespace)
+
+	if c.DeletionTimestamp != nil || equality.Semantic.DeepEqual(c.Spec, old.(*CRUD).Spec) {
+		return nil
+	}
+	allErrs := c.validate()
+	allErrs = append(allErrs, c.validateImmutable(old.(*CRUD))...)
+	allErrs = append(allErrs, c.validateDatabaseVersion(old.(*CRUD))...)
+	return c.toInvalid(allErrs)
+}
+
+// ValidateDelete implements webhook.Validator so a webhook will be registered for the type
+func (c *CRUD) ValidateDelete() error {
+	return nil
+}
+
+func (c *CRUD) validate() field.ErrorList {
+	allErrs := field.ErrorList{}
+
+	_, errs := c.ParseAPIDescription()
+	allErrs = append(allErrs, errs...)
+	allErrs = append(allErrs, c.validateDomainPrefix()...)
+	allErrs = append(allErrs, c.validateBackup()...)
+	allErrs = append(allErrs, c.validateDatabaseMode()...)
+
+	autoscaling := c.Spec.Autoscaling
+	if autoscaling.MinReplicas != nil && autoscaling.MaxReplicas != 0 && *autoscaling.MinReplicas > autoscaling.MaxReplicas {
+		allErrs = append(allErrs, field.Invalid(field.NewPath("spec", "autoscaling", "maxReplicas"),
+			autoscaling.MaxReplicas, "must be greater than or equal to minReplicas"))
+	}
+	return allErrs
+}
+
+func (c *CRUD) validateDomainPrefix() field.ErrorList {
+	fldPath := field.NewPath("spec", "domainPrefix")
+
+	if msgs := validation.IsDNS1123Label(c.Spec.DomainPrefix); len(msgs) > 0 {
+		return field.ErrorList{field.Invalid(fldPath, c.Spec.DomainPrefix, strings.Join(msgs, ", "))}
+	}
+	if crudReader == nil {
+		return nil
+	}
+
+	cruds := &CRUDList{}
+	if err := crudReader.List(context.Background(), cruds, client.MatchingFields{DomainPrefixField: c.Spec.DomainPrefix}); err != nil {
+		return field.ErrorList{field.InternalError(fldPath, err)}
+	}
+	for _, other := range cruds.Items {
+		if other.Namespace == c.Namespace && other.Name == c.Name {
+			continue
+		}
+		return field.ErrorList{field.Duplicate(fldPath,
+			fmt.Sprintf("%s (claimed by %s/%s)", c.Spec.DomainPrefix, other.Namespace, other.Name))}
+	}
+	return nil
+}
+
+func (c *CRUD) validateBackup() field.ErrorList {
+	backup := c.Spec.Database.Backup
+	if backup == nil {
+		return nil
+	}
+	fldPath := field.NewPath("spec", "database", "backup")
+	allErrs := field.ErrorList{}
+
+	// the cron controller parses the schedule, only catch obvious mistakes
+	if !strings.HasPrefix(backup.Schedule, "@") && len(strings.Fields(backup.Schedule)) != 5 {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("schedule"), backup.Schedule,
+			"must have five fields or be a predefined schedule such as @daily"))
+	}
+	destination := backup.Destination
+	if (destination.PersistentVolumeClaim == nil) == (destination.S3 == nil) {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("destination"), "",
+			"exactly one of persistentVolumeClaim and s3 must be set"))
+	}
+	return allErrs
+}
+
+// databaseMode is the mode of the database, CRUDs created before the mode
+// existed running it in cluster.
+func (c *CRUD) databaseMode() DatabaseMode {
+	if c.Spec.Database.Mode == "" {
+		return DatabaseModeInCluster
+	}
+	return c.Spec.Database.Mode
+}
+
+func (c *CRUD) validateDatabaseMode() field.ErrorList {
+	fldPath := field.NewPath("spec", "database")
+	database := c.Spec.Database
+	allErrs := field.ErrorList{}
+
+	external := database.Mode == DatabaseModeExternal
+	switch {
+	case external && database.External == nil:
+		allErrs = append(allErrs, field.Required(fldPath.Child("external"), "must be set in External mode"))
+	case !external && database.External != nil:
+		allErrs = append(allErrs, field.Forbidden(fldPath.Child("external"), "may only be set in External mode"))
+	}
+
+	// the replicas of other modes are up to the server
+	if c.databaseMode() != DatabaseModeInCluster && database.Replicas != nil && *database.Replicas > 1 {
+		allErrs = append(allErrs, field.Forbidden(fldPath.Child("replicas"), "may only be set in InCluster mode"))
+	}
+
+	pool := database.Mode == DatabaseModePool
+	switch {
+	case !pool && database.Pool != nil:
+		allErrs = append(allErrs, field.Forbidden(fldPath.Child("pool"), "may only be set in Pool mode"))
+	case database.Pool != nil && database.Pool.Name != "" && database.Pool.Selector != nil:
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("pool"), "", "only one of name and selector may be set"))
+	case database.Pool != nil && database.Pool.Selector != nil:
+		if _, err := metav1.LabelSelectorAsSelector(database.Pool.Selector); err != nil {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("pool", "selector"), "", err.Error()))
+		}
+	}
+	return allErrs
+}
+
+// validateDatabaseVersion checks a new version against the allowed ones. The
+// data of a major version cannot be downgraded, except by rolling back the
+// last upgrade or giving up a failed one. old is nil on creation.
+func (c *CRUD) validateDatabaseVersion(old *CRUD) field.ErrorList {
+	fldPath := field.NewPath("spec", "database", "version")
+	version := c.Spec.Database.Version
+	if old != nil && version == old.Spec.Database.Version {
+		return nil
+	}
+
+	allErrs := field.ErrorList{}
+	if version != "" && MajorVersion(version) < 0 {
+		allErrs = append(allErrs, field.Invalid(fldPath, version, "must start with the major version"))
+	}
+	if len(AllowedDatabaseVersions) > 0 && version != "" {
+		allowed := false
+		for _, v := range AllowedDatabaseVersions {
+			allowed = allowed || v == version
+		}
+		if !allowed {
+			allErrs = append(allErrs, field.NotSupported(fldPath, version, AllowedDatabaseVersions))
+		}
+	}
+	if old == nil || old.Spec.Database.Version == "" {
+		return allErrs
+	}
+
+	upgrade := old.Status.Database.Upgrade
+	switch {
+	case upgrade.Running():
+		allErrs = append(allErrs, field.Forbidden(fldPath, "cannot change while the database is upgraded to "+upgrade.To))
+	case MajorVersion(version) >= MajorVersion(old.Spec.Database.Version):
+	case upgrade != nil && upgrade.Phase == DatabaseUpgradeSucceeded && version == upgrade.From:
+		// rolls back to the volumes of the previous version
+	case upgrade != nil && upgrade.Phase == DatabaseUpgradeFailed && MajorVersion(version) >= MajorVersion(upgrade.From):
+		// the database still runs the previous version
+	default:
+		allErrs = append(allErrs, field.Forbidden(fldPath,
+			fmt.Sprintf("cannot downgrade from %s to %s", old.Spec.Database.Version, version)))
+	}
+	return allErrs
+}
+
+// validateImmutable rejects changes to fields that cannot be changed once
+// the CRUD has been created.
+func (c *CRUD) validateImmutable(old *CRUD) field.ErrorList {
+	allErrs := field.ErrorList{}
+
+	// The description name is the name of the generated project, renaming it
+	// would orphan the existing database tables.
+	oldDesc, oldErrs := old.ParseAPIDescription()
+	newDesc, newErrs := c.ParseAPIDescription()
+	if len(oldErrs) == 0 && len(newErrs) == 0 && oldDesc.Name != newDesc.Name {
+		allErrs = append(allErrs, field.Invalid(field.NewPath("spec", "apiDescription", "name"), newDesc.Name, "field is immutable"))
+	}
+	// the data would stay behind on the previous server
+	if c.databaseMode() != old.databaseMode() {
+		allErrs = append(allErrs, field.Invalid(field.NewPath("spec", "database", "mode"), c.Spec.Database.Mode, "field is immutable"))
+	}
+	// volumes can be expanded but neither shrunk nor moved to another class
+	storagePath := field.NewPath("spec", "database", "storage")
+	if size, oldSize := c.Spec.Database.Storage.Size, old.Spec.Database.Storage.Size; size != nil && oldSize != nil && size.Cmp(*oldSize) < 0 {
+		allErrs = append(allErrs, field.Forbidden(storagePath.Child("size"),
+			fmt.Sprintf("volumes cannot shrink from %s to %s", oldSize, size)))
+	}
+	if class := c.Spec.Database.Storage.StorageClassName; !equality.Semantic.DeepEqual(class, old.Spec.Database.Storage.StorageClassName) {
+		value := ""
+		if class != nil {
+			value = *class
+		}
+		allErrs = append(allErrs, field.Invalid(storagePath.Child("storageClassName"), value, "field is immutable"))
+	}
+	if c.Spec.Database.Pool != nil && old.Spec.Database.Pool != nil &&
+		old.Spec.Database.Pool.Name != "" && c.Spec.Database.Pool.Name != old.Spec.Database.Pool.Name {
+		allErrs = append(allErrs, field.Invalid(field.NewPath("spec", "database", "pool", "name"), c.Spec.Database.Pool.Name, "field is immutable"))
+	}
+	return allErrs
+}
+
+func (c *CRUD) toInvalid(allErrs field.ErrorList) error {
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return apierrors.NewInvalid(schema.GroupKind{Group: GroupVersion.Group, Kind: "CRUD"}, c.Name, allErrs)
+}
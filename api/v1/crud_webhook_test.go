@@ -0,0 +1,335 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"context"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+const testDescription = `{
+  "name": "todolist",
+  "deploy_strategy": {"port": 8080},
+  "apps": [{
+    "name": "todo",
+    "models": [{
+      "name": "List",
+      "fields": [{"name": "title", "field_type": "CharField", "max_length": 30}],
+      "serializers": [{"name": "ListSerializer", "fields": ["id", "title"]}]
+    }],
+    "endpoints": [{
+      "path": "lists",
+      "endpoint_type": "simple_data_access",
+      "model": "List",
+      "serializer": "ListSerializer"
+    }]
+  }]
+}`
+
+func newTestCRUD(namespace, name, prefix string) *CRUD {
+	return &CRUD{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+		Spec: CRUDSpec{
+			APIDescription: testDescription,
+			DomainPrefix:   prefix,
+		},
+	}
+}
+
+var _ = Describe("CRUD validating webhook", func() {
+	AfterEach(func() {
+		crudReader = nil
+	})
+
+	It("accepts a valid CRUD", func() {
+		Expect(newTestCRUD("default", "todo", "todo").ValidateCreate()).To(Succeed())
+	})
+
+	It("rejects an invalid apiDescription", func() {
+		crud := newTestCRUD("default", "todo", "todo")
+		crud.Spec.APIDescription = strings.Replace(testDescription, "CharField", "CharFeld", 1)
+
+		err := crud.ValidateCreate()
+		Expect(apierrors.IsInvalid(err)).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring("spec.apiDescription.apps[0].models[0].fields[0].field_type"))
+	})
+
+	It("rejects a domain prefix that is not a DNS label", func() {
+		err := newTestCRUD("default", "todo", "Todo.List").ValidateCreate()
+		Expect(apierrors.IsInvalid(err)).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring("spec.domainPrefix"))
+	})
+
+	It("rejects a domain prefix claimed in another namespace", func() {
+		crudReader = &indexedReader{Client: fake.NewFakeClientWithScheme(testScheme(), newTestCRUD("team-a", "todo", "dupsdups"))}
+
+		Expect(newTestCRUD("team-a", "todo", "dupsdups").ValidateUpdate(newTestCRUD("team-a", "todo", "dupsdups"))).To(Succeed())
+		err := newTestCRUD("team-b", "todo", "dupsdups").ValidateCreate()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("team-a/todo"))
+	})
+
+	It("rejects renaming the description", func() {
+		old := newTestCRUD("default", "todo", "todo")
+		crud := newTestCRUD("default", "todo", "todo")
+		crud.Spec.APIDescription = strings.Replace(testDescription, `"todolist"`, `"todos"`, 1)
+
+		err := crud.ValidateUpdate(old)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("spec.apiDescription.name"))
+	})
+
+	It("rejects a backup with a malformed schedule or without a single destination", func() {
+		crud := newTestCRUD("default", "todo", "todo")
+		crud.Spec.Database.Backup = &DatabaseBackupSpec{
+			Schedule: "0 3 * *",
+			Destination: BackupDestination{
+				PersistentVolumeClaim: &PVCBackupDestination{ClaimName: "backups"},
+				S3:                    &S3BackupDestination{Bucket: "backups", CredentialsSecret: "s3"},
+			},
+		}
+
+		err := crud.ValidateCreate()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("spec.database.backup.schedule"))
+		Expect(err.Error()).To(ContainSubstring("spec.database.backup.destination"))
+
+		crud.Spec.Database.Backup.Schedule = "@daily"
+		crud.Spec.Database.Backup.Destination.S3 = nil
+		Expect(crud.ValidateCreate()).To(Succeed())
+	})
+
+	It("requires the server of an external database and rejects changing the mode", func() {
+		crud := newTestCRUD("default", "todo", "todo")
+		crud.Spec.Database.Mode = DatabaseModeExternal
+
+		err := crud.ValidateCreate()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("spec.database.external"))
+
+		crud.Spec.Database.External = &ExternalDatabaseSpec{AdminSecret: "pg-admin"}
+		Expect(crud.ValidateCreate()).To(Succeed())
+
+		err = crud.ValidateUpdate(newTestCRUD("default", "todo", "todo"))
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("spec.database.mode"))
+	})
+
+	It("rejects shrinking the database volume or changing its class", func() {
+		old := newTestCRUD("default", "todo", "todo")
+		old.Default()
+		crud := old.DeepCopy()
+		larger := resource.MustParse("10G")
+		crud.Spec.Database.Storage.Size = &larger
+		Expect(crud.ValidateUpdate(old)).To(Succeed())
+
+		err := old.ValidateUpdate(crud)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("spec.database.storage.size"))
+
+		crud.Spec.Database.Storage.StorageClassName = pointer.StringPtr("standard")
+		err = crud.ValidateUpdate(old)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("spec.database.storage.storageClassName"))
+	})
+
+	It("only accepts the allowed database versions", func() {
+		AllowedDatabaseVersions = []string{"12", "13"}
+		defer func() { AllowedDatabaseVersions = nil }()
+
+		crud := newTestCRUD("default", "todo", "todo")
+		crud.Spec.Database.Version = "12"
+		Expect(crud.ValidateCreate()).To(Succeed())
+
+		crud.Spec.Database.Version = "11"
+		err := crud.ValidateCreate()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("spec.database.version"))
+	})
+
+	It("defaults to the highest database version allowed", func() {
+		crud := newTestCRUD("default", "todo", "todo")
+		crud.Default()
+		Expect(crud.Spec.Database.Version).To(Equal("13"))
+
+		AllowedDatabaseVersions = []string{"14", "15.2", "15"}
+		defer func() { AllowedDatabaseVersions = nil }()
+		crud = newTestCRUD("default", "todo", "todo")
+		crud.Default()
+		Expect(crud.Spec.Database.Version).To(Equal("15.2"))
+		Expect(crud.ValidateCreate()).To(Succeed())
+	})
+
+	It("rejects downgrading the database unless rolling back an upgrade", func() {
+		old := newTestCRUD("default", "todo", "todo")
+		old.Spec.Database.Version = "13"
+		crud := old.DeepCopy()
+		crud.Spec.Database.Version = "12.4"
+		err := crud.ValidateUpdate(old)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("cannot downgrade"))
+
+		old.Status.Database.Upgrade = &DatabaseUpgradeStatus{From: "12.4", To: "13", Phase: DatabaseUpgradeSucceeded}
+		Expect(crud.ValidateUpdate(old)).To(Succeed())
+
+		old.Status.Database.Upgrade.Phase = DatabaseUpgradeRestoring
+		crud.Spec.Database.Version = "14"
+		err = crud.ValidateUpdate(old)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("while the database is upgraded"))
+	})
+
+	It("only runs database replicas in cluster", func() {
+		crud := newTestCRUD("default", "todo", "todo")
+		crud.Spec.Database.Replicas = pointer.Int32Ptr(3)
+		Expect(crud.ValidateCreate()).To(Succeed())
+
+		crud.Spec.Database.Mode = DatabaseModeExternal
+		crud.Spec.Database.External = &ExternalDatabaseSpec{AdminSecret: "pg-admin"}
+		err := crud.ValidateCreate()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("spec.database.replicas"))
+	})
+
+	It("does not validate updates that leave the spec alone", func() {
+		old := newTestCRUD("default", "todo", "todo")
+		old.Spec.APIDescription = strings.Replace(testDescription, "CharField", "CharFeld", 1)
+		old.Finalizers = []string{CRUDFinalizer}
+
+		crud := old.DeepCopy()
+		crud.Annotations = map[string]string{RotateCredentialsAnnotation: "1"}
+		Expect(crud.ValidateUpdate(old)).To(Succeed())
+
+		// removing the finalizer of a CRUD being deleted
+		now := metav1.Now()
+		old.DeletionTimestamp = &now
+		crud = old.DeepCopy()
+		crud.Finalizers = nil
+		Expect(crud.ValidateUpdate(old)).To(Succeed())
+
+		// but changes to the spec are validated
+		old.DeletionTimestamp = nil
+		crud = old.DeepCopy()
+		crud.Spec.DomainPrefix = "todos"
+		err := crud.ValidateUpdate(old)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("spec.apiDescription"))
+	})
+
+	It("only accepts a pool name or a selector in Pool mode", func() {
+		crud := newTestCRUD("default", "todo", "todo")
+		crud.Spec.Database.Pool = &DatabasePoolReference{Name: "shared"}
+
+		err := crud.ValidateCreate()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("spec.database.pool"))
+
+		crud.Spec.Database.Mode = DatabaseModePool
+		Expect(crud.ValidateCreate()).To(Succeed())
+
+		crud.Spec.Database.Pool.Selector = &metav1.LabelSelector{MatchLabels: map[string]string{"tier": "standard"}}
+		err = crud.ValidateCreate()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("only one of name and selector"))
+
+		old := crud.DeepCopy()
+		crud.Spec.Database.Pool = &DatabasePoolReference{Name: "other"}
+		old.Spec.Database.Pool.Selector = nil
+		err = crud.ValidateUpdate(old)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("spec.database.pool.name"))
+	})
+})
+
+// indexedReader emulates the domain prefix field index on top of the fake
+// client, which does not support field selectors.
+type indexedReader struct {
+	client.Client
+}
+
+func (r *indexedReader) List(ctx context.Context, list runtime.Object, opts ...client.ListOption) error {
+	listOpts := &client.ListOptions{}
+	listOpts.ApplyOptions(opts)
+	prefix, _ := listOpts.FieldSelector.RequiresExactMatch(DomainPrefixField)
+
+	all := &CRUDList{}
+	if err := r.Client.List(ctx, all); err != nil {
+		return err
+	}
+	cruds := list.(*CRUDList)
+	for _, crud := range all.Items {
+		if crud.Spec.DomainPrefix == prefix {
+			cruds.Items = append(cruds.Items, crud)
+		}
+	}
+	return nil
+}
+
+func testScheme() *runtime.Scheme {
+	s := runtime.NewScheme()
+	Expect(AddToScheme(s)).To(Succeed())
+	return s
+}
+
+var _ = Describe("CRUD defaulting webhook", func() {
+	It("fills in the spec from the name and the description", func() {
+		crud := newTestCRUD("default", "todo", "")
+		crud.Default()
+
+		Expect(crud.Spec.DomainPrefix).To(Equal("todo"))
+		Expect(*crud.Spec.Autoscaling.MinReplicas).To(Equal(int32(1)))
+		Expect(crud.Spec.Autoscaling.MaxReplicas).To(Equal(int32(10)))
+		Expect(crud.Spec.Resources.Requests).To(HaveKey(corev1.ResourceCPU))
+		Expect(crud.DatabaseImage()).To(Equal("postgres:13"))
+		Expect(crud.Spec.Database.Storage.Size.String()).To(Equal("3G"))
+		Expect(*crud.Spec.Database.Replicas).To(Equal(int32(1)))
+		Expect(crud.Spec.Database.Resources.Requests).To(HaveKey(corev1.ResourceMemory))
+		Expect(crud.Spec.Database.Resources.Limits).To(HaveKey(corev1.ResourceMemory))
+	})
+
+	It("fills in the backup retention and S3 endpoint", func() {
+		crud := newTestCRUD("default", "todo", "")
+		crud.Spec.Database.Backup = &DatabaseBackupSpec{
+			Schedule:    "0 3 * * *",
+			Destination: BackupDestination{S3: &S3BackupDestination{Bucket: "backups", CredentialsSecret: "s3"}},
+		}
+		crud.Default()
+
+		Expect(*crud.Spec.Database.Backup.Retention).To(Equal(int32(7)))
+		Expect(crud.Spec.Database.Backup.Destination.S3.Endpoint).To(Equal("https://s3.amazonaws.com"))
+	})
+
+	It("keeps values that are already set", func() {
+		crud := newTestCRUD("default", "todo", "api")
+		crud.Spec.Autoscaling.MinReplicas = pointer.Int32Ptr(12)
+		crud.Default()
+
+		Expect(crud.Spec.DomainPrefix).To(Equal("api"))
+		Expect(crud.Spec.Autoscaling.MaxReplicas).To(Equal(int32(12)))
+	})
+})
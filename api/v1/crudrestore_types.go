@@ -0,0 +1,110 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// RestoreAnnotation is set on a CRUD by the CRUDRestore replacing its
+// database. The API is scaled down while it is set.
+const RestoreAnnotation = "api.crudgen.org/restore"
+
+// CRUDRestoreSpec defines the desired state of CRUDRestore
+type CRUDRestoreSpec struct {
+	// CRUD is the name of the CRUD, in the namespace of the restore, whose
+	// database is replaced by the backup.
+	// +kubebuilder:validation:Required
+	CRUD string `json:"crud"`
+	// Backup is the name of the backup file, e.g. todolist-20210102030000.dump.
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:Pattern=`^[^/]+\.dump$`
+	Backup string `json:"backup"`
+	// Source holds the backup. Defaults to the backup destination of the
+	// CRUD; set it to restore the backup of another CRUD, e.g. to clone
+	// production data into a staging CRUD.
+	// +kubebuilder:validation:Optional
+	Source *BackupDestination `json:"source,omitempty"`
+}
+
+// RestorePhase is the state of a restore.
+type RestorePhase string
+
+const (
+	// RestorePending waits for the database of the CRUD to be ready, or for
+	// another restore of the same CRUD to complete.
+	RestorePending RestorePhase = "Pending"
+	// RestoreScalingDown waits for the API pods to be gone.
+	RestoreScalingDown RestorePhase = "ScalingDown"
+	// RestoreRunning restores the backup and migrates it to the current
+	// image of the CRUD.
+	RestoreRunning   RestorePhase = "Running"
+	RestoreSucceeded RestorePhase = "Succeeded"
+	RestoreFailed    RestorePhase = "Failed"
+)
+
+// CRUDRestoreStatus defines the observed state of CRUDRestore
+type CRUDRestoreStatus struct {
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Enum=Pending;ScalingDown;Running;Succeeded;Failed
+	Phase RestorePhase `json:"phase,omitempty"`
+	// Message details the phase, e.g. why the restore failed.
+	// +kubebuilder:validation:Optional
+	Message string `json:"message,omitempty"`
+	// +kubebuilder:validation:Optional
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+	// +kubebuilder:validation:Optional
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+}
+
+// Finished reports whether the restore is over, successful or not.
+func (s *CRUDRestoreStatus) Finished() bool {
+	return s.Phase == RestoreSucceeded || s.Phase == RestoreFailed
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="CRUD",type="string",JSONPath=".spec.crud"
+// +kubebuilder:printcolumn:name="Backup",type="string",JSONPath=".spec.backup"
+// +kubebuilder:printcolumn:name="Phase",type="string",JSONPath=".status.phase"
+// +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
+
+// CRUDRestore is the Schema for the crudrestores API
+type CRUDRestore struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   CRUDRestoreSpec   `json:"spec,omitempty"`
+	Status CRUDRestoreStatus `json:"status,omitempty"`
+}
+
+func (r *CRUDRestore) JobName() string {
+	return r.Name + "-restore"
+}
+
+// +kubebuilder:object:root=true
+
+// CRUDRestoreList contains a list of CRUDRestore
+type CRUDRestoreList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []CRUDRestore `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&CRUDRestore{}, &CRUDRestoreList{})
+}
@@ -0,0 +1,92 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// DatabasePoolSpec defines the desired state of DatabasePool
+type DatabasePoolSpec struct {
+	// AdminSecret references a secret holding the host, port, username and
+	// password keys of the instance, as the admin secret of External mode
+	// does. It never leaves its namespace: the jobs creating and dropping
+	// the databases of the pool run there.
+	// +kubebuilder:validation:Required
+	AdminSecret corev1.SecretReference `json:"adminSecret"`
+	// MaxDatabases is the number of CRUDs the instance accepts.
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:Minimum=1
+	MaxDatabases int32 `json:"maxDatabases"`
+}
+
+// PoolDatabase is the database of a CRUD in a pool
+type PoolDatabase struct {
+	// +kubebuilder:validation:Required
+	Namespace string `json:"namespace"`
+	// CRUD is the name of the CRUD.
+	// +kubebuilder:validation:Required
+	CRUD string `json:"crud"`
+	// Ready is true once the database has been created on the instance.
+	// +kubebuilder:validation:Optional
+	Ready bool `json:"ready"`
+}
+
+// DatabasePoolStatus defines the observed state of DatabasePool
+type DatabasePoolStatus struct {
+	// Allocated is the number of CRUDs using the pool.
+	// +kubebuilder:validation:Optional
+	Allocated int32 `json:"allocated"`
+	// Available is the number of CRUDs the pool can still accept.
+	// +kubebuilder:validation:Optional
+	Available int32 `json:"available"`
+	// Databases lists the CRUDs using the pool.
+	// +kubebuilder:validation:Optional
+	Databases []PoolDatabase `json:"databases,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:scope=Cluster
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Max",type="integer",JSONPath=".spec.maxDatabases"
+// +kubebuilder:printcolumn:name="Allocated",type="integer",JSONPath=".status.allocated"
+// +kubebuilder:printcolumn:name="Available",type="integer",JSONPath=".status.available"
+// +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
+
+// DatabasePool is a shared postgres instance hosting the databases of CRUDs
+// in Pool mode
+type DatabasePool struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   DatabasePoolSpec   `json:"spec,omitempty"`
+	Status DatabasePoolStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// DatabasePoolList contains a list of DatabasePool
+type DatabasePoolList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []DatabasePool `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&DatabasePool{}, &DatabasePoolList{})
+}
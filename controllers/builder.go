@@ -0,0 +1,40 @@
+package controllers
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+
+	apiv1 "github.com/crudgen-org/crudgen-orchestrator/api/v1"
+)
+
+// Builder builds the image of the API description of a CRUD. A build is
+// identified by the CRUD and the hash of the description it builds.
+type Builder interface {
+	// Submit starts building the description of crud. Submitting a build
+	// that is already running must not start another one.
+	Submit(ctx context.Context, crud *apiv1.CRUD, hash string) error
+	// Poll returns the image built for the description of crud, or nil if
+	// the build is still running. A failed build is reported as a
+	// *BuildFailedError and an unknown one as ErrBuildNotFound, in which
+	// case the build is submitted again.
+	Poll(ctx context.Context, crud *apiv1.CRUD, hash string) (*BuildResult, error)
+}
+
+// ErrBuildNotFound is returned by Poll for a build the builder does not know.
+var ErrBuildNotFound = errors.New("build not found")
+
+// BuildFailedError is returned by Poll when a build has failed for good.
+type BuildFailedError struct {
+	Message string
+}
+
+func (e *BuildFailedError) Error() string {
+	return "image build failed: " + e.Message
+}
+
+// BuildResult describes a successfully built image.
+type BuildResult struct {
+	Image string
+	Port  int32
+}
@@ -0,0 +1,156 @@
+package controllers
+
+import (
+	"context"
+	"strings"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	apiv1 "github.com/crudgen-org/crudgen-orchestrator/api/v1"
+	"github.com/crudgen-org/crudgen-orchestrator/pkg/apidescription"
+)
+
+const testDescription = `{
+  "name": "todolist",
+  "deploy_strategy": {"port": 8080},
+  "apps": [{
+    "name": "todo",
+    "models": [{
+      "name": "List",
+      "fields": [{"name": "title", "field_type": "CharField", "max_length": 30}],
+      "serializers": [{"name": "ListSerializer", "fields": ["id", "title"]}]
+    }],
+    "endpoints": [{
+      "path": "lists",
+      "endpoint_type": "simple_data_access",
+      "model": "List",
+      "serializer": "ListSerializer"
+    }]
+  }]
+}`
+
+// fakeBuilder records the submitted builds and returns the result set by
+// the test when polled.
+type fakeBuilder struct {
+	submitted []string
+	result    *BuildResult
+	err       error
+}
+
+var _ Builder = &fakeBuilder{}
+
+func (b *fakeBuilder) Submit(ctx context.Context, crud *apiv1.CRUD, hash string) error {
+	b.submitted = append(b.submitted, hash)
+	return nil
+}
+
+func (b *fakeBuilder) Poll(ctx context.Context, crud *apiv1.CRUD, hash string) (*BuildResult, error) {
+	return b.result, b.err
+}
+
+func newTestCRUD() *apiv1.CRUD {
+	return &apiv1.CRUD{
+		ObjectMeta: meta.ObjectMeta{Namespace: "default", Name: "todolist"},
+		Spec:       apiv1.CRUDSpec{APIDescription: testDescription},
+	}
+}
+
+var _ = Describe("reconcileImage", func() {
+	var (
+		ctx     context.Context
+		logger  logr.Logger
+		builder *fakeBuilder
+		r       *CRUDReconciler
+		crud    *apiv1.CRUD
+		hash    string
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		logger = logf.Log.WithName("test")
+		builder = &fakeBuilder{}
+		r = &CRUDReconciler{Builder: builder}
+		crud = newTestCRUD()
+		var err error
+		hash, err = apidescription.Hash(crud.Spec.APIDescription)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("submits a build for a new description", func() {
+		Expect(r.reconcileImage(ctx, logger, crud)).To(Succeed())
+		Expect(builder.submitted).To(Equal([]string{hash}))
+		Expect(crud.Status.Build.APIDescriptionHash).To(Equal(hash))
+		Expect(crud.Status.Build.Phase).To(Equal(apiv1.BuildRunning))
+		Expect(crud.Status.Build.StartTime).NotTo(BeNil())
+		Expect(crud.Status.ImageReady).To(BeFalse())
+	})
+
+	It("records the built image", func() {
+		crud.Status.Build = apiv1.BuildStatus{APIDescriptionHash: hash, Phase: apiv1.BuildRunning}
+		builder.result = &BuildResult{Image: "registry/todolist@sha256:1234", Port: 8080}
+
+		Expect(r.reconcileImage(ctx, logger, crud)).To(Succeed())
+		Expect(builder.submitted).To(BeEmpty())
+		Expect(crud.Status.Build.Phase).To(Equal(apiv1.BuildSucceeded))
+		Expect(crud.Status.ImageReady).To(BeTrue())
+		Expect(crud.Status.Image).To(Equal("registry/todolist@sha256:1234"))
+		Expect(crud.Status.Port).To(Equal(int32(8080)))
+		Expect(crud.Status.APIDescriptionHash).To(Equal(hash))
+	})
+
+	It("reports a failed build in the ImageReady condition", func() {
+		crud.Status.Build = apiv1.BuildStatus{APIDescriptionHash: hash, Phase: apiv1.BuildRunning}
+		builder.err = &BuildFailedError{Message: "kaniko exited with code 1: no space left"}
+
+		Expect(r.reconcileImage(ctx, logger, crud)).To(Succeed())
+		Expect(crud.Status.Build.Phase).To(Equal(apiv1.BuildFailed))
+		cond := imageCondition(crud)
+		Expect(cond.Reason).To(Equal("BuildFailed"))
+		Expect(cond.Message).To(ContainSubstring("no space left"))
+	})
+
+	It("submits a build again when the builder lost it", func() {
+		crud.Status.Build = apiv1.BuildStatus{APIDescriptionHash: hash, Phase: apiv1.BuildFailed}
+		builder.err = ErrBuildNotFound
+
+		Expect(r.reconcileImage(ctx, logger, crud)).To(Succeed())
+		Expect(builder.submitted).To(Equal([]string{hash}))
+		Expect(crud.Status.Build.Phase).To(Equal(apiv1.BuildRunning))
+	})
+
+	It("keeps an image built from the current description", func() {
+		crud.Status.ImageReady = true
+		crud.Status.Image = "registry/todolist@sha256:1234"
+		crud.Status.APIDescriptionHash = hash
+
+		Expect(r.reconcileImage(ctx, logger, crud)).To(Succeed())
+		Expect(builder.submitted).To(BeEmpty())
+		Expect(imageUpToDate(crud)).To(BeTrue())
+	})
+
+	It("marks an image built from another description as stale", func() {
+		crud.Status.ImageReady = true
+		crud.Status.Image = "registry/todolist@sha256:1234"
+		crud.Status.APIDescriptionHash = "0123456789abcdef"
+		Expect(imageCondition(crud).Reason).To(Equal("ImageStale"))
+
+		Expect(r.reconcileImage(ctx, logger, crud)).To(Succeed())
+		Expect(crud.Status.ImageReady).To(BeFalse())
+		Expect(imageUpToDate(crud)).To(BeFalse())
+		Expect(builder.submitted).To(Equal([]string{hash}))
+		Expect(imageCondition(crud).Reason).To(Equal("Building"))
+	})
+
+	It("ignores whitespace changes in the description", func() {
+		crud.Status.ImageReady = true
+		crud.Status.Image = "registry/todolist@sha256:1234"
+		crud.Status.APIDescriptionHash = hash
+		crud.Spec.APIDescription = strings.Replace(testDescription, "\n", "\n\t", -1)
+
+		Expect(imageUpToDate(crud)).To(BeTrue())
+	})
+})
@@ -0,0 +1,280 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	batch "k8s.io/api/batch/v1"
+	core "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/pointer"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	apiv1 "github.com/crudgen-org/crudgen-orchestrator/api/v1"
+)
+
+const finalBackupPollInterval = 10 * time.Second
+
+// +kubebuilder:rbac:groups="",resources=persistentvolumeclaims,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;update;patch;delete
+
+func (r *CRUDReconciler) reconcileCleanUp(ctx context.Context, logger logr.Logger, crud *apiv1.CRUD) (ctrl.Result, error) {
+	if !controllerutil.ContainsFinalizer(crud, apiv1.CRUDFinalizer) {
+		return ctrl.Result{}, nil
+	}
+	crud.SetDefaults()
+
+	switch crud.Spec.Database.DeletionPolicy {
+	case apiv1.DeletionPolicyRetain:
+		if err := r.orphanDatabaseVolumes(ctx, logger, crud); err != nil {
+			return ctrl.Result{}, err
+		}
+		if err := r.orphanDatabaseSecret(ctx, logger, crud); err != nil {
+			return ctrl.Result{}, err
+		}
+
+	case apiv1.DeletionPolicySnapshot:
+		done, err := r.ensureFinalBackup(ctx, logger, crud)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if !done {
+			return ctrl.Result{RequeueAfter: finalBackupPollInterval}, r.updateStatus(ctx, crud)
+		}
+		if done, err := r.deleteDatabase(ctx, logger, crud); err != nil || !done {
+			return ctrl.Result{RequeueAfter: finalBackupPollInterval}, err
+		}
+
+	default:
+		if done, err := r.deleteDatabase(ctx, logger, crud); err != nil || !done {
+			return ctrl.Result{RequeueAfter: finalBackupPollInterval}, err
+		}
+	}
+	if err := r.deletePoolCredentials(ctx, crud); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	patch := client.MergeFromWithOptions(crud.DeepCopy(), client.MergeFromWithOptimisticLock{})
+	controllerutil.RemoveFinalizer(crud, apiv1.CRUDFinalizer)
+	if err := r.Patch(ctx, crud, patch); err != nil {
+		return ctrl.Result{}, errors.Wrap(err, "could not remove finalizer")
+	}
+	return ctrl.Result{}, nil
+}
+
+func (r *CRUDReconciler) ensureFinalizer(ctx context.Context, crud *apiv1.CRUD) error {
+	if controllerutil.ContainsFinalizer(crud, apiv1.CRUDFinalizer) {
+		return nil
+	}
+	patch := client.MergeFromWithOptions(crud.DeepCopy(), client.MergeFromWithOptimisticLock{})
+	controllerutil.AddFinalizer(crud, apiv1.CRUDFinalizer)
+	if err := r.Patch(ctx, crud, patch); err != nil {
+		return errors.Wrap(err, "could not add finalizer")
+	}
+	return nil
+}
+
+func (r *CRUDReconciler) listDatabaseVolumes(ctx context.Context, crud *apiv1.CRUD) (*core.PersistentVolumeClaimList, error) {
+	pvcs := &core.PersistentVolumeClaimList{}
+	err := r.List(ctx, pvcs, client.InNamespace(crud.Namespace), client.MatchingLabels(crud.DatabaseLabel()))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not list database volumes")
+	}
+	return pvcs, nil
+}
+
+// deleteDatabase deletes the data of the CRUD and reports whether it is
+// done: the volumes of the StatefulSet, or the database on the external
+// server or the pool.
+func (r *CRUDReconciler) deleteDatabase(ctx context.Context, logger logr.Logger, crud *apiv1.CRUD) (bool, error) {
+	switch {
+	case crud.Spec.Database.Mode == apiv1.DatabaseModePool && crud.Status.Database.Pool == "":
+		// no database was allocated
+		return true, nil
+	case !crud.InCluster():
+		return r.dropExternalDatabase(ctx, logger, crud)
+	}
+	return true, r.deleteDatabaseVolumes(ctx, logger, crud)
+}
+
+func (r *CRUDReconciler) deleteDatabaseVolumes(ctx context.Context, logger logr.Logger, crud *apiv1.CRUD) error {
+	pvcs, err := r.listDatabaseVolumes(ctx, crud)
+	if err != nil {
+		return err
+	}
+	for i := range pvcs.Items {
+		pvc := &pvcs.Items[i]
+		logger.Info("deleting database volume", "pvc", pvc.Name)
+		if err := r.Delete(ctx, pvc); err != nil && !apierrors.IsNotFound(err) {
+			return errors.Wrap(err, "could not delete database volume")
+		}
+	}
+	return nil
+}
+
+// orphanDatabaseVolumes makes sure nothing garbage collects the database
+// volumes once the CRUD is gone.
+func (r *CRUDReconciler) orphanDatabaseVolumes(ctx context.Context, logger logr.Logger, crud *apiv1.CRUD) error {
+	pvcs, err := r.listDatabaseVolumes(ctx, crud)
+	if err != nil {
+		return err
+	}
+	for i := range pvcs.Items {
+		pvc := &pvcs.Items[i]
+		if len(pvc.OwnerReferences) == 0 {
+			continue
+		}
+		logger.Info("orphaning database volume", "pvc", pvc.Name)
+		patch := client.MergeFrom(pvc.DeepCopy())
+		pvc.OwnerReferences = nil
+		if err := r.Patch(ctx, pvc, patch); err != nil {
+			return errors.Wrap(err, "could not orphan database volume")
+		}
+	}
+	return nil
+}
+
+// orphanDatabaseSecret keeps the credentials of retained volumes around.
+func (r *CRUDReconciler) orphanDatabaseSecret(ctx context.Context, logger logr.Logger, crud *apiv1.CRUD) error {
+	key := key(crud)
+	key.Name = crud.DatabaseSecretName()
+
+	secret := &core.Secret{}
+	switch err := r.Get(ctx, key, secret); {
+	case apierrors.IsNotFound(err):
+		return nil
+	case err != nil:
+		return errors.Wrap(err, "could not retrieve database secret")
+	}
+	if len(secret.OwnerReferences) == 0 {
+		return nil
+	}
+	logger.Info("orphaning database secret", "secret", secret.Name)
+	patch := client.MergeFrom(secret.DeepCopy())
+	secret.OwnerReferences = nil
+	if err := r.Patch(ctx, secret, patch); err != nil {
+		return errors.Wrap(err, "could not orphan database secret")
+	}
+	return nil
+}
+
+// ensureFinalBackup dumps the database into a volume that outlives the CRUD
+// and reports whether the dump has completed. A failed dump is reported in
+// the FinalBackupFailed condition and an event; it is retried once its job
+// is deleted.
+func (r *CRUDReconciler) ensureFinalBackup(ctx context.Context, logger logr.Logger, crud *apiv1.CRUD) (bool, error) {
+	key := key(crud)
+	key.Name = crud.FinalBackupName()
+
+	pvc := &core.PersistentVolumeClaim{}
+	switch err := r.Get(ctx, key, pvc); {
+	case apierrors.IsNotFound(err):
+		pvc = &core.PersistentVolumeClaim{
+			ObjectMeta: meta.ObjectMeta{
+				Name:      crud.FinalBackupName(),
+				Namespace: crud.Namespace,
+			},
+			Spec: core.PersistentVolumeClaimSpec{
+				AccessModes: []core.PersistentVolumeAccessMode{
+					"ReadWriteOnce",
+				},
+				Resources: core.ResourceRequirements{
+					Requests: map[core.ResourceName]resource.Quantity{
+						"storage": *crud.Spec.Database.Storage.Size,
+					},
+				},
+			},
+		}
+		// no owner reference: the backup must survive the CRUD
+		if err := r.Create(ctx, pvc); err != nil {
+			return false, errors.Wrap(err, "could not create final backup volume")
+		}
+
+	case err != nil:
+		return false, errors.Wrap(err, "could not retrieve final backup volume")
+	}
+
+	job := &batch.Job{}
+	switch err := r.Get(ctx, key, job); {
+	case apierrors.IsNotFound(err):
+		job = &batch.Job{
+			ObjectMeta: meta.ObjectMeta{
+				Name:      crud.FinalBackupName(),
+				Namespace: crud.Namespace,
+			},
+			Spec: batch.JobSpec{
+				BackoffLimit: pointer.Int32Ptr(3),
+				Template: core.PodTemplateSpec{
+					Spec: core.PodSpec{
+						RestartPolicy: core.RestartPolicyOnFailure,
+						Containers: []core.Container{
+							{
+								Name:    "pg-dump",
+								Image:   crud.DatabaseImage(),
+								Command: []string{"sh", "-c", `pg_dump --format=custom --file=/backup/final-$(date +%Y%m%d%H%M%S).dump`},
+								Env:     databaseClientEnv(crud),
+								VolumeMounts: []core.VolumeMount{
+									{
+										Name:      "backup",
+										MountPath: "/backup",
+									},
+								},
+							},
+						},
+						Volumes: []core.Volume{
+							{
+								Name: "backup",
+								VolumeSource: core.VolumeSource{
+									PersistentVolumeClaim: &core.PersistentVolumeClaimVolumeSource{
+										ClaimName: crud.FinalBackupName(),
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		}
+		if err := controllerutil.SetControllerReference(crud, job, r.Scheme); err != nil {
+			return false, errors.Wrap(err, "could not set owner reference on final backup job")
+		}
+		logger.Info("starting final database backup", "pvc", pvc.Name)
+		if err := r.Create(ctx, job); err != nil {
+			return false, errors.Wrap(err, "could not create final backup job")
+		}
+		return false, nil
+
+	case err != nil:
+		return false, errors.Wrap(err, "could not retrieve final backup job")
+	}
+
+	cond := jobFinished(job)
+	switch {
+	case cond == nil:
+		if crud.Status.GetCondition(apiv1.ConditionFinalBackupFailed) != nil {
+			crud.Status.SetCondition(newCondition(apiv1.ConditionFinalBackupFailed, false, "FinalBackupRunning",
+				"the final backup is being retried"))
+		}
+		return false, nil
+
+	case cond.Type == batch.JobComplete:
+		return true, nil
+	}
+
+	// keep the finalizer: deleting the volumes now would lose the data
+	logger.Info("final database backup failed", "job", job.Name, "reason", cond.Reason, "message", cond.Message)
+	if !crud.Status.IsConditionTrue(apiv1.ConditionFinalBackupFailed) {
+		message := fmt.Sprintf("final backup job %s failed: %s. Delete the job to retry the backup, "+
+			"or set spec.database.deletionPolicy to Retain or Delete to proceed without it", job.Name, cond.Message)
+		r.Recorder.Event(crud, core.EventTypeWarning, "FinalBackupFailed", message)
+		crud.Status.SetCondition(newCondition(apiv1.ConditionFinalBackupFailed, true, "FinalBackupFailed", message))
+	}
+	return false, nil
+}
@@ -0,0 +1,202 @@
+package controllers
+
+import (
+	"context"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	batch "k8s.io/api/batch/v1"
+	core "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	apiv1 "github.com/crudgen-org/crudgen-orchestrator/api/v1"
+)
+
+var _ = Describe("CRUD deletion", func() {
+	var (
+		ctx      context.Context
+		logger   logr.Logger
+		recorder *record.FakeRecorder
+		r        *CRUDReconciler
+		crud     *apiv1.CRUD
+	)
+
+	owned := func() []meta.OwnerReference {
+		return []meta.OwnerReference{{APIVersion: apiv1.GroupVersion.String(), Kind: "CRUD", Name: crud.Name, UID: crud.UID}}
+	}
+
+	var (
+		volume *core.PersistentVolumeClaim
+		secret *core.Secret
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		logger = logf.Log.WithName("test")
+		crud = newTestCRUD()
+		crud.UID = "1234"
+		crud.ResourceVersion = "1"
+		crud.SetDefaults()
+
+		volume = &core.PersistentVolumeClaim{
+			ObjectMeta: meta.ObjectMeta{
+				Namespace:       crud.Namespace,
+				Name:            "ordb-" + crud.DatabaseStatefulName() + "-0",
+				Labels:          crud.DatabaseLabel(),
+				OwnerReferences: owned(),
+			},
+		}
+		secret = &core.Secret{
+			ObjectMeta: meta.ObjectMeta{
+				Namespace:       crud.Namespace,
+				Name:            crud.DatabaseSecretName(),
+				OwnerReferences: owned(),
+			},
+		}
+		s := testScheme()
+		recorder = record.NewFakeRecorder(10)
+		r = &CRUDReconciler{
+			Client:   fake.NewFakeClientWithScheme(s, crud, volume.DeepCopy(), secret.DeepCopy()),
+			Scheme:   s,
+			Recorder: recorder,
+		}
+		Expect(r.ensureFinalizer(ctx, crud)).To(Succeed())
+	})
+
+	// cleanUp reconciles the latest version of crud
+	cleanUp := func() {
+		latest := &apiv1.CRUD{}
+		Expect(r.Get(ctx, key(crud), latest)).To(Succeed())
+		crud = latest
+		_, err := r.reconcileCleanUp(ctx, logger, crud)
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	// remove deletes crud with the given policy and reconciles it
+	remove := func(policy apiv1.DeletionPolicy) {
+		crud.Spec.Database.DeletionPolicy = policy
+		now := meta.Now()
+		crud.DeletionTimestamp = &now
+		Expect(r.Update(ctx, crud)).To(Succeed())
+		cleanUp()
+	}
+
+	finalized := func() bool {
+		latest := &apiv1.CRUD{}
+		Expect(r.Get(ctx, key(crud), latest)).To(Succeed())
+		return len(latest.Finalizers) == 0
+	}
+
+	volumeExists := func() bool {
+		err := r.Get(ctx, key(volume), &core.PersistentVolumeClaim{})
+		Expect(err == nil || apierrors.IsNotFound(err)).To(BeTrue())
+		return err == nil
+	}
+
+	finalBackup := func() *batch.Job {
+		job := &batch.Job{}
+		jobKey := key(crud)
+		jobKey.Name = crud.FinalBackupName()
+		Expect(r.Get(ctx, jobKey, job)).To(Succeed())
+		return job
+	}
+
+	finishFinalBackup := func(condition batch.JobConditionType) {
+		job := finalBackup()
+		job.Status.Conditions = []batch.JobCondition{{Type: condition, Status: core.ConditionTrue, Message: "BackoffLimitExceeded"}}
+		Expect(r.Update(ctx, job)).To(Succeed())
+	}
+
+	It("holds the deletion with a finalizer", func() {
+		latest := &apiv1.CRUD{}
+		Expect(r.Get(ctx, key(crud), latest)).To(Succeed())
+		Expect(latest.Finalizers).To(ConsistOf(apiv1.CRUDFinalizer))
+		Expect(r.ensureFinalizer(ctx, crud)).To(Succeed())
+		Expect(crud.Finalizers).To(HaveLen(1))
+	})
+
+	It("deletes the database volumes by default", func() {
+		remove(apiv1.DeletionPolicyDelete)
+		Expect(volumeExists()).To(BeFalse())
+		Expect(finalized()).To(BeTrue())
+	})
+
+	It("orphans the volumes and the credentials with the Retain policy", func() {
+		remove(apiv1.DeletionPolicyRetain)
+		retained := &core.PersistentVolumeClaim{}
+		Expect(r.Get(ctx, key(volume), retained)).To(Succeed())
+		Expect(retained.OwnerReferences).To(BeEmpty())
+		credentials := &core.Secret{}
+		Expect(r.Get(ctx, key(secret), credentials)).To(Succeed())
+		Expect(credentials.OwnerReferences).To(BeEmpty())
+		Expect(finalized()).To(BeTrue())
+	})
+
+	It("dumps the database before deleting it with the Snapshot policy", func() {
+		remove(apiv1.DeletionPolicySnapshot)
+		backupVolume := &core.PersistentVolumeClaim{}
+		backupKey := key(crud)
+		backupKey.Name = crud.FinalBackupName()
+		Expect(r.Get(ctx, backupKey, backupVolume)).To(Succeed())
+		Expect(backupVolume.OwnerReferences).To(BeEmpty())
+		Expect(finalBackup().Spec.Template.Spec.Containers[0].Command[2]).To(ContainSubstring("pg_dump"))
+		Expect(finalized()).To(BeFalse())
+
+		finishFinalBackup(batch.JobComplete)
+		cleanUp()
+		Expect(volumeExists()).To(BeFalse())
+		Expect(r.Get(ctx, backupKey, backupVolume)).To(Succeed())
+		Expect(finalized()).To(BeTrue())
+	})
+
+	Context("when the final backup fails", func() {
+		BeforeEach(func() {
+			remove(apiv1.DeletionPolicySnapshot)
+			finishFinalBackup(batch.JobFailed)
+			cleanUp()
+		})
+
+		It("reports the failure and keeps the data", func() {
+			Expect(volumeExists()).To(BeTrue())
+			Expect(finalized()).To(BeFalse())
+			latest := &apiv1.CRUD{}
+			Expect(r.Get(ctx, key(crud), latest)).To(Succeed())
+			cond := latest.Status.GetCondition(apiv1.ConditionFinalBackupFailed)
+			Expect(cond).NotTo(BeNil())
+			Expect(cond.Status).To(Equal(core.ConditionTrue))
+			Expect(cond.Message).To(ContainSubstring("BackoffLimitExceeded"))
+			Expect(recorder.Events).To(Receive(ContainSubstring("FinalBackupFailed")))
+
+			// reported once
+			cleanUp()
+			Expect(recorder.Events).NotTo(Receive())
+		})
+
+		It("retries the backup once its job is deleted", func() {
+			Expect(r.Delete(ctx, finalBackup())).To(Succeed())
+			cleanUp()
+			Expect(finalBackup().Status.Conditions).To(BeEmpty())
+
+			cleanUp()
+			Expect(crud.Status.IsConditionTrue(apiv1.ConditionFinalBackupFailed)).To(BeFalse())
+
+			finishFinalBackup(batch.JobComplete)
+			cleanUp()
+			Expect(finalized()).To(BeTrue())
+		})
+
+		It("proceeds without it once the policy is changed", func() {
+			Expect(r.Get(ctx, key(crud), crud)).To(Succeed())
+			crud.Spec.Database.DeletionPolicy = apiv1.DeletionPolicyRetain
+			Expect(r.Update(ctx, crud)).To(Succeed())
+			cleanUp()
+			Expect(volumeExists()).To(BeTrue())
+			Expect(finalized()).To(BeTrue())
+		})
+	})
+})
@@ -18,18 +18,36 @@ package controllers
 
 import (
 	"context"
+	"time"
 
 	"github.com/go-logr/logr"
+	apps "k8s.io/api/apps/v1"
+	autoscaling "k8s.io/api/autoscaling/v1"
+	batch "k8s.io/api/batch/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	core "k8s.io/api/core/v1"
+	networking "k8s.io/api/networking/v1beta1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/api/errors"
 	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	apiv1 "github.com/crudgen-org/crudgen-orchestrator/api/v1"
 )
 
+// notReadyRequeueInterval is how often a CRUD that is not Ready yet is
+// checked again.
+const notReadyRequeueInterval = 30 * time.Second
+
 // CRUDReconciler reconciles a CRUD object
 type CRUDReconciler struct {
 	client.Client
@@ -38,6 +56,20 @@ type CRUDReconciler struct {
 
 	RootDomain    string
 	ClusterIssuer string
+	Recorder      record.EventRecorder
+	// BackupImage provides the minio client uploading the database backups
+	// to S3.
+	BackupImage string
+	// Builder builds the images of the CRUDs. When nil, Status.Image is
+	// expected to be set by an external builder.
+	Builder Builder
+	// DefaultStorageClass is the storage class of the database volumes of
+	// the CRUDs that do not set one. When empty, the default class of the
+	// cluster is used.
+	DefaultStorageClass string
+	// PodReader reads the database pods directly from the API server, so
+	// that the manager does not cache every pod of the cluster.
+	PodReader client.Reader
 }
 
 func key(object meta.Object) types.NamespacedName {
@@ -49,6 +81,10 @@ func key(object meta.Object) types.NamespacedName {
 
 // +kubebuilder:rbac:groups=api.crudgen.org,resources=cruds,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=api.crudgen.org,resources=cruds/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=apps,resources=deployments;statefulsets,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="",resources=services,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=networking.k8s.io,resources=ingresses,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=autoscaling,resources=horizontalpodautoscalers,verbs=get;list;watch;create;update;patch;delete
 
 func (r *CRUDReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 	ctx := context.Background()
@@ -68,48 +104,182 @@ func (r *CRUDReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 		return r.reconcileCleanUp(ctx, logger, crud)
 
 	default:
-		if !crud.Status.ImageReady {
-			logger.Info("CRUD resource not ready for deployment. stopping...")
-			return ctrl.Result{}, nil
+		if err := r.ensureFinalizer(ctx, crud); err != nil {
+			return ctrl.Result{}, err
 		}
+		crud.SetDefaults()
 		return r.reconcile(ctx, logger, crud)
 	}
 }
 
 func (r *CRUDReconciler) reconcile(ctx context.Context, logger logr.Logger, crud *apiv1.CRUD) (ctrl.Result, error) {
-	if err := r.ensureDeployment(ctx, logger, crud); err != nil {
+	if err := r.reconcileRollback(ctx, logger, crud); err != nil {
 		return ctrl.Result{}, err
 	}
-	if err := r.ensureService(ctx, logger, crud); err != nil {
+	restoring, err := r.reconcileRestore(ctx, logger, crud)
+	if err != nil {
 		return ctrl.Result{}, err
 	}
-	if err := r.ensureIngress(ctx, logger, crud); err != nil {
+	upgrading, err := r.reconcileDatabaseUpgrade(ctx, logger, crud, restoring)
+	if err != nil {
 		return ctrl.Result{}, err
 	}
-	if err := r.ensureHPA(ctx, logger, crud); err != nil {
-		return ctrl.Result{}, err
+
+	result := ctrl.Result{}
+	var descErr error
+	desc, errs := crud.ParseAPIDescription()
+	if len(errs) == 0 {
+		if r.Builder == nil {
+			// an external builder builds the current description, see
+			// imageUpToDate, its image listens on the port of that one
+			crud.Status.Port = desc.DeployStrategy.Port
+		}
+		compatible, err := r.checkSchemaChanges(ctx, logger, crud, desc)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		// no need to build an image that will not be rolled out
+		if compatible && r.Builder != nil {
+			if err := r.reconcileImage(ctx, logger, crud); err != nil {
+				return ctrl.Result{}, err
+			}
+		}
 	}
-	if err := r.ensureDatabseStatefulset(ctx, logger, crud); err != nil {
+	switch {
+	case len(errs) > 0:
+		// nothing to deploy until the spec is fixed
+		descErr = errs.ToAggregate()
+		logger.Error(descErr, "invalid apiDescription")
+
+	case crud.Status.Image == "":
+		logger.Info("CRUD resource not ready for deployment")
+
+	default:
+		failover, err := r.ensureResources(ctx, logger, crud, restoring || upgrading)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		due, err := r.reconcileCredentialsRotation(ctx, logger, crud)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		result.RequeueAfter = sooner(failover, due)
+	}
+
+	if err := r.updateConditions(ctx, crud, descErr); err != nil {
 		return ctrl.Result{}, err
 	}
-	if err := r.ensureDatabaseService(ctx, logger, crud); err != nil {
+	if err := r.updateStatus(ctx, crud); err != nil {
 		return ctrl.Result{}, err
 	}
-	if !crud.Status.Deployed {
-		crud.Status.Deployed = true
-		if err := r.Update(ctx, crud); err != nil {
-			return ctrl.Result{}, err
+	if descErr == nil && !crud.Status.IsConditionTrue(apiv1.ConditionReady) {
+		result.RequeueAfter = sooner(result.RequeueAfter, notReadyRequeueInterval)
+	}
+	return result, nil
+}
+
+// ensureResources applies the objects of crud. The API is left scaled down
+// while the database is being restored or upgraded, and nothing is applied
+// until a pool has room for the database in Pool mode. It returns when the
+// failover of an unready database primary is due.
+func (r *CRUDReconciler) ensureResources(ctx context.Context, logger logr.Logger, crud *apiv1.CRUD, scaledDown bool) (time.Duration, error) {
+	var failover time.Duration
+	if crud.Spec.Database.Mode == apiv1.DatabaseModePool {
+		allocated, err := r.ensurePoolAllocation(ctx, logger, crud)
+		if err != nil || !allocated {
+			return 0, err
 		}
 	}
-	return ctrl.Result{}, nil
+	if err := r.ensureDatabaseSecret(ctx, logger, crud); err != nil {
+		return 0, err
+	}
+	if !scaledDown {
+		if err := r.ensureDeployment(ctx, logger, crud); err != nil {
+			return 0, err
+		}
+	}
+	if err := r.ensureService(ctx, logger, crud); err != nil {
+		return 0, err
+	}
+	if err := r.ensureIngress(ctx, logger, crud); err != nil {
+		return 0, err
+	}
+	if !scaledDown {
+		if err := r.ensureHPA(ctx, logger, crud); err != nil {
+			return 0, err
+		}
+	}
+	if crud.InCluster() {
+		if err := r.ensureDatabseStatefulset(ctx, logger, crud); err != nil {
+			return 0, err
+		}
+		due, err := r.reconcileDatabaseRoles(ctx, logger, crud)
+		if err != nil {
+			return 0, err
+		}
+		failover = due
+		if err := r.ensureDatabaseService(ctx, logger, crud); err != nil {
+			return 0, err
+		}
+		if err := r.resizeDatabaseVolumes(ctx, logger, crud); err != nil {
+			return 0, err
+		}
+	} else {
+		if err := r.ensureExternalDatabase(ctx, logger, crud); err != nil {
+			return 0, err
+		}
+	}
+	if err := r.ensureDatabaseBackup(ctx, logger, crud); err != nil {
+		return 0, err
+	}
+	return failover, nil
 }
 
-func (r *CRUDReconciler) reconcileCleanUp(ctx context.Context, logger logr.Logger, crud *apiv1.CRUD) (ctrl.Result, error) {
-	return ctrl.Result{}, nil
+// sooner returns the shorter of two requeue delays, zero meaning none.
+func sooner(a, b time.Duration) time.Duration {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// updateStatus patches the fields of the status owned by the reconciler
+// onto the latest version of crud, retrying on conflicts with other writers
+// such as an external image builder.
+func (r *CRUDReconciler) updateStatus(ctx context.Context, crud *apiv1.CRUD) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		latest := &apiv1.CRUD{}
+		if err := r.Get(ctx, key(crud), latest); err != nil {
+			return err
+		}
+		base := latest.DeepCopy()
+		copyReconcilerStatus(&crud.Status, &latest.Status)
+		if r.Builder != nil {
+			copyImageStatus(&crud.Status, &latest.Status)
+		}
+		if equality.Semantic.DeepEqual(base.Status, latest.Status) {
+			return nil
+		}
+		return r.Status().Patch(ctx, latest, client.MergeFromWithOptions(base, client.MergeFromWithOptimisticLock{}))
+	})
 }
 
 func (r *CRUDReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	// resyncs of the owned objects carry nothing new
+	owned := builder.WithPredicates(predicate.ResourceVersionChangedPredicate{})
+
 	return ctrl.NewControllerManagedBy(mgr).
-		For(&apiv1.CRUD{}).
+		For(&apiv1.CRUD{}, builder.WithPredicates(crudChangedPredicate{})).
+		Owns(&apps.Deployment{}, owned).
+		Owns(&apps.StatefulSet{}, owned).
+		Owns(&core.Service{}, owned).
+		Owns(&core.Secret{}, owned).
+		Owns(&networking.Ingress{}, owned).
+		Owns(&autoscaling.HorizontalPodAutoscaler{}, owned).
+		Owns(&batch.Job{}, owned).
+		Owns(&batchv1beta1.CronJob{}, owned).
+		Watches(&source.Kind{Type: &batch.Job{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: handler.ToRequestsFunc(poolJobCRUD),
+		}, owned).
 		Complete(r)
 }
@@ -0,0 +1,180 @@
+package controllers
+
+import (
+	"context"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	autoscaling "k8s.io/api/autoscaling/v1"
+	core "k8s.io/api/core/v1"
+	networking "k8s.io/api/networking/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	apiv1 "github.com/crudgen-org/crudgen-orchestrator/api/v1"
+)
+
+// racingClient lets an external builder write the image status of the CRUD
+// right before each of the first races status patches of the reconciler.
+type racingClient struct {
+	client.Client
+	races int
+}
+
+func (c *racingClient) Status() client.StatusWriter {
+	return &racingStatusWriter{StatusWriter: c.Client.Status(), client: c}
+}
+
+type racingStatusWriter struct {
+	client.StatusWriter
+	client *racingClient
+}
+
+func (w *racingStatusWriter) Patch(ctx context.Context, obj runtime.Object, patch client.Patch, opts ...client.PatchOption) error {
+	if w.client.races > 0 {
+		w.client.races--
+		crud := &apiv1.CRUD{}
+		if err := w.client.Get(ctx, key(obj.(*apiv1.CRUD)), crud); err != nil {
+			return err
+		}
+		crud.Status.Image, crud.Status.ImageReady = "registry/todolist:external", true
+		if err := w.StatusWriter.Update(ctx, crud); err != nil {
+			return err
+		}
+	}
+	return w.StatusWriter.Patch(ctx, obj, patch, opts...)
+}
+
+var _ = Describe("updateStatus", func() {
+	var (
+		ctx  context.Context
+		c    *racingClient
+		r    *CRUDReconciler
+		crud *apiv1.CRUD
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		crud = newTestCRUD()
+		crud.ResourceVersion = "1"
+		s := testScheme()
+		c = &racingClient{Client: fake.NewFakeClientWithScheme(s, crud.DeepCopy())}
+		r = &CRUDReconciler{Client: c, Scheme: s}
+	})
+
+	latest := func() *apiv1.CRUD {
+		latest := &apiv1.CRUD{}
+		Expect(r.Get(ctx, key(crud), latest)).To(Succeed())
+		return latest
+	}
+
+	It("patches the status it owns, leaving the image to the external builder", func() {
+		crud.Status.Deployed = true
+		crud.Status.Image = "registry/todolist:stale"
+		crud.Status.SetCondition(newCondition(apiv1.ConditionReady, true, "Ready", ""))
+		c.races = 1
+		Expect(r.updateStatus(ctx, crud)).To(Succeed())
+
+		status := latest().Status
+		Expect(status.Deployed).To(BeTrue())
+		Expect(status.IsConditionTrue(apiv1.ConditionReady)).To(BeTrue())
+		Expect(status.Image).To(Equal("registry/todolist:external"))
+		Expect(status.ImageReady).To(BeTrue())
+	})
+
+	It("writes the image status when it builds the images itself", func() {
+		r.Builder = &fakeBuilder{}
+		crud.Status.Image, crud.Status.ImageReady = "registry/todolist@sha256:1", true
+		Expect(r.updateStatus(ctx, crud)).To(Succeed())
+		Expect(latest().Status.Image).To(Equal("registry/todolist@sha256:1"))
+	})
+
+	It("writes the port without a builder", func() {
+		crud.Status.Port = 8080
+		Expect(r.updateStatus(ctx, crud)).To(Succeed())
+		Expect(latest().Status.Port).To(Equal(int32(8080)))
+	})
+
+	It("does not write an unchanged status", func() {
+		version := latest().ResourceVersion
+		Expect(r.updateStatus(ctx, crud)).To(Succeed())
+		Expect(latest().ResourceVersion).To(Equal(version))
+	})
+
+	It("gives up after conflicting with every retry", func() {
+		crud.Status.Deployed = true
+		c.races = 100
+		err := r.updateStatus(ctx, crud)
+		Expect(apierrors.IsConflict(err)).To(BeTrue())
+	})
+})
+
+var _ = Describe("watches", func() {
+	var (
+		ctx    context.Context
+		logger logr.Logger
+		r      *CRUDReconciler
+		crud   *apiv1.CRUD
+		owner  *handler.EnqueueRequestForOwner
+		queue  workqueue.RateLimitingInterface
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		logger = logf.Log.WithName("test")
+		crud = newTestCRUD()
+		crud.UID = "1234"
+		crud.SetDefaults()
+		s := testScheme()
+		r = &CRUDReconciler{Client: &applyClient{fake.NewFakeClientWithScheme(s)}, Scheme: s}
+
+		// the handler of the Owns() watches
+		mapper := apimeta.NewDefaultRESTMapper(nil)
+		mapper.Add(apiv1.GroupVersion.WithKind("CRUD"), apimeta.RESTScopeNamespace)
+		owner = &handler.EnqueueRequestForOwner{OwnerType: &apiv1.CRUD{}, IsController: true}
+		Expect(owner.InjectScheme(s)).To(Succeed())
+		Expect(owner.InjectMapper(mapper)).To(Succeed())
+		queue = workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	})
+
+	AfterEach(func() {
+		queue.ShutDown()
+	})
+
+	// enqueued returns the requests queued for the deletion of obj
+	enqueued := func(obj runtime.Object) []reconcile.Request {
+		Expect(r.Get(ctx, key(obj.(meta.Object)), obj)).To(Succeed())
+		owner.Delete(event.DeleteEvent{Meta: obj.(meta.Object), Object: obj}, queue)
+		requests := []reconcile.Request{}
+		for queue.Len() > 0 {
+			item, _ := queue.Get()
+			requests = append(requests, item.(reconcile.Request))
+			queue.Done(item)
+		}
+		return requests
+	}
+
+	It("reconciles the CRUD controlling a deleted child", func() {
+		Expect(r.ensureService(ctx, logger, crud)).To(Succeed())
+		Expect(r.ensureIngress(ctx, logger, crud)).To(Succeed())
+		Expect(r.ensureHPA(ctx, logger, crud)).To(Succeed())
+
+		request := reconcile.Request{NamespacedName: key(crud)}
+		Expect(enqueued(&core.Service{ObjectMeta: meta.ObjectMeta{Namespace: crud.Namespace, Name: crud.ServiceName()}})).
+			To(ConsistOf(request))
+		Expect(enqueued(&networking.Ingress{ObjectMeta: meta.ObjectMeta{Namespace: crud.Namespace, Name: crud.Name}})).
+			To(ConsistOf(request))
+		Expect(enqueued(&autoscaling.HorizontalPodAutoscaler{ObjectMeta: meta.ObjectMeta{Namespace: crud.Namespace, Name: crud.Name}})).
+			To(ConsistOf(request))
+	})
+})
@@ -0,0 +1,213 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	batch "k8s.io/api/batch/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	core "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	apiv1 "github.com/crudgen-org/crudgen-orchestrator/api/v1"
+)
+
+// backupLabel marks the jobs backing up the database of a CRUD.
+const backupLabel = "api.crudgen.org/backup"
+
+const (
+	backupDumpDir   = "/dump"
+	backupVolumeDir = "/backup"
+)
+
+// dumpScript dumps the database to BACKUP_DIR, in a file named after
+// BACKUP_PREFIX and the current time. The file only gets its final name
+// once complete.
+const dumpScript = `set -e
+file="$BACKUP_DIR/$BACKUP_PREFIX$(date -u +%Y%m%d%H%M%S).dump"
+pg_dump --format=custom --file="$file.partial"
+mv "$file.partial" "$file"`
+
+// pruneScript reads the names of the backups and runs the given command,
+// with the name in $name, on the ones beyond the RETENTION newest.
+const pruneScript = `grep "^${BACKUP_PREFIX}[0-9]\{14\}\.dump$" | sort -r | awk -v keep="$RETENTION" 'NR > keep' | while read -r name; do %s; done`
+
+// volumeBackupScript dumps the database to a volume and prunes the backups
+// beyond the retention.
+var volumeBackupScript = dumpScript + "\nls -1 \"$BACKUP_DIR\" | " +
+	fmt.Sprintf(pruneScript, `rm -f "$BACKUP_DIR/$name"`)
+
+// s3Script configures the minio client from the environment set by s3Env
+// and sets $target to the directory holding the backups.
+const s3Script = `set -e
+mc alias set backup "$S3_ENDPOINT" "$AWS_ACCESS_KEY_ID" "$AWS_SECRET_ACCESS_KEY" >/dev/null
+target="backup/$S3_BUCKET/"
+if [ -n "$S3_PREFIX" ]; then target="$target${S3_PREFIX%/}/"; fi
+`
+
+// s3UploadScript uploads the dump of the init container with the minio
+// client and prunes the backups beyond the retention.
+var s3UploadScript = s3Script + `mc cp "$BACKUP_DIR"/*.dump "$target"
+mc ls "$target" | awk '{print $NF}' | ` + fmt.Sprintf(pruneScript, `mc rm "$target$name"`)
+
+// +kubebuilder:rbac:groups=batch,resources=cronjobs,verbs=get;list;watch;create;update;patch;delete
+
+// ensureDatabaseBackup schedules the backups of the database in a CronJob
+// and records when the last one succeeded.
+func (r *CRUDReconciler) ensureDatabaseBackup(ctx context.Context, logger logr.Logger, crud *apiv1.CRUD) error {
+	if crud.Spec.Database.Backup == nil {
+		cronJob := &batchv1beta1.CronJob{}
+		cronJob.Namespace, cronJob.Name = crud.Namespace, crud.BackupCronJobName()
+		if err := r.Delete(ctx, cronJob); err != nil && !apierrors.IsNotFound(err) {
+			return errors.Wrap(err, "could not delete backup cronjob")
+		}
+		return nil
+	}
+
+	if err := r.apply(ctx, crud, r.backupCronJob(crud)); err != nil {
+		return errors.Wrap(err, "could not apply backup cronjob")
+	}
+	return r.updateLastBackupTime(ctx, logger, crud)
+}
+
+func (r *CRUDReconciler) backupCronJob(crud *apiv1.CRUD) *batchv1beta1.CronJob {
+	backup := crud.Spec.Database.Backup
+	labels := crud.LabelSelectors()
+	labels[backupLabel] = "true"
+
+	backupEnv := func(dir string) []core.EnvVar {
+		return []core.EnvVar{
+			{Name: "BACKUP_DIR", Value: dir},
+			{Name: "BACKUP_PREFIX", Value: crud.Name + "-"},
+			{Name: "RETENTION", Value: fmt.Sprint(*backup.Retention)},
+		}
+	}
+	pod := core.PodSpec{RestartPolicy: core.RestartPolicyOnFailure}
+
+	if s3 := backup.Destination.S3; s3 != nil {
+		dump := []core.VolumeMount{{Name: "dump", MountPath: backupDumpDir}}
+		pod.InitContainers = []core.Container{
+			{
+				Name:         "pg-dump",
+				Image:        crud.DatabaseImage(),
+				Command:      []string{"sh", "-c", dumpScript},
+				Env:          append(databaseClientEnv(crud), backupEnv(backupDumpDir)...),
+				VolumeMounts: dump,
+			},
+		}
+		pod.Containers = []core.Container{
+			{
+				Name:         "upload",
+				Image:        r.BackupImage,
+				Command:      []string{"sh", "-c", s3UploadScript},
+				Env:          append(backupEnv(backupDumpDir), s3Env(s3)...),
+				VolumeMounts: dump,
+			},
+		}
+		pod.Volumes = []core.Volume{{
+			Name:         "dump",
+			VolumeSource: core.VolumeSource{EmptyDir: &core.EmptyDirVolumeSource{}},
+		}}
+	} else {
+		pod.Containers = []core.Container{
+			{
+				Name:    "pg-dump",
+				Image:   crud.DatabaseImage(),
+				Command: []string{"sh", "-c", volumeBackupScript},
+				Env:     append(databaseClientEnv(crud), backupEnv(backupVolumeDir)...),
+				VolumeMounts: []core.VolumeMount{
+					{
+						Name:      "backup",
+						MountPath: backupVolumeDir,
+					},
+				},
+			},
+		}
+		pod.Volumes = []core.Volume{{
+			Name: "backup",
+			VolumeSource: core.VolumeSource{
+				PersistentVolumeClaim: &core.PersistentVolumeClaimVolumeSource{
+					ClaimName: backup.Destination.PersistentVolumeClaim.ClaimName,
+				},
+			},
+		}}
+	}
+
+	return &batchv1beta1.CronJob{
+		ObjectMeta: meta.ObjectMeta{
+			Name:      crud.BackupCronJobName(),
+			Namespace: crud.Namespace,
+		},
+		Spec: batchv1beta1.CronJobSpec{
+			Schedule:                   backup.Schedule,
+			ConcurrencyPolicy:          batchv1beta1.ForbidConcurrent,
+			SuccessfulJobsHistoryLimit: pointer.Int32Ptr(3),
+			FailedJobsHistoryLimit:     pointer.Int32Ptr(1),
+			JobTemplate: batchv1beta1.JobTemplateSpec{
+				ObjectMeta: meta.ObjectMeta{
+					Labels: labels,
+				},
+				Spec: batch.JobSpec{
+					BackoffLimit: pointer.Int32Ptr(2),
+					Template: core.PodTemplateSpec{
+						// no labels: the selector of the API would match
+						Spec: pod,
+					},
+				},
+			},
+		},
+	}
+}
+
+// s3Env is the environment of s3Script.
+func s3Env(s3 *apiv1.S3BackupDestination) []core.EnvVar {
+	credentials := func(key string) core.EnvVar {
+		return core.EnvVar{
+			Name: key,
+			ValueFrom: &core.EnvVarSource{
+				SecretKeyRef: &core.SecretKeySelector{
+					LocalObjectReference: core.LocalObjectReference{
+						Name: s3.CredentialsSecret,
+					},
+					Key: key,
+				},
+			},
+		}
+	}
+	return []core.EnvVar{
+		{Name: "S3_ENDPOINT", Value: s3.Endpoint},
+		{Name: "S3_BUCKET", Value: s3.Bucket},
+		{Name: "S3_PREFIX", Value: s3.Prefix},
+		credentials("AWS_ACCESS_KEY_ID"),
+		credentials("AWS_SECRET_ACCESS_KEY"),
+	}
+}
+
+// updateLastBackupTime records the completion time of the latest successful
+// backup job. The cron controller updates the CronJob when its jobs finish,
+// which triggers a reconciliation.
+func (r *CRUDReconciler) updateLastBackupTime(ctx context.Context, logger logr.Logger, crud *apiv1.CRUD) error {
+	labels := crud.LabelSelectors()
+	labels[backupLabel] = "true"
+	jobs := &batch.JobList{}
+	if err := r.List(ctx, jobs, client.InNamespace(crud.Namespace), client.MatchingLabels(labels)); err != nil {
+		return errors.Wrap(err, "could not list backup jobs")
+	}
+
+	for i := range jobs.Items {
+		job := &jobs.Items[i]
+		if cond := jobFinished(job); cond == nil || cond.Type != batch.JobComplete || job.Status.CompletionTime == nil {
+			continue
+		}
+		if last := crud.Status.Database.LastBackupTime; last == nil || last.Before(job.Status.CompletionTime) {
+			logger.Info("database backed up", "job", job.Name)
+			crud.Status.Database.LastBackupTime = job.Status.CompletionTime.DeepCopy()
+		}
+	}
+	return nil
+}
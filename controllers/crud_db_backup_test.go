@@ -0,0 +1,97 @@
+package controllers
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	batch "k8s.io/api/batch/v1"
+	core "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	apiv1 "github.com/crudgen-org/crudgen-orchestrator/api/v1"
+)
+
+var _ = Describe("database backups", func() {
+	var crud *apiv1.CRUD
+
+	BeforeEach(func() {
+		crud = newTestCRUD()
+		crud.Spec.Database.Backup = &apiv1.DatabaseBackupSpec{
+			Schedule:  "0 3 * * *",
+			Retention: pointer.Int32Ptr(5),
+			Destination: apiv1.BackupDestination{
+				PersistentVolumeClaim: &apiv1.PVCBackupDestination{ClaimName: "backups"},
+			},
+		}
+		crud.SetDefaults()
+	})
+
+	env := func(container core.Container) map[string]string {
+		values := map[string]string{}
+		for _, e := range container.Env {
+			values[e.Name] = e.Value
+		}
+		return values
+	}
+
+	It("dumps the database to a volume", func() {
+		r := &CRUDReconciler{}
+		cronJob := r.backupCronJob(crud)
+
+		Expect(cronJob.Name).To(Equal("todolist-backup"))
+		Expect(cronJob.Spec.Schedule).To(Equal("0 3 * * *"))
+		Expect(cronJob.Spec.JobTemplate.Labels).To(HaveKeyWithValue(backupLabel, "true"))
+		pod := cronJob.Spec.JobTemplate.Spec.Template.Spec
+		Expect(pod.Containers).To(HaveLen(1))
+		Expect(pod.Containers[0].Image).To(Equal(crud.DatabaseImage()))
+		Expect(pod.Containers[0].Command[2]).To(ContainSubstring("pg_dump"))
+		Expect(env(pod.Containers[0])).To(HaveKeyWithValue("RETENTION", "5"))
+		Expect(env(pod.Containers[0])).To(HaveKeyWithValue("BACKUP_DIR", backupVolumeDir))
+		Expect(pod.Volumes[0].PersistentVolumeClaim.ClaimName).To(Equal("backups"))
+	})
+
+	It("uploads the dump to S3", func() {
+		crud.Spec.Database.Backup.Destination = apiv1.BackupDestination{
+			S3: &apiv1.S3BackupDestination{Endpoint: "http://minio:9000", Bucket: "backups", Prefix: "team-a", CredentialsSecret: "minio"},
+		}
+		r := &CRUDReconciler{BackupImage: "minio/mc"}
+		pod := r.backupCronJob(crud).Spec.JobTemplate.Spec.Template.Spec
+
+		Expect(pod.InitContainers).To(HaveLen(1))
+		Expect(pod.InitContainers[0].Command[2]).To(ContainSubstring("pg_dump"))
+		Expect(pod.Containers).To(HaveLen(1))
+		upload := pod.Containers[0]
+		Expect(upload.Image).To(Equal("minio/mc"))
+		Expect(env(upload)).To(HaveKeyWithValue("S3_ENDPOINT", "http://minio:9000"))
+		Expect(env(upload)).To(HaveKeyWithValue("S3_PREFIX", "team-a"))
+		Expect(env(upload)).NotTo(HaveKey("PGPASSWORD"))
+		Expect(upload.Env).To(ContainElements(s3Env(crud.Spec.Database.Backup.Destination.S3)))
+	})
+
+	It("records the completion of the latest successful backup", func() {
+		labels := crud.LabelSelectors()
+		labels[backupLabel] = "true"
+		older, newer := meta.NewTime(time.Now().Add(-time.Hour).Truncate(time.Second)), meta.NewTime(time.Now().Truncate(time.Second))
+		job := func(name string, finished meta.Time, condition batch.JobConditionType) *batch.Job {
+			return &batch.Job{
+				ObjectMeta: meta.ObjectMeta{Namespace: crud.Namespace, Name: name, Labels: labels},
+				Status: batch.JobStatus{
+					CompletionTime: &finished,
+					Conditions:     []batch.JobCondition{{Type: condition, Status: core.ConditionTrue}},
+				},
+			}
+		}
+		r := &CRUDReconciler{Client: fake.NewFakeClientWithScheme(testScheme(),
+			job("backup-1", older, batch.JobComplete),
+			job("backup-2", newer, batch.JobFailed),
+		)}
+
+		Expect(r.updateLastBackupTime(context.Background(), logf.Log, crud)).To(Succeed())
+		Expect(crud.Status.Database.LastBackupTime.Equal(&older)).To(BeTrue())
+	})
+})
@@ -0,0 +1,248 @@
+package controllers
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"net"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	apps "k8s.io/api/apps/v1"
+	core "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	apiv1 "github.com/crudgen-org/crudgen-orchestrator/api/v1"
+)
+
+const (
+	lowerAlphabet    = "abcdefghijklmnopqrstuvwxyz"
+	passwordAlphabet = lowerAlphabet + "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	passwordLength   = 32
+)
+
+// +kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;create;update;patch;delete
+
+// Credentials of the in-cluster databases created before they were
+// generated per CRUD.
+const (
+	legacyDatabaseUser     = "objectrocket"
+	legacyDatabasePassword = "orkb123"
+	legacyDatabaseName     = "ordb"
+)
+
+// legacyCredentialsAnnotation marks a database secret holding the legacy
+// credentials, which are rotated as soon as possible.
+const legacyCredentialsAnnotation = "api.crudgen.org/legacy-credentials"
+
+// ensureDatabaseSecret creates the credentials of the CRUD database once.
+// The secret is never overwritten: the values are baked into the database
+// the first time it starts. A database that was initialised before the
+// secret existed keeps the legacy credentials until they are rotated.
+func (r *CRUDReconciler) ensureDatabaseSecret(ctx context.Context, logger logr.Logger, crud *apiv1.CRUD) error {
+	key := key(crud)
+	key.Name = crud.DatabaseSecretName()
+
+	switch err := r.Get(ctx, key, &core.Secret{}); {
+	case apierrors.IsNotFound(err):
+	case err != nil:
+		return errors.Wrap(err, "could not retrieve database secret")
+	default:
+		return nil
+	}
+
+	legacy, err := r.legacyDatabase(ctx, crud)
+	if err != nil {
+		return err
+	}
+	if legacy {
+		return r.createLegacyDatabaseSecret(ctx, logger, crud)
+	}
+
+	address := fmt.Sprintf("%s:%d", crud.DatabaseServiceName(), apiv1.DatabasePort)
+	server := map[string]string{}
+	if !crud.InCluster() {
+		admin, err := r.databaseAdmin(ctx, crud)
+		if err != nil {
+			return err
+		}
+		host, port, err := r.externalServer(ctx, admin)
+		if err != nil {
+			return err
+		}
+		address = net.JoinHostPort(host, port)
+		server[apiv1.DatabaseHostKey] = host
+		server[apiv1.DatabasePortKey] = port
+	}
+
+	user, err := randomString(lowerAlphabet, 1, 12)
+	if err != nil {
+		return err
+	}
+	database, err := randomString(lowerAlphabet, 1, 12)
+	if err != nil {
+		return err
+	}
+	password, err := randomString(passwordAlphabet, 0, passwordLength)
+	if err != nil {
+		return err
+	}
+
+	secret := &core.Secret{
+		ObjectMeta: meta.ObjectMeta{
+			Name:      crud.DatabaseSecretName(),
+			Namespace: crud.Namespace,
+			Labels:    crud.DatabaseLabel(),
+		},
+		Type: core.SecretTypeOpaque,
+		StringData: map[string]string{
+			apiv1.DatabaseUserKey:     "u" + user,
+			apiv1.DatabasePasswordKey: password,
+			apiv1.DatabaseNameKey:     "db" + database,
+			apiv1.DatabaseAPIUserKey:  "u" + user,
+			apiv1.DatabaseURLKey:      crud.DatabaseURL(address, "u"+user, password, "db"+database),
+		},
+	}
+	for k, v := range server {
+		secret.StringData[k] = v
+	}
+	if err := controllerutil.SetControllerReference(crud, secret, r.Scheme); err != nil {
+		return errors.Wrap(err, "could not set owner reference on database secret")
+	}
+	logger.Info("generating database credentials", "secret", secret.Name)
+	if err := r.Create(ctx, secret); err != nil {
+		return errors.Wrap(err, "could not create database secret")
+	}
+	return nil
+}
+
+// legacyDatabase reports whether the in-cluster database of crud exists
+// already, and was thus initialised with the legacy credentials.
+func (r *CRUDReconciler) legacyDatabase(ctx context.Context, crud *apiv1.CRUD) (bool, error) {
+	if !crud.InCluster() {
+		return false, nil
+	}
+	key := key(crud)
+	key.Name = crud.DatabaseStatefulName()
+	switch err := r.Get(ctx, key, &apps.StatefulSet{}); {
+	case err == nil:
+		return true, nil
+	case !apierrors.IsNotFound(err):
+		return false, errors.Wrap(err, "could not retrieve statefulset")
+	}
+	pvcs, err := r.listDatabaseVolumes(ctx, crud)
+	if err != nil {
+		return false, err
+	}
+	return len(pvcs.Items) > 0, nil
+}
+
+func (r *CRUDReconciler) createLegacyDatabaseSecret(ctx context.Context, logger logr.Logger, crud *apiv1.CRUD) error {
+	address := fmt.Sprintf("%s:%d", crud.DatabaseServiceName(), apiv1.DatabasePort)
+	secret := &core.Secret{
+		ObjectMeta: meta.ObjectMeta{
+			Name:        crud.DatabaseSecretName(),
+			Namespace:   crud.Namespace,
+			Labels:      crud.DatabaseLabel(),
+			Annotations: map[string]string{legacyCredentialsAnnotation: "true"},
+		},
+		Type: core.SecretTypeOpaque,
+		StringData: map[string]string{
+			apiv1.DatabaseUserKey:     legacyDatabaseUser,
+			apiv1.DatabasePasswordKey: legacyDatabasePassword,
+			apiv1.DatabaseNameKey:     legacyDatabaseName,
+			apiv1.DatabaseAPIUserKey:  legacyDatabaseUser,
+			apiv1.DatabaseURLKey:      crud.DatabaseURL(address, legacyDatabaseUser, legacyDatabasePassword, legacyDatabaseName),
+		},
+	}
+	if err := controllerutil.SetControllerReference(crud, secret, r.Scheme); err != nil {
+		return errors.Wrap(err, "could not set owner reference on database secret")
+	}
+	logger.Info("recording the legacy database credentials", "secret", secret.Name)
+	if err := r.Create(ctx, secret); err != nil {
+		return errors.Wrap(err, "could not create database secret")
+	}
+	return nil
+}
+
+// randomString returns a random string of length characters from alphabet,
+// the first skip characters are taken from the lowercase letters only so
+// that the result is a valid postgres identifier.
+func randomString(alphabet string, skip, length int) (string, error) {
+	b := make([]byte, length)
+	for i := range b {
+		chars := alphabet
+		if i < skip {
+			chars = lowerAlphabet
+		}
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(chars))))
+		if err != nil {
+			return "", errors.Wrap(err, "could not generate random string")
+		}
+		b[i] = chars[n.Int64()]
+	}
+	return string(b), nil
+}
+
+// secretEnv returns an environment variable read from the database secret.
+func secretEnv(crud *apiv1.CRUD, name, key string) core.EnvVar {
+	return core.EnvVar{
+		Name: name,
+		ValueFrom: &core.EnvVarSource{
+			SecretKeyRef: &core.SecretKeySelector{
+				LocalObjectReference: core.LocalObjectReference{
+					Name: crud.DatabaseSecretName(),
+				},
+				Key: key,
+			},
+		},
+	}
+}
+
+// databaseAddress returns the host and port of the server the credentials
+// in secret are for.
+func databaseAddress(crud *apiv1.CRUD, secret *core.Secret) string {
+	if host := string(secret.Data[apiv1.DatabaseHostKey]); host != "" {
+		return net.JoinHostPort(host, string(secret.Data[apiv1.DatabasePortKey]))
+	}
+	return fmt.Sprintf("%s:%d", crud.DatabaseServiceName(), apiv1.DatabasePort)
+}
+
+// databaseServerEnv locates the database server in the libpq environment.
+func databaseServerEnv(crud *apiv1.CRUD) []core.EnvVar {
+	if !crud.InCluster() {
+		return []core.EnvVar{
+			secretEnv(crud, "PGHOST", apiv1.DatabaseHostKey),
+			secretEnv(crud, "PGPORT", apiv1.DatabasePortKey),
+		}
+	}
+	return []core.EnvVar{
+		{Name: "PGHOST", Value: crud.DatabaseServiceName()},
+		{Name: "PGPORT", Value: fmt.Sprint(apiv1.DatabasePort)},
+	}
+}
+
+// databaseClientEnv is the libpq environment used by the postgres client
+// tools to connect to the CRUD database.
+func databaseClientEnv(crud *apiv1.CRUD) []core.EnvVar {
+	return append(databaseServerEnv(crud),
+		secretEnv(crud, "PGUSER", apiv1.DatabaseUserKey),
+		secretEnv(crud, "PGPASSWORD", apiv1.DatabasePasswordKey),
+		secretEnv(crud, "PGDATABASE", apiv1.DatabaseNameKey),
+	)
+}
+
+// databaseAdminEnv is the libpq environment of a role allowed to manage the
+// roles of the CRUD: the owner, a superuser, in InCluster mode, the admin of
+// the server in External and Pool modes. OWNER is the owner of the CRUD
+// database.
+func databaseAdminEnv(admin *databaseAdmin) []core.EnvVar {
+	owner := admin.credentialEnv("OWNER", apiv1.DatabaseUserKey)
+	if admin.crud.InCluster() {
+		return append(databaseClientEnv(admin.crud), owner)
+	}
+	return append(externalAdminEnv(admin), owner)
+}
@@ -0,0 +1,195 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	apiv1 "github.com/crudgen-org/crudgen-orchestrator/api/v1"
+)
+
+// externalMaintenanceDatabase is the database the admin of an external
+// server connects to.
+const externalMaintenanceDatabase = "postgres"
+
+// createDatabaseScript creates the owner role and the database of the CRUD
+// on an external server. The admin joins the owner role, which managed
+// servers require to create a database owned by it.
+const createDatabaseScript = `psql -v ON_ERROR_STOP=1 \
+  -v owner="$OWNER" -v password="$OWNER_PASSWORD" -v database="$DATABASE" <<'EOF'
+SELECT format('CREATE ROLE %I', :'owner') WHERE NOT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = :'owner') \gexec
+ALTER ROLE :"owner" WITH LOGIN PASSWORD :'password';
+GRANT :"owner" TO CURRENT_USER;
+SELECT format('CREATE DATABASE %I OWNER %I', :'database', :'owner')
+  WHERE NOT EXISTS (SELECT 1 FROM pg_database WHERE datname = :'database') \gexec
+REVOKE ALL ON DATABASE :"database" FROM PUBLIC;
+EOF`
+
+// dropDatabaseScript drops the database of the CRUD and its roles, the API
+// roles of the rotations included, from an external server.
+const dropDatabaseScript = `psql -v ON_ERROR_STOP=1 -v owner="$OWNER" -v database="$DATABASE" <<'EOF'
+SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE datname = :'database' AND pid <> pg_backend_pid();
+SELECT format('DROP DATABASE %I', :'database') WHERE EXISTS (SELECT 1 FROM pg_database WHERE datname = :'database') \gexec
+SELECT format('DROP ROLE %I', rolname) FROM pg_roles
+  WHERE rolname IN (:'owner', :'owner' || '_a', :'owner' || '_b') ORDER BY rolname DESC \gexec
+EOF`
+
+func createDatabaseJobName(crud *apiv1.CRUD) string {
+	return fmt.Sprintf("%s-create-database", crud.Name)
+}
+
+func dropDatabaseJobName(crud *apiv1.CRUD) string {
+	return fmt.Sprintf("%s-drop-database", crud.Name)
+}
+
+// databaseAdmin locates the jobs managing the database and the roles of a
+// CRUD. They run in the namespace of the CRUD, except in Pool mode: the
+// admin secret of a pool controls the databases of every CRUD using it, so
+// the jobs run in its namespace with a copy of the credentials of the CRUD.
+type databaseAdmin struct {
+	crud      *apiv1.CRUD
+	namespace string
+	// adminSecret holds the admin credentials of the server, none in
+	// InCluster mode where the owner is a superuser.
+	adminSecret string
+	// credentials holds the credentials of the CRUD database.
+	credentials string
+}
+
+// databaseAdmin returns where the jobs managing the database of crud run.
+func (r *CRUDReconciler) databaseAdmin(ctx context.Context, crud *apiv1.CRUD) (*databaseAdmin, error) {
+	admin := &databaseAdmin{crud: crud, namespace: crud.Namespace, credentials: crud.DatabaseSecretName()}
+	switch crud.Spec.Database.Mode {
+	case apiv1.DatabaseModeExternal:
+		admin.adminSecret = crud.Spec.Database.External.AdminSecret
+
+	case apiv1.DatabaseModePool:
+		pool := &apiv1.DatabasePool{}
+		if err := r.Get(ctx, types.NamespacedName{Name: crud.Status.Database.Pool}, pool); err != nil {
+			return nil, errors.Wrapf(err, "could not retrieve database pool %s", crud.Status.Database.Pool)
+		}
+		ref := pool.Spec.AdminSecret
+		if ref.Namespace == "" {
+			return nil, fmt.Errorf("database pool %s has no admin secret namespace", pool.Name)
+		}
+		admin.namespace = ref.Namespace
+		admin.adminSecret = ref.Name
+		admin.credentials = poolCredentialsName(crud)
+	}
+	return admin, nil
+}
+
+// shared reports whether the jobs run outside of the namespace of the CRUD.
+func (a *databaseAdmin) shared() bool {
+	return a.namespace != a.crud.Namespace
+}
+
+// jobName is the name of the job of the CRUD called name. The UID of the
+// CRUD tells apart the jobs of the CRUDs sharing a namespace.
+func (a *databaseAdmin) jobName(name string) string {
+	if !a.shared() {
+		return name
+	}
+	return string(a.crud.UID) + strings.TrimPrefix(name, a.crud.Name)
+}
+
+// credentialEnv is the environment variable name taking key from the
+// credentials of the CRUD.
+func (a *databaseAdmin) credentialEnv(name, key string) core.EnvVar {
+	env := secretEnv(a.crud, name, key)
+	env.ValueFrom.SecretKeyRef.Name = a.credentials
+	return env
+}
+
+// externalServer returns the host and port of the external server from its
+// admin secret.
+func (r *CRUDReconciler) externalServer(ctx context.Context, admin *databaseAdmin) (string, string, error) {
+	key := types.NamespacedName{Namespace: admin.namespace, Name: admin.adminSecret}
+	secret := &core.Secret{}
+	if err := r.Get(ctx, key, secret); err != nil {
+		return "", "", errors.Wrapf(err, "could not retrieve database admin secret %s", key)
+	}
+	host := string(secret.Data[apiv1.ExternalHostKey])
+	if host == "" {
+		return "", "", fmt.Errorf("database admin secret %s has no %s key", key, apiv1.ExternalHostKey)
+	}
+	port := string(secret.Data[apiv1.ExternalPortKey])
+	if port == "" {
+		port = fmt.Sprint(apiv1.DatabasePort)
+	}
+	return host, port, nil
+}
+
+// externalAdminEnv is the libpq environment of the admin of the external
+// server.
+func externalAdminEnv(admin *databaseAdmin) []core.EnvVar {
+	adminEnv := func(name, key string, optional bool) core.EnvVar {
+		return core.EnvVar{
+			Name: name,
+			ValueFrom: &core.EnvVarSource{
+				SecretKeyRef: &core.SecretKeySelector{
+					LocalObjectReference: core.LocalObjectReference{
+						Name: admin.adminSecret,
+					},
+					Key:      key,
+					Optional: &optional,
+				},
+			},
+		}
+	}
+	return []core.EnvVar{
+		adminEnv("PGHOST", apiv1.ExternalHostKey, false),
+		adminEnv("PGPORT", apiv1.ExternalPortKey, true),
+		adminEnv("PGUSER", apiv1.ExternalUsernameKey, false),
+		adminEnv("PGPASSWORD", apiv1.ExternalPasswordKey, false),
+		{Name: "PGDATABASE", Value: externalMaintenanceDatabase},
+	}
+}
+
+// ensureExternalDatabase creates the database and the owner role of the
+// CRUD on the external server once, and records the server in the status.
+func (r *CRUDReconciler) ensureExternalDatabase(ctx context.Context, logger logr.Logger, crud *apiv1.CRUD) error {
+	if crud.Status.Database.Server != "" {
+		return nil
+	}
+	admin, err := r.databaseAdmin(ctx, crud)
+	if err != nil {
+		return err
+	}
+	done, err := r.runJob(ctx, logger, admin, createDatabaseJobName(crud), createDatabaseScript, append(databaseAdminEnv(admin),
+		admin.credentialEnv("OWNER_PASSWORD", apiv1.DatabasePasswordKey),
+		admin.credentialEnv("DATABASE", apiv1.DatabaseNameKey),
+	))
+	if err != nil || !done {
+		return err
+	}
+	host, port, err := r.externalServer(ctx, admin)
+	if err != nil {
+		return err
+	}
+	crud.Status.Database.Server = net.JoinHostPort(host, port)
+	logger.Info("external database created", "server", crud.Status.Database.Server)
+	return nil
+}
+
+// dropExternalDatabase drops the database and the roles of the CRUD from the
+// external server and reports whether it is done.
+func (r *CRUDReconciler) dropExternalDatabase(ctx context.Context, logger logr.Logger, crud *apiv1.CRUD) (bool, error) {
+	// the API would hold connections to the database
+	if err := r.scaleDeployment(ctx, crud, 0); err != nil {
+		return false, err
+	}
+	admin, err := r.databaseAdmin(ctx, crud)
+	if err != nil {
+		return false, err
+	}
+	return r.runJob(ctx, logger, admin, dropDatabaseJobName(crud), dropDatabaseScript, append(databaseAdminEnv(admin),
+		admin.credentialEnv("DATABASE", apiv1.DatabaseNameKey),
+	))
+}
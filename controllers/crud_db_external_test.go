@@ -0,0 +1,121 @@
+package controllers
+
+import (
+	"context"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	batch "k8s.io/api/batch/v1"
+	core "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	apiv1 "github.com/crudgen-org/crudgen-orchestrator/api/v1"
+)
+
+var _ = Describe("external databases", func() {
+	var (
+		ctx    context.Context
+		logger logr.Logger
+		r      *CRUDReconciler
+		crud   *apiv1.CRUD
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		logger = logf.Log.WithName("test")
+		crud = newTestCRUD()
+		crud.Spec.Database.Mode = apiv1.DatabaseModeExternal
+		crud.Spec.Database.External = &apiv1.ExternalDatabaseSpec{AdminSecret: "pg-admin"}
+		crud.SetDefaults()
+
+		admin := &core.Secret{
+			ObjectMeta: meta.ObjectMeta{Namespace: crud.Namespace, Name: "pg-admin"},
+			Data: map[string][]byte{
+				apiv1.ExternalHostKey:     []byte("db.example.com"),
+				apiv1.ExternalUsernameKey: []byte("admin"),
+				apiv1.ExternalPasswordKey: []byte("secret"),
+			},
+		}
+		s := testScheme()
+		r = &CRUDReconciler{Client: fake.NewFakeClientWithScheme(s, crud.DeepCopy(), admin), Scheme: s}
+	})
+
+	job := func(name string) *batch.Job {
+		job := &batch.Job{}
+		jobKey := key(crud)
+		jobKey.Name = name
+		Expect(r.Get(ctx, jobKey, job)).To(Succeed())
+		return job
+	}
+
+	complete := func(name string) {
+		j := job(name)
+		j.Status.Conditions = []batch.JobCondition{{Type: batch.JobComplete, Status: core.ConditionTrue}}
+		Expect(r.Update(ctx, j)).To(Succeed())
+	}
+
+	env := func(container core.Container) map[string]*core.EnvVar {
+		vars := map[string]*core.EnvVar{}
+		for i := range container.Env {
+			vars[container.Env[i].Name] = &container.Env[i]
+		}
+		return vars
+	}
+
+	It("points the credentials at the external server", func() {
+		Expect(r.ensureDatabaseSecret(ctx, logger, crud)).To(Succeed())
+
+		secret := &core.Secret{}
+		secretKey := key(crud)
+		secretKey.Name = crud.DatabaseSecretName()
+		Expect(r.Get(ctx, secretKey, secret)).To(Succeed())
+		Expect(secret.StringData).To(HaveKeyWithValue(apiv1.DatabaseHostKey, "db.example.com"))
+		Expect(secret.StringData).To(HaveKeyWithValue(apiv1.DatabasePortKey, "5432"))
+		Expect(secret.StringData[apiv1.DatabaseURLKey]).To(ContainSubstring("@db.example.com:5432/"))
+
+		Expect(env(waitForDatabase(crud))["PGHOST"].ValueFrom.SecretKeyRef.Key).To(Equal(apiv1.DatabaseHostKey))
+	})
+
+	It("creates the database with the admin credentials", func() {
+		Expect(r.ensureDatabaseSecret(ctx, logger, crud)).To(Succeed())
+		Expect(r.ensureExternalDatabase(ctx, logger, crud)).To(Succeed())
+		Expect(crud.Status.Database.Server).To(BeEmpty())
+		cond, err := r.databaseCondition(ctx, crud)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cond.Reason).To(Equal("DatabaseCreating"))
+
+		psql := job(createDatabaseJobName(crud)).Spec.Template.Spec.Containers[0]
+		Expect(psql.Command[2]).To(ContainSubstring("CREATE DATABASE"))
+		vars := env(psql)
+		Expect(vars["PGUSER"].ValueFrom.SecretKeyRef.Name).To(Equal("pg-admin"))
+		Expect(vars["PGDATABASE"].Value).To(Equal(externalMaintenanceDatabase))
+		Expect(vars["OWNER"].ValueFrom.SecretKeyRef.Name).To(Equal(crud.DatabaseSecretName()))
+
+		complete(createDatabaseJobName(crud))
+		Expect(r.ensureExternalDatabase(ctx, logger, crud)).To(Succeed())
+		Expect(crud.Status.Database.Server).To(Equal("db.example.com:5432"))
+		cond, err = r.databaseCondition(ctx, crud)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cond.Status).To(Equal(core.ConditionTrue))
+	})
+
+	It("drops the database when the CRUD is deleted", func() {
+		Expect(r.ensureDatabaseSecret(ctx, logger, crud)).To(Succeed())
+		done, err := r.deleteDatabase(ctx, logger, crud)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(done).To(BeFalse())
+		Expect(job(dropDatabaseJobName(crud)).Spec.Template.Spec.Containers[0].Command[2]).To(ContainSubstring("DROP DATABASE"))
+
+		complete(dropDatabaseJobName(crud))
+		done, err = r.deleteDatabase(ctx, logger, crud)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(done).To(BeTrue())
+		jobKey := key(crud)
+		jobKey.Name = dropDatabaseJobName(crud)
+		Expect(apierrors.IsNotFound(r.Get(ctx, jobKey, &batch.Job{}))).To(BeTrue())
+	})
+})
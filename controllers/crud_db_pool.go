@@ -0,0 +1,212 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	apiv1 "github.com/crudgen-org/crudgen-orchestrator/api/v1"
+)
+
+// +kubebuilder:rbac:groups=api.crudgen.org,resources=databasepools,verbs=get;list;watch
+// +kubebuilder:rbac:groups=api.crudgen.org,resources=databasepools/status,verbs=get;update;patch
+
+// poolIndex returns the index of the database of crud in the pool, or -1.
+func poolIndex(pool *apiv1.DatabasePool, crud *apiv1.CRUD) int {
+	for i, db := range pool.Status.Databases {
+		if db.Namespace == crud.Namespace && db.CRUD == crud.Name {
+			return i
+		}
+	}
+	return -1
+}
+
+// poolRoom is the number of databases the pool can still accept.
+func poolRoom(pool *apiv1.DatabasePool) int32 {
+	if room := pool.Spec.MaxDatabases - int32(len(pool.Status.Databases)); room > 0 {
+		return room
+	}
+	return 0
+}
+
+// ensurePoolAllocation allocates the database of crud on a pool. It reports
+// false while no pool has room for it.
+func (r *CRUDReconciler) ensurePoolAllocation(ctx context.Context, logger logr.Logger, crud *apiv1.CRUD) (bool, error) {
+	if crud.Status.Database.Pool == "" {
+		pool, err := r.selectPool(ctx, crud)
+		if err != nil {
+			return false, err
+		}
+		if pool == nil {
+			logger.Info("no database pool has room for the database")
+			return false, nil
+		}
+		if poolIndex(pool, crud) < 0 {
+			// the lock keeps concurrent allocations from overcommitting
+			// the pool
+			patch := client.MergeFromWithOptions(pool.DeepCopy(), client.MergeFromWithOptimisticLock{})
+			pool.Status.Databases = append(pool.Status.Databases, apiv1.PoolDatabase{
+				Namespace: crud.Namespace,
+				CRUD:      crud.Name,
+			})
+			pool.Status.Allocated = int32(len(pool.Status.Databases))
+			pool.Status.Available = poolRoom(pool)
+			if err := r.Status().Patch(ctx, pool, patch); err != nil {
+				return false, errors.Wrapf(err, "could not allocate the database on pool %s", pool.Name)
+			}
+		}
+		crud.Status.Database.Pool = pool.Name
+		logger.Info("database allocated on pool", "pool", pool.Name)
+	}
+	return true, nil
+}
+
+// selectPool returns the pool crud is allocated on, or the pool with the most
+// room among the candidates. It returns nil when none has room.
+func (r *CRUDReconciler) selectPool(ctx context.Context, crud *apiv1.CRUD) (*apiv1.DatabasePool, error) {
+	ref := crud.Spec.Database.Pool
+	if ref == nil {
+		ref = &apiv1.DatabasePoolReference{}
+	}
+
+	var candidates []apiv1.DatabasePool
+	if ref.Name != "" {
+		pool := apiv1.DatabasePool{}
+		switch err := r.Get(ctx, types.NamespacedName{Name: ref.Name}, &pool); {
+		case apierrors.IsNotFound(err):
+			return nil, nil
+		case err != nil:
+			return nil, errors.Wrapf(err, "could not retrieve database pool %s", ref.Name)
+		}
+		candidates = append(candidates, pool)
+	} else {
+		selector := labels.Everything()
+		if ref.Selector != nil {
+			var err error
+			if selector, err = meta.LabelSelectorAsSelector(ref.Selector); err != nil {
+				return nil, err
+			}
+		}
+		pools := &apiv1.DatabasePoolList{}
+		if err := r.List(ctx, pools, client.MatchingLabelsSelector{Selector: selector}); err != nil {
+			return nil, errors.Wrap(err, "could not list database pools")
+		}
+		candidates = pools.Items
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if ri, rj := poolRoom(&candidates[i]), poolRoom(&candidates[j]); ri != rj {
+			return ri > rj
+		}
+		return candidates[i].Name < candidates[j].Name
+	})
+	for i := range candidates {
+		// an allocation whose status update was lost
+		if poolIndex(&candidates[i], crud) >= 0 {
+			return &candidates[i], nil
+		}
+	}
+	if len(candidates) == 0 || poolRoom(&candidates[0]) == 0 {
+		return nil, nil
+	}
+	return &candidates[0], nil
+}
+
+// poolCRUDNamespaceLabel and poolCRUDLabel tell which CRUD the jobs and the
+// credentials kept in the namespace of the admin secret of a pool are for.
+const (
+	poolCRUDNamespaceLabel = "api.crudgen.org/crud-namespace"
+	poolCRUDLabel          = "api.crudgen.org/crud"
+)
+
+func poolLabels(crud *apiv1.CRUD) map[string]string {
+	return map[string]string{
+		poolCRUDNamespaceLabel: crud.Namespace,
+		poolCRUDLabel:          crud.Name,
+	}
+}
+
+// poolCredentialsName is the copy of the credentials of crud in the
+// namespace of the admin secret of its pool.
+func poolCredentialsName(crud *apiv1.CRUD) string {
+	return fmt.Sprintf("crud-%s-database", crud.UID)
+}
+
+// poolJobCRUD maps the jobs run in the namespace of a pool to their CRUD,
+// which cannot own them from another namespace.
+func poolJobCRUD(o handler.MapObject) []reconcile.Request {
+	labels := o.Meta.GetLabels()
+	if labels[poolCRUDNamespaceLabel] == "" || labels[poolCRUDLabel] == "" {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: types.NamespacedName{
+		Namespace: labels[poolCRUDNamespaceLabel],
+		Name:      labels[poolCRUDLabel],
+	}}}
+}
+
+// ensurePoolCredentials copies the credentials of the CRUD, and only them,
+// to the namespace the jobs of its pool run in. The admin secret of the
+// pool never leaves its namespace.
+func (r *CRUDReconciler) ensurePoolCredentials(ctx context.Context, admin *databaseAdmin) error {
+	crud := admin.crud
+	source := &core.Secret{}
+	if err := r.Get(ctx, types.NamespacedName{Namespace: crud.Namespace, Name: crud.DatabaseSecretName()}, source); err != nil {
+		return errors.Wrap(err, "could not retrieve database secret")
+	}
+
+	key := types.NamespacedName{Namespace: admin.namespace, Name: admin.credentials}
+	secret := &core.Secret{}
+	switch err := r.Get(ctx, key, secret); {
+	case apierrors.IsNotFound(err):
+		secret = &core.Secret{
+			ObjectMeta: meta.ObjectMeta{
+				Name:      key.Name,
+				Namespace: key.Namespace,
+				Labels:    poolLabels(crud),
+			},
+			Type: core.SecretTypeOpaque,
+			Data: source.Data,
+		}
+		if err := r.Create(ctx, secret); err != nil {
+			return errors.Wrap(err, "could not create pool copy of the database secret")
+		}
+	case err != nil:
+		return errors.Wrap(err, "could not retrieve pool copy of the database secret")
+	case !equality.Semantic.DeepEqual(secret.Data, source.Data):
+		secret.Data = source.Data
+		if err := r.Update(ctx, secret); err != nil {
+			return errors.Wrap(err, "could not update pool copy of the database secret")
+		}
+	}
+	return nil
+}
+
+// deletePoolCredentials deletes the copy of the credentials of a deleted
+// CRUD from the namespace of its pool.
+func (r *CRUDReconciler) deletePoolCredentials(ctx context.Context, crud *apiv1.CRUD) error {
+	if crud.Spec.Database.Mode != apiv1.DatabaseModePool || crud.Status.Database.Pool == "" {
+		return nil
+	}
+	admin, err := r.databaseAdmin(ctx, crud)
+	if err != nil {
+		return err
+	}
+	secret := &core.Secret{ObjectMeta: meta.ObjectMeta{Namespace: admin.namespace, Name: admin.credentials}}
+	if err := r.Delete(ctx, secret); err != nil && !apierrors.IsNotFound(err) {
+		return errors.Wrap(err, "could not delete pool copy of the database secret")
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package controllers
+
+import (
+	"context"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	batch "k8s.io/api/batch/v1"
+	core "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	apiv1 "github.com/crudgen-org/crudgen-orchestrator/api/v1"
+)
+
+var _ = Describe("database pools", func() {
+	var (
+		ctx    context.Context
+		logger logr.Logger
+		r      *CRUDReconciler
+		crud   *apiv1.CRUD
+	)
+
+	newPool := func(name string, max int32, labels map[string]string, allocated ...string) *apiv1.DatabasePool {
+		pool := &apiv1.DatabasePool{
+			ObjectMeta: meta.ObjectMeta{Name: name, Labels: labels, ResourceVersion: "1"},
+			Spec: apiv1.DatabasePoolSpec{
+				AdminSecret:  core.SecretReference{Namespace: "db", Name: name + "-admin"},
+				MaxDatabases: max,
+			},
+		}
+		for _, crud := range allocated {
+			pool.Status.Databases = append(pool.Status.Databases, apiv1.PoolDatabase{Namespace: "other", CRUD: crud})
+		}
+		return pool
+	}
+
+	newAdmin := func(pool string) *core.Secret {
+		return &core.Secret{
+			ObjectMeta: meta.ObjectMeta{Namespace: "db", Name: pool + "-admin"},
+			Data: map[string][]byte{
+				apiv1.ExternalHostKey:     []byte(pool + ".db.example.com"),
+				apiv1.ExternalUsernameKey: []byte("admin"),
+				apiv1.ExternalPasswordKey: []byte("secret"),
+			},
+		}
+	}
+
+	setup := func(objects ...runtime.Object) {
+		s := testScheme()
+		objects = append(objects, crud.DeepCopy())
+		r = &CRUDReconciler{Client: fake.NewFakeClientWithScheme(s, objects...), Scheme: s}
+	}
+
+	// createJob returns the job creating the database, in the namespace of
+	// the admin secret of the pool
+	createJob := func() *batch.Job {
+		job := &batch.Job{}
+		name := string(crud.UID) + "-create-database"
+		Expect(r.Get(ctx, types.NamespacedName{Namespace: "db", Name: name}, job)).To(Succeed())
+		return job
+	}
+
+	pool := func(name string) *apiv1.DatabasePool {
+		pool := &apiv1.DatabasePool{}
+		Expect(r.Get(ctx, types.NamespacedName{Name: name}, pool)).To(Succeed())
+		return pool
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		logger = logf.Log.WithName("test")
+		crud = newTestCRUD()
+		crud.UID = "1234"
+		crud.Spec.Database.Mode = apiv1.DatabaseModePool
+		crud.SetDefaults()
+	})
+
+	It("allocates the database on the matching pool with the most room", func() {
+		crud.Spec.Database.Pool = &apiv1.DatabasePoolReference{
+			Selector: &meta.LabelSelector{MatchLabels: map[string]string{"tier": "standard"}},
+		}
+		setup(
+			newPool("busy", 3, map[string]string{"tier": "standard"}, "a", "b"),
+			newPool("quiet", 3, map[string]string{"tier": "standard"}, "a"),
+			newPool("premium", 10, map[string]string{"tier": "premium"}),
+			newAdmin("quiet"),
+		)
+
+		allocated, err := r.ensurePoolAllocation(ctx, logger, crud)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(allocated).To(BeTrue())
+		Expect(crud.Status.Database.Pool).To(Equal("quiet"))
+
+		quiet := pool("quiet")
+		Expect(quiet.Status.Databases).To(ContainElement(apiv1.PoolDatabase{Namespace: crud.Namespace, CRUD: crud.Name}))
+		Expect(quiet.Status.Allocated).To(Equal(int32(2)))
+		Expect(quiet.Status.Available).To(Equal(int32(1)))
+
+		Expect(r.ensureDatabaseSecret(ctx, logger, crud)).To(Succeed())
+		Expect(r.ensureExternalDatabase(ctx, logger, crud)).To(Succeed())
+		job := createJob()
+		Expect(job.Labels).To(Equal(poolLabels(crud)))
+		Expect(poolJobCRUD(handler.MapObject{Meta: job, Object: job})).To(ConsistOf(reconcile.Request{NamespacedName: key(crud)}))
+		for _, env := range job.Spec.Template.Spec.Containers[0].Env {
+			switch env.Name {
+			case "PGUSER":
+				Expect(env.ValueFrom.SecretKeyRef.Name).To(Equal("quiet-admin"))
+			case "OWNER_PASSWORD":
+				Expect(env.ValueFrom.SecretKeyRef.Name).To(Equal(poolCredentialsName(crud)))
+			}
+		}
+	})
+
+	It("keeps the admin secret of the pool in its namespace", func() {
+		crud.Spec.Database.Pool = &apiv1.DatabasePoolReference{Name: "quiet"}
+		setup(newPool("quiet", 3, nil), newAdmin("quiet"))
+		_, err := r.ensurePoolAllocation(ctx, logger, crud)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(r.ensureDatabaseSecret(ctx, logger, crud)).To(Succeed())
+		Expect(r.ensureExternalDatabase(ctx, logger, crud)).To(Succeed())
+
+		// the namespace of the CRUD only holds its own credentials
+		secrets := &core.SecretList{}
+		Expect(r.List(ctx, secrets, client.InNamespace(crud.Namespace))).To(Succeed())
+		Expect(secrets.Items).To(HaveLen(1))
+		credentials := secrets.Items[0]
+		Expect(credentials.Name).To(Equal(crud.DatabaseSecretName()))
+		Expect(credentials.Data).NotTo(HaveKey(apiv1.ExternalPasswordKey))
+
+		// which the jobs of the pool get a copy of
+		copied := &core.Secret{}
+		Expect(r.Get(ctx, types.NamespacedName{Namespace: "db", Name: poolCredentialsName(crud)}, copied)).To(Succeed())
+		Expect(copied.Data).To(Equal(credentials.Data))
+		Expect(copied.OwnerReferences).To(BeEmpty())
+		Expect(createJob().OwnerReferences).To(BeEmpty())
+
+		// the copy goes away with the CRUD
+		job := createJob()
+		job.Status.Conditions = []batch.JobCondition{{Type: batch.JobComplete, Status: core.ConditionTrue}}
+		Expect(r.Update(ctx, job)).To(Succeed())
+		Expect(r.ensureExternalDatabase(ctx, logger, crud)).To(Succeed())
+		Expect(crud.Status.Database.Server).To(Equal("quiet.db.example.com:5432"))
+		Expect(r.deletePoolCredentials(ctx, crud)).To(Succeed())
+		err = r.Get(ctx, types.NamespacedName{Namespace: "db", Name: poolCredentialsName(crud)}, copied)
+		Expect(apierrors.IsNotFound(err)).To(BeTrue())
+	})
+
+	It("waits while the named pool is full", func() {
+		crud.Spec.Database.Pool = &apiv1.DatabasePoolReference{Name: "busy"}
+		setup(newPool("busy", 2, nil, "a", "b"), newPool("quiet", 2, nil))
+
+		allocated, err := r.ensurePoolAllocation(ctx, logger, crud)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(allocated).To(BeFalse())
+		Expect(crud.Status.Database.Pool).To(BeEmpty())
+		cond, err := r.databaseCondition(ctx, crud)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cond.Reason).To(Equal("NoPoolAvailable"))
+		Expect(pool("busy").Status.Databases).To(HaveLen(2))
+	})
+
+	It("keeps an allocation whose status update was lost", func() {
+		full := newPool("shared", 1, nil)
+		full.Status.Databases = []apiv1.PoolDatabase{{Namespace: crud.Namespace, CRUD: crud.Name}}
+		setup(full, newAdmin("shared"))
+
+		allocated, err := r.ensurePoolAllocation(ctx, logger, crud)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(allocated).To(BeTrue())
+		Expect(crud.Status.Database.Pool).To(Equal("shared"))
+		Expect(pool("shared").Status.Databases).To(HaveLen(1))
+	})
+
+	It("has nothing to drop without an allocation", func() {
+		setup()
+		done, err := r.deleteDatabase(ctx, logger, crud)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(done).To(BeTrue())
+	})
+})
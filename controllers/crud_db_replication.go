@@ -0,0 +1,215 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	core "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	apiv1 "github.com/crudgen-org/crudgen-orchestrator/api/v1"
+)
+
+// +kubebuilder:rbac:groups="",resources=pods,verbs=get;list;patch
+
+// failoverGracePeriod is how long the primary may be unready before a
+// standby is promoted, so that a restart does not trigger a failover.
+const failoverGracePeriod = 30 * time.Second
+
+// podInfoPath is where the downward API exposes the labels of the database
+// pods, the role label included. The file follows label changes.
+const podInfoPath = "/etc/podinfo"
+
+// postgresScript starts an instance in the role the orchestrator gave its pod
+// and follows role changes. A standby clones the primary on first start, and
+// a former primary is rewound to follow the new one, or cloned again when it
+// cannot be. A standby whose role becomes primary is promoted; a primary
+// whose role becomes replica shuts down so as to restart as a standby.
+const postgresScript = `set -e
+role() {
+  sed -n 's|^` + apiv1.DatabaseRoleLabel + `="\(.*\)"$|\1|p' ` + podInfoPath + `/labels
+}
+until [ -n "$(role)" ]; do
+  echo "waiting for a database role"
+  sleep 2
+done
+
+hba='host replication all all md5'
+echo "echo '$hba' >> \"\$PGDATA/pg_hba.conf\"" > /docker-entrypoint-initdb.d/replication.sh
+if [ -s "$PGDATA/PG_VERSION" ] && ! grep -q '^host replication' "$PGDATA/pg_hba.conf"; then
+  echo "$hba" >> "$PGDATA/pg_hba.conf"
+fi
+
+export PGPASSWORD="$POSTGRES_PASSWORD"
+clone() {
+  find "$PGDATA" -mindepth 1 -delete
+  gosu postgres pg_basebackup --host="$PRIMARY_HOST" --username="$POSTGRES_USER" \
+    --pgdata="$PGDATA" --wal-method=stream --write-recovery-conf
+}
+current=$(role)
+if [ "$current" = ` + apiv1.DatabaseRolePrimary + ` ]; then
+  rm -f "$PGDATA/standby.signal"
+elif [ ! -s "$PGDATA/PG_VERSION" ]; then
+  clone
+elif [ ! -f "$PGDATA/standby.signal" ]; then
+  gosu postgres pg_rewind --target-pgdata="$PGDATA" --write-recovery-conf \
+    --source-server="host=$PRIMARY_HOST user=$POSTGRES_USER dbname=$POSTGRES_DB" || clone
+fi
+
+docker-entrypoint.sh postgres -c wal_level=replica -c hot_standby=on -c wal_log_hints=on -c max_wal_senders=10 &
+pid=$!
+trap 'kill -TERM $pid; wait $pid; exit 0' TERM INT
+while kill -0 $pid 2>/dev/null; do
+  sleep 2
+  case "$(role)" in
+  "$current") ;;
+  ` + apiv1.DatabaseRolePrimary + `)
+    echo "promoting to primary"
+    gosu postgres pg_ctl promote -D "$PGDATA"
+    current=` + apiv1.DatabaseRolePrimary + `
+    ;;
+  *)
+    echo "demoted, restarting as a standby"
+    kill -TERM $pid
+    wait $pid || true
+    exit 1
+    ;;
+  esac
+done
+wait $pid`
+
+// podOrdinal returns the ordinal of a pod of the statefulset, or -1.
+func podOrdinal(crud *apiv1.CRUD, name string) int {
+	suffix := strings.TrimPrefix(name, crud.DatabaseStatefulName()+"-")
+	ordinal, err := strconv.Atoi(suffix)
+	if err != nil || suffix == name {
+		return -1
+	}
+	return ordinal
+}
+
+// podReady reports whether the pod is ready, and since when it has been in
+// that state.
+func podReady(pod *core.Pod) (bool, time.Time) {
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == core.PodReady {
+			return cond.Status == core.ConditionTrue, cond.LastTransitionTime.Time
+		}
+	}
+	return false, pod.CreationTimestamp.Time
+}
+
+// databaseReplicas is the number of instances of the statefulset. It does
+// not drop below the primary while the primary cannot be moved to one of the
+// remaining instances.
+func databaseReplicas(crud *apiv1.CRUD) int32 {
+	replicas := *crud.Spec.Database.Replicas
+	if ordinal := int32(podOrdinal(crud, crud.Status.Database.Primary)); ordinal >= replicas {
+		replicas = ordinal + 1
+	}
+	return replicas
+}
+
+// reconcileDatabaseRoles labels the database pods with their role. When the
+// primary has been unready for failoverGracePeriod, or is about to be
+// removed by a scale down, a ready standby is promoted in its place. The
+// pods are not watched: the statefulset reports the primary becoming
+// unready, and the time left before the failover is returned to requeue.
+func (r *CRUDReconciler) reconcileDatabaseRoles(ctx context.Context, logger logr.Logger, crud *apiv1.CRUD) (time.Duration, error) {
+	if crud.Status.Database.Primary == "" {
+		crud.Status.Database.Primary = fmt.Sprintf("%s-0", crud.DatabaseStatefulName())
+	}
+
+	pods := &core.PodList{}
+	if err := r.PodReader.List(ctx, pods, client.InNamespace(crud.Namespace), client.MatchingLabels(crud.DatabaseLabel())); err != nil {
+		return 0, errors.Wrap(err, "could not list database pods")
+	}
+	sort.Slice(pods.Items, func(i, j int) bool {
+		return podOrdinal(crud, pods.Items[i].Name) < podOrdinal(crud, pods.Items[j].Name)
+	})
+
+	var primary, candidate *core.Pod
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		ordinal := podOrdinal(crud, pod.Name)
+		switch ready, _ := podReady(pod); {
+		case pod.Name == crud.Status.Database.Primary:
+			primary = pod
+		case ready && pod.DeletionTimestamp == nil && candidate == nil &&
+			ordinal >= 0 && ordinal < int(*crud.Spec.Database.Replicas):
+			candidate = pod
+		}
+	}
+	reason, due := primaryFailure(crud, primary)
+	if reason != "" && candidate != nil {
+		logger.Info("promoting database standby", "primary", crud.Status.Database.Primary, "standby", candidate.Name, "reason", reason)
+		if err := r.persistPrimary(ctx, crud, candidate.Name); err != nil {
+			return 0, err
+		}
+		r.Recorder.Eventf(crud, core.EventTypeWarning, "DatabaseFailover", "promoting %s: %s", candidate.Name, reason)
+	}
+
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		role := apiv1.DatabaseRoleReplica
+		if pod.Name == crud.Status.Database.Primary {
+			role = apiv1.DatabaseRolePrimary
+		}
+		if pod.Labels[apiv1.DatabaseRoleLabel] == role {
+			continue
+		}
+		patch := client.MergeFrom(pod.DeepCopy())
+		if pod.Labels == nil {
+			pod.Labels = map[string]string{}
+		}
+		pod.Labels[apiv1.DatabaseRoleLabel] = role
+		if err := r.Patch(ctx, pod, patch); err != nil {
+			return 0, errors.Wrapf(err, "could not label database pod %s", pod.Name)
+		}
+	}
+	return due, nil
+}
+
+// persistPrimary records the new primary before any pod is relabeled. The
+// promoted standby diverges from the previous primary: were the status lost
+// to a later error, the next reconcile would relabel the previous primary
+// once it recovers, and both timelines would be written to. The patch fails
+// if the CRUD has changed since it was read.
+func (r *CRUDReconciler) persistPrimary(ctx context.Context, crud *apiv1.CRUD, primary string) error {
+	// the response of the patch would overwrite the status being reconciled
+	latest := crud.DeepCopy()
+	base := latest.DeepCopy()
+	latest.Status.Database.Primary = primary
+	if err := r.Status().Patch(ctx, latest, client.MergeFromWithOptions(base, client.MergeFromWithOptimisticLock{})); err != nil {
+		return errors.Wrap(err, "could not record the database primary")
+	}
+	crud.Status.Database.Primary = primary
+	crud.ResourceVersion = latest.ResourceVersion
+	return nil
+}
+
+// primaryFailure returns why the primary should be replaced, if it should,
+// or else how long an unready primary has left before it is. A missing
+// primary pod is being recreated by the statefulset and keeps its role.
+func primaryFailure(crud *apiv1.CRUD, primary *core.Pod) (string, time.Duration) {
+	if primary == nil {
+		return "", 0
+	}
+	if podOrdinal(crud, primary.Name) >= int(*crud.Spec.Database.Replicas) {
+		return "the primary is scaled down", 0
+	}
+	ready, since := podReady(primary)
+	if ready {
+		return "", 0
+	}
+	if left := failoverGracePeriod - time.Since(since); left > 0 {
+		return "", left
+	}
+	return fmt.Sprintf("the primary has been unready since %s", since.Format(time.RFC3339)), 0
+}
@@ -0,0 +1,201 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pkg/errors"
+	apps "k8s.io/api/apps/v1"
+	core "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	apiv1 "github.com/crudgen-org/crudgen-orchestrator/api/v1"
+)
+
+// unlabeledPodsClient fails the patches of the pods, as a reconcile
+// interrupted right after promoting a standby.
+type unlabeledPodsClient struct {
+	client.Client
+}
+
+func (c *unlabeledPodsClient) Patch(ctx context.Context, obj runtime.Object, patch client.Patch, opts ...client.PatchOption) error {
+	if _, ok := obj.(*core.Pod); ok {
+		return errors.New("connection refused")
+	}
+	return c.Client.Patch(ctx, obj, patch, opts...)
+}
+
+var _ = Describe("database replication", func() {
+	var (
+		ctx      context.Context
+		logger   logr.Logger
+		r        *CRUDReconciler
+		recorder *record.FakeRecorder
+		crud     *apiv1.CRUD
+	)
+
+	podName := func(ordinal int) string {
+		return fmt.Sprintf("%s-%d", crud.DatabaseStatefulName(), ordinal)
+	}
+
+	// newPod fakes a database pod that has been ready, or not, for age
+	newPod := func(ordinal int, ready bool, age time.Duration) *core.Pod {
+		status := core.ConditionFalse
+		if ready {
+			status = core.ConditionTrue
+		}
+		return &core.Pod{
+			ObjectMeta: meta.ObjectMeta{
+				Namespace: crud.Namespace,
+				Name:      podName(ordinal),
+				Labels:    crud.DatabaseLabel(),
+			},
+			Status: core.PodStatus{
+				Conditions: []core.PodCondition{{
+					Type:               core.PodReady,
+					Status:             status,
+					LastTransitionTime: meta.NewTime(time.Now().Add(-age)),
+				}},
+			},
+		}
+	}
+
+	setup := func(objects ...runtime.Object) {
+		s := testScheme()
+		recorder = record.NewFakeRecorder(10)
+		objects = append(objects, crud.DeepCopy())
+		c := fake.NewFakeClientWithScheme(s, objects...)
+		r = &CRUDReconciler{Client: c, PodReader: c, Scheme: s, Recorder: recorder}
+	}
+
+	// reconcileRoles reconciles the roles of the pods of crud and returns
+	// when the failover is due
+	reconcileRoles := func(crud *apiv1.CRUD) time.Duration {
+		due, err := r.reconcileDatabaseRoles(ctx, logger, crud)
+		Expect(err).NotTo(HaveOccurred())
+		return due
+	}
+
+	roles := func() map[string]string {
+		pods := &core.PodList{}
+		Expect(r.List(ctx, pods)).To(Succeed())
+		roles := map[string]string{}
+		for _, pod := range pods.Items {
+			roles[pod.Name] = pod.Labels[apiv1.DatabaseRoleLabel]
+		}
+		return roles
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		logger = logf.Log.WithName("test")
+		crud = newTestCRUD()
+		crud.ResourceVersion = "1"
+		crud.Spec.Database.Replicas = pointer.Int32Ptr(3)
+		crud.SetDefaults()
+	})
+
+	It("makes the first instance the primary", func() {
+		setup(newPod(0, false, time.Hour), newPod(1, false, time.Hour), newPod(2, false, time.Hour))
+		reconcileRoles(crud)
+
+		Expect(crud.Status.Database.Primary).To(Equal(podName(0)))
+		Expect(roles()).To(Equal(map[string]string{
+			podName(0): apiv1.DatabaseRolePrimary,
+			podName(1): apiv1.DatabaseRoleReplica,
+			podName(2): apiv1.DatabaseRoleReplica,
+		}))
+		Expect(recorder.Events).To(BeEmpty())
+	})
+
+	It("waits for the grace period before failing over", func() {
+		crud.Status.Database.Primary = podName(0)
+		setup(newPod(0, false, time.Second), newPod(1, true, time.Hour))
+		// the pods are not watched, the reconcile is requeued
+		Expect(reconcileRoles(crud)).To(BeNumerically("~", failoverGracePeriod-time.Second, time.Second))
+		Expect(crud.Status.Database.Primary).To(Equal(podName(0)))
+	})
+
+	It("promotes a ready standby when the primary fails", func() {
+		crud.Status.Database.Primary = podName(0)
+		setup(newPod(0, false, time.Minute), newPod(1, false, time.Minute), newPod(2, true, time.Hour),
+			&apps.StatefulSet{
+				ObjectMeta: meta.ObjectMeta{Namespace: crud.Namespace, Name: crud.DatabaseStatefulName()},
+				Spec:       apps.StatefulSetSpec{Replicas: pointer.Int32Ptr(3)},
+				Status:     apps.StatefulSetStatus{ReadyReplicas: 1},
+			})
+		reconcileRoles(crud)
+
+		Expect(crud.Status.Database.Primary).To(Equal(podName(2)))
+		Expect(roles()).To(Equal(map[string]string{
+			podName(0): apiv1.DatabaseRoleReplica,
+			podName(1): apiv1.DatabaseRoleReplica,
+			podName(2): apiv1.DatabaseRolePrimary,
+		}))
+		Expect(recorder.Events).To(Receive(ContainSubstring("DatabaseFailover")))
+
+		cond, err := r.databaseCondition(ctx, crud)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cond.Status).To(Equal(core.ConditionTrue))
+		Expect(cond.Message).To(HavePrefix("primary " + podName(2)))
+	})
+
+	It("records the promoted standby before relabeling the pods", func() {
+		crud.Status.Database.Primary = podName(0)
+		setup(newPod(0, false, time.Minute), newPod(1, true, time.Hour))
+		r.Client = &unlabeledPodsClient{r.Client}
+		_, err := r.reconcileDatabaseRoles(ctx, logger, crud)
+		Expect(err).To(MatchError(ContainSubstring("could not label database pod")))
+
+		latest := &apiv1.CRUD{}
+		Expect(r.Get(ctx, key(crud), latest)).To(Succeed())
+		Expect(latest.Status.Database.Primary).To(Equal(podName(1)))
+
+		// the previous primary recovers before the next reconcile
+		r.Client = r.Client.(*unlabeledPodsClient).Client
+		Expect(r.Status().Update(ctx, newPod(0, true, 0))).To(Succeed())
+		reconcileRoles(latest)
+		Expect(roles()).To(Equal(map[string]string{
+			podName(0): apiv1.DatabaseRoleReplica,
+			podName(1): apiv1.DatabaseRolePrimary,
+		}))
+	})
+
+	It("does not promote a standby for a CRUD changed since it was read", func() {
+		crud.Status.Database.Primary = podName(0)
+		setup(newPod(0, false, time.Minute), newPod(1, true, time.Hour))
+		crud.ResourceVersion = "0"
+		_, err := r.reconcileDatabaseRoles(ctx, logger, crud)
+		Expect(apierrors.IsConflict(errors.Cause(err))).To(BeTrue())
+		Expect(roles()).To(Equal(map[string]string{podName(0): "", podName(1): ""}))
+	})
+
+	It("keeps a failed primary without a ready standby", func() {
+		crud.Status.Database.Primary = podName(0)
+		setup(newPod(0, false, time.Minute), newPod(1, false, time.Minute))
+		reconcileRoles(crud)
+		Expect(crud.Status.Database.Primary).To(Equal(podName(0)))
+	})
+
+	It("moves the primary off the instances being scaled down", func() {
+		crud.Spec.Database.Replicas = pointer.Int32Ptr(1)
+		crud.Status.Database.Primary = podName(2)
+		setup(newPod(0, true, time.Hour), newPod(1, true, time.Hour), newPod(2, true, time.Hour))
+		Expect(databaseReplicas(crud)).To(Equal(int32(3)))
+
+		reconcileRoles(crud)
+		Expect(crud.Status.Database.Primary).To(Equal(podName(0)))
+		Expect(databaseReplicas(crud)).To(Equal(int32(1)))
+	})
+})
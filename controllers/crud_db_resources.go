@@ -2,6 +2,8 @@ package controllers
 
 import (
 	"context"
+	"fmt"
+
 	"github.com/go-logr/logr"
 	"github.com/pkg/errors"
 	apps "k8s.io/api/apps/v1"
@@ -11,157 +13,230 @@ import (
 	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/utils/pointer"
-	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 
 	apiv1 "github.com/crudgen-org/crudgen-orchestrator/api/v1"
 )
 
-func (r *CRUDReconciler) ensureDatabseStatefulset(ctx context.Context, logger logr.Logger, crud *apiv1.CRUD) error {
-	sts := &apps.StatefulSet{}
-	resourceQuantity, _ := resource.ParseQuantity("3G")
+// pgIsReady checks that the database accepts connections. It does not
+// authenticate, so the credentials it uses may be stale after a rotation.
+var pgIsReady = core.Handler{
+	Exec: &core.ExecAction{
+		Command: []string{"sh", "-c",
+			fmt.Sprintf(`exec pg_isready --host=127.0.0.1 --port=%d --username="$POSTGRES_USER" --dbname="$POSTGRES_DB"`, apiv1.DatabasePort)},
+	},
+}
 
-	switch err := r.Get(ctx, key(crud), sts); {
-	case apierrors.IsNotFound(err):
-		sts = &apps.StatefulSet{
+// postgresDataDir is the PGDATA of the postgres image, where the database
+// volume is mounted. The volume holds the data in a subdirectory, initdb
+// refuses a mount point that is not empty.
+const postgresDataDir = "/var/lib/postgresql/data"
+
+// waitForDatabaseScript polls the database service until it accepts
+// connections.
+const waitForDatabaseScript = `until pg_isready --timeout=5; do
+  echo "waiting for $PGHOST"
+  sleep 2
+done`
+
+// waitForDatabase is an init container holding back the pods that connect
+// to the database until it is ready, instead of letting them crash.
+func waitForDatabase(crud *apiv1.CRUD) core.Container {
+	return core.Container{
+		Name:    "wait-for-database",
+		Image:   crud.DatabaseImage(),
+		Command: []string{"sh", "-c", waitForDatabaseScript},
+		Env:     databaseServerEnv(crud),
+	}
+}
+
+// databaseVolumeClaims are the volume claim templates of the database
+// statefulset. Without a class in the spec, the default class of the
+// orchestrator is used, and the default one of the cluster without either.
+func (r *CRUDReconciler) databaseVolumeClaims(crud *apiv1.CRUD) []core.PersistentVolumeClaim {
+	class := crud.Spec.Database.Storage.StorageClassName
+	if class == nil && r.DefaultStorageClass != "" {
+		class = pointer.StringPtr(r.DefaultStorageClass)
+	}
+	return []core.PersistentVolumeClaim{
+		{
 			ObjectMeta: meta.ObjectMeta{
-				Name:      crud.DatabaseStatefulName(),
-				Namespace: crud.Namespace,
+				Name: crud.DatabaseVolumeClaimName(),
 			},
-			Spec: apps.StatefulSetSpec{
-				Replicas: pointer.Int32Ptr(1),
-				Selector: &meta.LabelSelector{
-					MatchLabels: crud.DatabaseLabel(),
+			Spec: core.PersistentVolumeClaimSpec{
+				AccessModes: []core.PersistentVolumeAccessMode{
+					"ReadWriteOnce",
 				},
-				Template: core.PodTemplateSpec{
-					ObjectMeta: meta.ObjectMeta{
-						Labels: map[string]string{
-							"app":  "postgres",
-							"crud": crud.GetName(),
-						},
+				Resources: core.ResourceRequirements{
+					Requests: map[core.ResourceName]resource.Quantity{
+						"storage": *crud.Spec.Database.Storage.Size,
 					},
-					Spec: core.PodSpec{
-						Volumes:        nil,
-						InitContainers: nil,
-						Containers: []core.Container{
-							{
-								Name:  "pg",
-								Image: "postgres:13",
-								Ports: []core.ContainerPort{
-									{
-										Name:          "ordb",
-										ContainerPort: 5432,
-									},
+				},
+				StorageClassName: class,
+			},
+		},
+	}
+}
+
+func (r *CRUDReconciler) ensureDatabseStatefulset(ctx context.Context, logger logr.Logger, crud *apiv1.CRUD) error {
+	key := key(crud)
+	key.Name = crud.DatabaseStatefulName()
+
+	claims := r.databaseVolumeClaims(crud)
+
+	// volume claim templates are immutable, keep the ones the statefulset
+	// was created with; resizeDatabaseVolumes expands the claims themselves
+	existing := &apps.StatefulSet{}
+	switch err := r.Get(ctx, key, existing); {
+	case apierrors.IsNotFound(err):
+	case err != nil:
+		return errors.Wrap(err, "could not retrieve statefulset")
+	case existing.DeletionTimestamp != nil:
+		return nil
+	case !hasVolumeClaim(existing, crud.DatabaseVolumeClaimName()):
+		// a major upgrade, or its rollback, switched the database to other
+		// volumes: the statefulset is recreated on them
+		logger.Info("recreating database statefulset", "volumeClaim", crud.DatabaseVolumeClaimName())
+		if err := r.Delete(ctx, existing); err != nil && !apierrors.IsNotFound(err) {
+			return errors.Wrap(err, "could not delete statefulset")
+		}
+		return nil
+	default:
+		for i := range claims {
+			for _, current := range existing.Spec.VolumeClaimTemplates {
+				if current.Name != claims[i].Name {
+					continue
+				}
+				claims[i].Spec.Resources.Requests = current.Spec.Resources.Requests
+				claims[i].Spec.StorageClassName = current.Spec.StorageClassName
+			}
+		}
+	}
+
+	sts := &apps.StatefulSet{
+		ObjectMeta: meta.ObjectMeta{
+			Name:      crud.DatabaseStatefulName(),
+			Namespace: crud.Namespace,
+		},
+		Spec: apps.StatefulSetSpec{
+			Replicas: pointer.Int32Ptr(databaseReplicas(crud)),
+			Selector: &meta.LabelSelector{
+				MatchLabels: crud.DatabaseLabel(),
+			},
+			Template: core.PodTemplateSpec{
+				ObjectMeta: meta.ObjectMeta{
+					Labels: crud.DatabaseLabel(),
+				},
+				Spec: core.PodSpec{
+					Containers: []core.Container{
+						{
+							Name:    "pg",
+							Image:   crud.DatabaseServerImage(),
+							Command: []string{"sh", "-c", postgresScript},
+							Ports: []core.ContainerPort{
+								{
+									Name:          "ordb",
+									ContainerPort: apiv1.DatabasePort,
 								},
-								EnvFrom: []core.EnvFromSource{
-									{
-										ConfigMapRef: &core.ConfigMapEnvSource{
-											LocalObjectReference: core.LocalObjectReference{
-												Name: crud.DatabaseConfigMapName(),
-											},
-										},
-									},
+							},
+							Env: []core.EnvVar{
+								secretEnv(crud, "POSTGRES_USER", apiv1.DatabaseUserKey),
+								secretEnv(crud, "POSTGRES_PASSWORD", apiv1.DatabasePasswordKey),
+								secretEnv(crud, "POSTGRES_DB", apiv1.DatabaseNameKey),
+								{Name: "PGDATA", Value: postgresDataDir},
+								{Name: "PRIMARY_HOST", Value: crud.DatabaseServiceName()},
+							},
+							VolumeMounts: []core.VolumeMount{
+								{
+									Name:      crud.DatabaseVolumeClaimName(),
+									MountPath: postgresDataDir,
+									SubPath:   "Postgres",
 								},
-								VolumeMounts: []core.VolumeMount{
-									{
-										Name:      "ordb",
-										MountPath: "/var/lib/PostgreSQL/data",
-										SubPath:   "Postgres",
-									},
+								{
+									Name:      "podinfo",
+									MountPath: podInfoPath,
 								},
-								LivenessProbe:  nil, // TODO
-								ReadinessProbe: nil, // TODO
+							},
+							Resources: crud.Spec.Database.Resources,
+							// initdb runs on the unix socket only, the
+							// database is ready once it listens on TCP
+							ReadinessProbe: &core.Probe{
+								Handler:          pgIsReady,
+								PeriodSeconds:    5,
+								FailureThreshold: 3,
+							},
+							// leave time for crash recovery after a restart
+							LivenessProbe: &core.Probe{
+								Handler:             pgIsReady,
+								InitialDelaySeconds: 30,
+								PeriodSeconds:       10,
+								TimeoutSeconds:      5,
+								FailureThreshold:    6,
 							},
 						},
 					},
-				},
-				VolumeClaimTemplates: []core.PersistentVolumeClaim{
-					{
-						ObjectMeta: meta.ObjectMeta{
-							Name: "ordb",
-						},
-						Spec: core.PersistentVolumeClaimSpec{
-							AccessModes: []core.PersistentVolumeAccessMode{
-								"ReadWriteOnce",
-							},
-							Resources: core.ResourceRequirements{
-								Requests: map[core.ResourceName]resource.Quantity{
-									"storage": resourceQuantity,
+					Volumes: []core.Volume{
+						{
+							Name: "podinfo",
+							VolumeSource: core.VolumeSource{
+								DownwardAPI: &core.DownwardAPIVolumeSource{
+									Items: []core.DownwardAPIVolumeFile{
+										{
+											Path:     "labels",
+											FieldRef: &core.ObjectFieldSelector{FieldPath: "metadata.labels"},
+										},
+									},
 								},
 							},
-							StorageClassName: pointer.StringPtr("hiops"),
 						},
 					},
 				},
 			},
-		}
-		if err := controllerutil.SetControllerReference(crud, sts, r.Scheme); err != nil {
-			return errors.Wrap(err, "could not set owner reference on database statefulset")
-		}
-		if err := r.Create(ctx, sts); err != nil {
-			return errors.Wrap(err, "could not update statefulset")
-		}
-
-	case err != nil:
-		return errors.Wrap(err, "could not retrieve statefulset")
-
-	default:
-		//updateDeploy := false
-		//if sts.Spec.Template.Spec.Containers == nil ||
-		//	len(sts.Spec.Template.Spec.Containers) == 0 {
-		//	return errors.New("containers in deployment is nil.")
-		//}
-		//if sts.Spec.Template.Spec.Containers[0].Image != crud.Status.Image {
-		//	sts.Spec.Template.Spec.Containers[0].sts = crud.Status.Image
-		//	updateDeploy = true
-		//}
-		//if updateDeploy {
-		//	if err := r.Update(ctx, sts); err != nil {
-		//		return errors.Wrap(err, "could not update deployment")
-		//	}
-		//}
-		// TODO update if necessary
+			VolumeClaimTemplates: claims,
+		},
+	}
+	if err := r.apply(ctx, crud, sts); err != nil {
+		return errors.Wrap(err, "could not apply statefulset")
 	}
 	return nil
 }
 
-func (r *CRUDReconciler) ensureDatabaseService(ctx context.Context, logger logr.Logger, crud *apiv1.CRUD) error {
-	service := &core.Service{}
+func hasVolumeClaim(sts *apps.StatefulSet, name string) bool {
+	for _, claim := range sts.Spec.VolumeClaimTemplates {
+		if claim.Name == name {
+			return true
+		}
+	}
+	return false
+}
 
-	key := key(crud)
-	key.Name = crud.DatabaseServiceName()
-	switch err := r.Get(ctx, key, service); {
-	case apierrors.IsNotFound(err):
-		service := &core.Service{
-			ObjectMeta: meta.ObjectMeta{
-				Name:      crud.DatabaseServiceName(),
-				Namespace: crud.Namespace,
-			},
-			Spec: core.ServiceSpec{
-				Ports: []core.ServicePort{
-					{
-						Name: "pg",
-						Port: 5432,
-						TargetPort: intstr.IntOrString{
-							IntVal: 5432,
-						},
-					},
+func (r *CRUDReconciler) ensureDatabaseService(ctx context.Context, logger logr.Logger, crud *apiv1.CRUD) error {
+	service := &core.Service{
+		ObjectMeta: meta.ObjectMeta{
+			Name:      crud.DatabaseServiceName(),
+			Namespace: crud.Namespace,
+		},
+		Spec: core.ServiceSpec{
+			Ports: []core.ServicePort{
+				{
+					Name:       "pg",
+					Port:       apiv1.DatabasePort,
+					TargetPort: intstr.FromInt(apiv1.DatabasePort),
 				},
-				Selector: crud.DatabaseLabel(),
-				Type:     core.ServiceTypeClusterIP,
 			},
-		}
-		if err := controllerutil.SetControllerReference(crud, service, r.Scheme); err != nil {
-			return errors.Wrap(err, "could not set controller reference on service")
-		}
-		if err := r.Create(ctx, service); err != nil {
-			return errors.Wrap(err, "could not create service")
-		}
-
-	case err != nil:
-		return errors.Wrap(err, "could not get service")
+			Selector: crud.DatabaseRoleLabels(apiv1.DatabaseRolePrimary),
+			Type:     core.ServiceTypeClusterIP,
+		},
+	}
+	if err := r.apply(ctx, crud, service); err != nil {
+		return errors.Wrap(err, "could not apply database service")
+	}
 
-	default:
-		// TODO: update if necessary
+	// the standbys serve read-only queries, it has no endpoints without them
+	readOnly := service.DeepCopy()
+	readOnly.Name = crud.DatabaseReadOnlyServiceName()
+	readOnly.Spec.Selector = crud.DatabaseRoleLabels(apiv1.DatabaseRoleReplica)
+	if err := r.apply(ctx, crud, readOnly); err != nil {
+		return errors.Wrap(err, "could not apply read-only database service")
 	}
 	return nil
 }
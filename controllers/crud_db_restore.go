@@ -0,0 +1,99 @@
+package controllers
+
+import (
+	"context"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	apps "k8s.io/api/apps/v1"
+	autoscaling "k8s.io/api/autoscaling/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	apiv1 "github.com/crudgen-org/crudgen-orchestrator/api/v1"
+)
+
+// +kubebuilder:rbac:groups=api.crudgen.org,resources=crudrestores,verbs=get;list;watch
+
+// reconcileRestore keeps the API scaled down while a CRUDRestore holds the
+// restore annotation, and reports whether it does. The annotation is dropped
+// if the restore is gone or finished.
+func (r *CRUDReconciler) reconcileRestore(ctx context.Context, logger logr.Logger, crud *apiv1.CRUD) (bool, error) {
+	name, ok := crud.Annotations[apiv1.RestoreAnnotation]
+	restoring := false
+	if ok {
+		key := key(crud)
+		key.Name = name
+		restore := &apiv1.CRUDRestore{}
+		switch err := r.Get(ctx, key, restore); {
+		case err == nil:
+			restoring = !restore.Status.Finished()
+		case !apierrors.IsNotFound(err):
+			return false, errors.Wrap(err, "could not retrieve crudrestore")
+		}
+	}
+	if ok && !restoring {
+		logger.Info("dropping stale restore annotation", "crudrestore", name)
+		latest := crud.DeepCopy()
+		patch := client.MergeFrom(crud.DeepCopy())
+		delete(latest.Annotations, apiv1.RestoreAnnotation)
+		if err := r.Patch(ctx, latest, patch); err != nil {
+			return false, errors.Wrap(err, "could not remove restore annotation")
+		}
+		crud.Annotations = latest.Annotations
+	}
+
+	if !restoring {
+		if crud.Status.IsConditionTrue(apiv1.ConditionRestoring) {
+			// the HPA does not scale a deployment with no replicas
+			if err := r.scaleDeployment(ctx, crud, *crud.Spec.Autoscaling.MinReplicas); err != nil {
+				return false, err
+			}
+			setRestoringCondition(crud, newCondition(apiv1.ConditionRestoring, false, "RestoreFinished",
+				"the API serves the restored database"))
+		}
+		return false, nil
+	}
+
+	setRestoringCondition(crud, newCondition(apiv1.ConditionRestoring, true, "RestoreRunning",
+		"the database is being restored by "+name))
+	return true, r.scaleDownAPI(ctx, crud)
+}
+
+// scaleDownAPI scales the API deployment to zero, deleting the HPA which
+// would scale it back up. ensureHPA recreates it.
+func (r *CRUDReconciler) scaleDownAPI(ctx context.Context, crud *apiv1.CRUD) error {
+	hpa := &autoscaling.HorizontalPodAutoscaler{}
+	hpa.Namespace, hpa.Name = crud.Namespace, crud.Name
+	if err := r.Delete(ctx, hpa); err != nil && !apierrors.IsNotFound(err) {
+		return errors.Wrap(err, "could not delete hpa")
+	}
+	return r.scaleDeployment(ctx, crud, 0)
+}
+
+func setRestoringCondition(crud *apiv1.CRUD, cond apiv1.Condition) {
+	cond.ObservedGeneration = crud.Generation
+	crud.Status.SetCondition(cond)
+}
+
+// scaleDeployment sets the replicas of the API deployment, if it exists.
+func (r *CRUDReconciler) scaleDeployment(ctx context.Context, crud *apiv1.CRUD, replicas int32) error {
+	key := key(crud)
+	key.Name = crud.DeploymentName()
+	deploy := &apps.Deployment{}
+	switch err := r.Get(ctx, key, deploy); {
+	case apierrors.IsNotFound(err):
+		return nil
+	case err != nil:
+		return errors.Wrap(err, "could not retrieve deployment")
+	}
+	if deploy.Spec.Replicas != nil && *deploy.Spec.Replicas == replicas {
+		return nil
+	}
+	patch := client.MergeFrom(deploy.DeepCopy())
+	deploy.Spec.Replicas = &replicas
+	if err := r.Patch(ctx, deploy, patch); err != nil {
+		return errors.Wrap(err, "could not scale deployment")
+	}
+	return nil
+}
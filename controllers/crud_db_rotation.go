@@ -0,0 +1,355 @@
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	apps "k8s.io/api/apps/v1"
+	batch "k8s.io/api/batch/v1"
+	core "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	apiv1 "github.com/crudgen-org/crudgen-orchestrator/api/v1"
+)
+
+// Keys of the database secret that only exist while a rotation is running.
+const (
+	pendingAPIUserKey     = "PENDING_API_USER"
+	pendingAPIPasswordKey = "PENDING_API_PASSWORD"
+	pendingPasswordKey    = "PENDING_POSTGRES_PASSWORD"
+	previousAPIUserKey    = "PREVIOUS_API_USER"
+)
+
+// credentialsHashAnnotation rolls the API pods when DATABASE_URL changes.
+const credentialsHashAnnotation = "api.crudgen.org/credentials-hash"
+
+// rotateCredentialsScript creates or updates the API role the API moves to.
+// The API roles log in as members of the owner and assume it, so objects
+// they create stay owned by the owner whichever role created them. No other
+// role is changed: the pods keep connecting with the current credentials
+// until they are replaced. Running it again has the same effect.
+const rotateCredentialsScript = `psql -v ON_ERROR_STOP=1 --single-transaction \
+  -v owner="$OWNER" -v api_user="$NEW_API_USER" -v api_password="$NEW_API_PASSWORD" <<'EOF'
+SELECT format('CREATE ROLE %I', :'api_user') WHERE NOT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = :'api_user') \gexec
+ALTER ROLE :"api_user" WITH LOGIN PASSWORD :'api_password';
+GRANT :"owner" TO :"api_user";
+ALTER ROLE :"api_user" SET role TO :'owner';
+EOF`
+
+// retireCredentialsScript disables the role the API used before the last
+// rotation, unless it is the owner, and changes the owner password once no
+// pod uses them anymore. In InCluster mode the job logs in as the owner: if
+// a previous run changed the password already, it logs in with the new one.
+const retireCredentialsScript = `psql --command='SELECT 1' >/dev/null 2>&1 || export PGPASSWORD="$NEW_PASSWORD"
+psql -v ON_ERROR_STOP=1 --single-transaction \
+  -v owner="$OWNER" -v api_user="$OLD_API_USER" -v owner_password="$NEW_PASSWORD" <<'EOF'
+SELECT format('ALTER ROLE %I WITH NOLOGIN PASSWORD NULL', :'api_user') WHERE :'api_user' <> :'owner' \gexec
+ALTER ROLE :"owner" WITH PASSWORD :'owner_password';
+EOF`
+
+func rotationJobName(crud *apiv1.CRUD) string {
+	return fmt.Sprintf("%s-rotate-credentials", crud.Name)
+}
+
+func retireJobName(crud *apiv1.CRUD) string {
+	return fmt.Sprintf("%s-retire-credentials", crud.Name)
+}
+
+// credentialsHash identifies the credentials currently handed to the API.
+func credentialsHash(secret *core.Secret) string {
+	return fmt.Sprintf("%x", sha256.Sum256(secret.Data[apiv1.DatabaseURLKey]))[:16]
+}
+
+// reconcileCredentialsRotation drives a rotation of the database credentials
+// one step forward. It returns after how long the next periodic rotation is
+// due, or zero if none is scheduled.
+//
+// A rotation goes through three steps, each resumed from the secret:
+//  1. new credentials are stored as pending keys of the secret,
+//  2. a job creates the new API role, alternating between <owner>_a and
+//     <owner>_b, and the API credentials of the secret are replaced, which
+//     rolls the API deployment,
+//  3. once the rollout is complete, a job disables the previous API role and
+//     changes the owner password.
+//
+// The credentials of a role are never changed while pods may use them, the
+// owner included, which the API uses until the first rotation. The jobs can
+// run again when the secret could not be updated after they completed.
+func (r *CRUDReconciler) reconcileCredentialsRotation(ctx context.Context, logger logr.Logger, crud *apiv1.CRUD) (time.Duration, error) {
+	key := key(crud)
+	key.Name = crud.DatabaseSecretName()
+
+	secret := &core.Secret{}
+	if err := r.Get(ctx, key, secret); err != nil {
+		return 0, errors.Wrap(err, "could not retrieve database secret")
+	}
+
+	switch {
+	case len(secret.Data[pendingAPIUserKey]) > 0:
+		return 0, r.applyPendingCredentials(ctx, logger, crud, secret)
+
+	case len(secret.Data[previousAPIUserKey]) > 0:
+		return 0, r.retirePreviousCredentials(ctx, logger, crud, secret)
+	}
+
+	request := crud.Annotations[apiv1.RotateCredentialsAnnotation]
+	requested := request != "" && request != crud.Status.Database.RotationRequest ||
+		secret.Annotations[legacyCredentialsAnnotation] != ""
+
+	var due time.Duration
+	if period := crud.Spec.Database.RotationPeriod; period != nil && period.Duration > 0 {
+		last := secret.CreationTimestamp.Time
+		if t := crud.Status.Database.CredentialsRotationTime; t != nil {
+			last = t.Time
+		}
+		due = time.Until(last.Add(period.Duration))
+		if due <= 0 {
+			requested = true
+		}
+	}
+	if !requested {
+		return due, nil
+	}
+
+	logger.Info("starting database credentials rotation")
+	return 0, r.preparePendingCredentials(ctx, crud, secret)
+}
+
+func (r *CRUDReconciler) preparePendingCredentials(ctx context.Context, crud *apiv1.CRUD, secret *core.Secret) error {
+	owner := string(secret.Data[apiv1.DatabaseUserKey])
+	current := string(secret.Data[apiv1.DatabaseAPIUserKey])
+
+	// alternate between two API roles so the previous one keeps working
+	// until every pod has moved to the new one
+	apiUser := owner + "_a"
+	if current == apiUser {
+		apiUser = owner + "_b"
+	}
+	apiPassword, err := randomString(passwordAlphabet, 0, passwordLength)
+	if err != nil {
+		return err
+	}
+	password, err := randomString(passwordAlphabet, 0, passwordLength)
+	if err != nil {
+		return err
+	}
+
+	patch := client.MergeFromWithOptions(secret.DeepCopy(), client.MergeFromWithOptimisticLock{})
+	secret.Data[pendingAPIUserKey] = []byte(apiUser)
+	secret.Data[pendingAPIPasswordKey] = []byte(apiPassword)
+	secret.Data[pendingPasswordKey] = []byte(password)
+	if err := r.Patch(ctx, secret, patch); err != nil {
+		return errors.Wrap(err, "could not store pending database credentials")
+	}
+	return nil
+}
+
+func (r *CRUDReconciler) applyPendingCredentials(ctx context.Context, logger logr.Logger, crud *apiv1.CRUD, secret *core.Secret) error {
+	admin, err := r.databaseAdmin(ctx, crud)
+	if err != nil {
+		return err
+	}
+	done, err := r.runJob(ctx, logger, admin, rotationJobName(crud), rotateCredentialsScript, append(databaseAdminEnv(admin),
+		admin.credentialEnv("NEW_API_USER", pendingAPIUserKey),
+		admin.credentialEnv("NEW_API_PASSWORD", pendingAPIPasswordKey),
+	))
+	if err != nil || !done {
+		return err
+	}
+
+	apiUser := string(secret.Data[pendingAPIUserKey])
+	apiPassword := string(secret.Data[pendingAPIPasswordKey])
+	database := string(secret.Data[apiv1.DatabaseNameKey])
+
+	patch := client.MergeFromWithOptions(secret.DeepCopy(), client.MergeFromWithOptimisticLock{})
+	previous := secret.Data[apiv1.DatabaseAPIUserKey]
+	if len(previous) == 0 {
+		previous = secret.Data[apiv1.DatabaseUserKey]
+	}
+	// the owner password changes with the retirement of the previous role
+	secret.Data[previousAPIUserKey] = previous
+	secret.Data[apiv1.DatabaseAPIUserKey] = []byte(apiUser)
+	secret.Data[apiv1.DatabaseURLKey] = []byte(crud.DatabaseURL(databaseAddress(crud, secret), apiUser, apiPassword, database))
+	delete(secret.Data, pendingAPIUserKey)
+	delete(secret.Data, pendingAPIPasswordKey)
+	if err := r.Patch(ctx, secret, patch); err != nil {
+		return errors.Wrap(err, "could not store rotated database credentials")
+	}
+
+	now := meta.Now()
+	crud.Status.Database.CredentialsRotationTime = &now
+	crud.Status.Database.RotationRequest = crud.Annotations[apiv1.RotateCredentialsAnnotation]
+	// the update of the secret triggers the rollout of the API
+	logger.Info("database credentials rotated", "apiUser", apiUser)
+	return nil
+}
+
+func (r *CRUDReconciler) retirePreviousCredentials(ctx context.Context, logger logr.Logger, crud *apiv1.CRUD, secret *core.Secret) error {
+	rolledOut, err := r.deploymentRolledOut(ctx, crud, credentialsHash(secret))
+	if err != nil || !rolledOut {
+		return err
+	}
+
+	password := pendingPasswordKey
+	if len(secret.Data[pendingPasswordKey]) == 0 {
+		// a rotation started before the owner password changed last
+		password = apiv1.DatabasePasswordKey
+	}
+	admin, err := r.databaseAdmin(ctx, crud)
+	if err != nil {
+		return err
+	}
+	done, err := r.runJob(ctx, logger, admin, retireJobName(crud), retireCredentialsScript, append(databaseAdminEnv(admin),
+		admin.credentialEnv("OLD_API_USER", previousAPIUserKey),
+		admin.credentialEnv("NEW_PASSWORD", password),
+	))
+	if err != nil || !done {
+		return err
+	}
+
+	patch := client.MergeFromWithOptions(secret.DeepCopy(), client.MergeFromWithOptimisticLock{})
+	secret.Data[apiv1.DatabasePasswordKey] = secret.Data[password]
+	delete(secret.Data, previousAPIUserKey)
+	delete(secret.Data, pendingPasswordKey)
+	delete(secret.Annotations, legacyCredentialsAnnotation)
+	if err := r.Patch(ctx, secret, patch); err != nil {
+		return errors.Wrap(err, "could not store the owner database password")
+	}
+	return nil
+}
+
+// deploymentRolledOut reports whether every pod of the API deployment runs
+// with the given credentials.
+func (r *CRUDReconciler) deploymentRolledOut(ctx context.Context, crud *apiv1.CRUD, hash string) (bool, error) {
+	key := key(crud)
+	key.Name = crud.DeploymentName()
+
+	deploy := &apps.Deployment{}
+	if err := r.Get(ctx, key, deploy); err != nil {
+		return false, errors.Wrap(err, "could not retrieve deployment")
+	}
+	if deploy.Spec.Template.Annotations[credentialsHashAnnotation] != hash ||
+		deploy.Status.ObservedGeneration < deploy.Generation {
+		return false, nil
+	}
+	replicas := int32(1)
+	if deploy.Spec.Replicas != nil {
+		replicas = *deploy.Spec.Replicas
+	}
+	return deploy.Status.UpdatedReplicas == replicas &&
+		deploy.Status.Replicas == replicas &&
+		deploy.Status.AvailableReplicas == replicas, nil
+}
+
+// runJob runs script where admin manages the database, with the postgres
+// client tools and the given libpq environment, and reports whether it has
+// completed. A completed job is deleted so that the same name can be used
+// again: the script runs once more if the caller fails to record its
+// outcome, so it must be idempotent.
+func (r *CRUDReconciler) runJob(ctx context.Context, logger logr.Logger, admin *databaseAdmin, name, script string, env []core.EnvVar) (bool, error) {
+	if admin.shared() {
+		if err := r.ensurePoolCredentials(ctx, admin); err != nil {
+			return false, err
+		}
+	}
+	job, err := r.ensureJob(ctx, logger, admin.crud, admin.namespace, admin.jobName(name), script, env)
+	if err != nil || job == nil {
+		return false, err
+	}
+
+	switch cond := jobFinished(job); {
+	case cond == nil:
+		return false, nil
+	case cond.Type == batch.JobComplete:
+		if err := r.deleteJob(ctx, job); err != nil {
+			return false, err
+		}
+		return true, nil
+	default:
+		logger.Info("database job failed, delete it to retry", "job", name, "reason", cond.Reason, "message", cond.Message)
+		return false, nil
+	}
+}
+
+// ensureDatabaseJob returns the job running script against the CRUD
+// database, or nil if it has just been created.
+func (r *CRUDReconciler) ensureDatabaseJob(ctx context.Context, logger logr.Logger, crud *apiv1.CRUD, name, script string, env []core.EnvVar) (*batch.Job, error) {
+	return r.ensureJob(ctx, logger, crud, crud.Namespace, name, script, append(databaseClientEnv(crud), env...))
+}
+
+// ensureJob returns the job of crud running script in namespace with the
+// postgres client tools and the given libpq environment, or nil if it has
+// just been created. The CRUD cannot own the jobs of other namespaces, they
+// are labeled with it instead.
+func (r *CRUDReconciler) ensureJob(ctx context.Context, logger logr.Logger, crud *apiv1.CRUD, namespace, name, script string, env []core.EnvVar) (*batch.Job, error) {
+	key := types.NamespacedName{Namespace: namespace, Name: name}
+
+	job := &batch.Job{}
+	switch err := r.Get(ctx, key, job); {
+	case apierrors.IsNotFound(err):
+		job = &batch.Job{
+			ObjectMeta: meta.ObjectMeta{
+				Name:      name,
+				Namespace: namespace,
+			},
+			Spec: batch.JobSpec{
+				BackoffLimit: pointer.Int32Ptr(6),
+				Template: core.PodTemplateSpec{
+					Spec: core.PodSpec{
+						RestartPolicy: core.RestartPolicyOnFailure,
+						Containers: []core.Container{
+							{
+								Name:    "psql",
+								Image:   crud.DatabaseImage(),
+								Command: []string{"sh", "-c", script},
+								Env:     env,
+							},
+						},
+					},
+				},
+			},
+		}
+		if namespace != crud.Namespace {
+			job.Labels = poolLabels(crud)
+		} else if err := controllerutil.SetControllerReference(crud, job, r.Scheme); err != nil {
+			return nil, errors.Wrapf(err, "could not set owner reference on job %s", name)
+		}
+		logger.Info("starting database job", "job", name, "namespace", namespace)
+		if err := r.Create(ctx, job); err != nil {
+			return nil, errors.Wrapf(err, "could not create job %s", name)
+		}
+		return nil, nil
+
+	case err != nil:
+		return nil, errors.Wrapf(err, "could not retrieve job %s", name)
+	}
+	return job, nil
+}
+
+// jobFinished returns the Complete or Failed condition of job, or nil while
+// it is running.
+func jobFinished(job *batch.Job) *batch.JobCondition {
+	for i := range job.Status.Conditions {
+		cond := &job.Status.Conditions[i]
+		if cond.Status == core.ConditionTrue && (cond.Type == batch.JobComplete || cond.Type == batch.JobFailed) {
+			return cond
+		}
+	}
+	return nil
+}
+
+func (r *CRUDReconciler) deleteJob(ctx context.Context, job *batch.Job) error {
+	if err := r.Delete(ctx, job, client.PropagationPolicy(meta.DeletePropagationBackground)); err != nil && !apierrors.IsNotFound(err) {
+		return errors.Wrapf(err, "could not delete job %s", job.Name)
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package controllers
+
+import (
+	"context"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	apps "k8s.io/api/apps/v1"
+	batch "k8s.io/api/batch/v1"
+	core "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	apiv1 "github.com/crudgen-org/crudgen-orchestrator/api/v1"
+)
+
+var _ = Describe("credentials rotation", func() {
+	var (
+		ctx    context.Context
+		logger logr.Logger
+		r      *CRUDReconciler
+		crud   *apiv1.CRUD
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		logger = logf.Log.WithName("test")
+		crud = newTestCRUD()
+		crud.SetDefaults()
+		crud.Annotations = map[string]string{apiv1.RotateCredentialsAnnotation: "1"}
+	})
+
+	setup := func(apiUser string) {
+		secret := &core.Secret{
+			ObjectMeta: meta.ObjectMeta{Namespace: crud.Namespace, Name: crud.DatabaseSecretName(), ResourceVersion: "1"},
+			Data: map[string][]byte{
+				apiv1.DatabaseUserKey:     []byte("uowner"),
+				apiv1.DatabasePasswordKey: []byte("owner-password"),
+				apiv1.DatabaseNameKey:     []byte("dbcrud"),
+				apiv1.DatabaseAPIUserKey:  []byte(apiUser),
+				apiv1.DatabaseURLKey:      []byte("psql://" + apiUser + "@db/dbcrud"),
+			},
+		}
+		deploy := &apps.Deployment{
+			ObjectMeta: meta.ObjectMeta{Namespace: crud.Namespace, Name: crud.DeploymentName()},
+			Spec:       apps.DeploymentSpec{Replicas: pointer.Int32Ptr(2)},
+		}
+		s := testScheme()
+		r = &CRUDReconciler{Client: fake.NewFakeClientWithScheme(s, secret, deploy), Scheme: s}
+	}
+
+	secret := func() *core.Secret {
+		secret := &core.Secret{}
+		secretKey := key(crud)
+		secretKey.Name = crud.DatabaseSecretName()
+		Expect(r.Get(ctx, secretKey, secret)).To(Succeed())
+		return secret
+	}
+
+	reconcile := func() {
+		_, err := r.reconcileCredentialsRotation(ctx, logger, crud)
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	jobKey := func(name string) meta.Object {
+		return &batch.Job{ObjectMeta: meta.ObjectMeta{Namespace: crud.Namespace, Name: name}}
+	}
+
+	job := func(name string) *batch.Job {
+		job := &batch.Job{}
+		Expect(r.Get(ctx, key(jobKey(name)), job)).To(Succeed())
+		return job
+	}
+
+	jobExists := func(name string) bool {
+		err := r.Get(ctx, key(jobKey(name)), &batch.Job{})
+		Expect(err == nil || apierrors.IsNotFound(err)).To(BeTrue())
+		return err == nil
+	}
+
+	complete := func(name string) {
+		j := job(name)
+		j.Status.Conditions = []batch.JobCondition{{Type: batch.JobComplete, Status: core.ConditionTrue}}
+		Expect(r.Update(ctx, j)).To(Succeed())
+	}
+
+	// rollOut fakes the rollout of the API with the current credentials
+	rollOut := func() {
+		deploy := &apps.Deployment{}
+		Expect(r.Get(ctx, key(&apps.Deployment{ObjectMeta: meta.ObjectMeta{Namespace: crud.Namespace, Name: crud.DeploymentName()}}), deploy)).To(Succeed())
+		deploy.Spec.Template.Annotations = map[string]string{credentialsHashAnnotation: credentialsHash(secret())}
+		deploy.Status = apps.DeploymentStatus{Replicas: 2, UpdatedReplicas: 2, AvailableReplicas: 2}
+		Expect(r.Update(ctx, deploy)).To(Succeed())
+	}
+
+	envKeys := func(job *batch.Job) map[string]string {
+		keys := map[string]string{}
+		for _, env := range job.Spec.Template.Spec.Containers[0].Env {
+			if env.ValueFrom != nil && env.ValueFrom.SecretKeyRef != nil {
+				keys[env.Name] = env.ValueFrom.SecretKeyRef.Key
+			}
+		}
+		return keys
+	}
+
+	It("moves the API off the owner before changing its password", func() {
+		setup("uowner")
+		reconcile()
+		Expect(secret().Data).To(HaveKeyWithValue(pendingAPIUserKey, []byte("uowner_a")))
+		pending := secret().Data[pendingPasswordKey]
+		Expect(pending).NotTo(BeEmpty())
+
+		reconcile()
+		rotation := job(rotationJobName(crud))
+		Expect(rotation.Spec.Template.Spec.Containers[0].Command[2]).NotTo(ContainSubstring(`ALTER ROLE :"owner"`))
+		Expect(envKeys(rotation)).NotTo(HaveKey("NEW_PASSWORD"))
+		complete(rotationJobName(crud))
+
+		reconcile()
+		data := secret().Data
+		Expect(data).To(HaveKeyWithValue(apiv1.DatabaseAPIUserKey, []byte("uowner_a")))
+		Expect(string(data[apiv1.DatabaseURLKey])).To(ContainSubstring("://uowner_a:"))
+		Expect(data).To(HaveKeyWithValue(apiv1.DatabasePasswordKey, []byte("owner-password")))
+		Expect(data).To(HaveKeyWithValue(previousAPIUserKey, []byte("uowner")))
+		Expect(data).NotTo(HaveKey(pendingAPIUserKey))
+		Expect(crud.Status.Database.RotationRequest).To(Equal("1"))
+		Expect(crud.Status.Database.CredentialsRotationTime).NotTo(BeNil())
+
+		// the pods still connect as the owner
+		reconcile()
+		Expect(jobExists(retireJobName(crud))).To(BeFalse())
+
+		rollOut()
+		reconcile()
+		Expect(envKeys(job(retireJobName(crud)))).To(HaveKeyWithValue("NEW_PASSWORD", pendingPasswordKey))
+		complete(retireJobName(crud))
+
+		reconcile()
+		data = secret().Data
+		Expect(data).To(HaveKeyWithValue(apiv1.DatabasePasswordKey, pending))
+		Expect(data).NotTo(HaveKey(previousAPIUserKey))
+		Expect(data).NotTo(HaveKey(pendingPasswordKey))
+
+		// until the next request
+		reconcile()
+		Expect(secret().Data).NotTo(HaveKey(pendingAPIUserKey))
+	})
+
+	It("alternates between the two API roles", func() {
+		setup("uowner_a")
+		reconcile()
+		Expect(secret().Data).To(HaveKeyWithValue(pendingAPIUserKey, []byte("uowner_b")))
+
+		reconcile()
+		complete(rotationJobName(crud))
+		reconcile()
+		Expect(secret().Data).To(HaveKeyWithValue(previousAPIUserKey, []byte("uowner_a")))
+	})
+
+	It("runs the jobs again when their outcome was not recorded", func() {
+		setup("uowner")
+		reconcile()
+		reconcile()
+		complete(rotationJobName(crud))
+		// the job is deleted, then the update of the secret is lost
+		Expect(r.Delete(ctx, job(rotationJobName(crud)))).To(Succeed())
+
+		reconcile()
+		Expect(secret().Data).To(HaveKey(pendingAPIUserKey))
+		Expect(job(rotationJobName(crud)).Spec.Template.Spec.Containers[0].Command[2]).To(ContainSubstring("WHERE NOT EXISTS"))
+		complete(rotationJobName(crud))
+		reconcile()
+		Expect(secret().Data).To(HaveKeyWithValue(apiv1.DatabaseAPIUserKey, []byte("uowner_a")))
+
+		rollOut()
+		reconcile()
+		complete(retireJobName(crud))
+		Expect(r.Delete(ctx, job(retireJobName(crud)))).To(Succeed())
+
+		// the owner password may have been changed by the lost run
+		reconcile()
+		Expect(job(retireJobName(crud)).Spec.Template.Spec.Containers[0].Command[2]).To(ContainSubstring(`export PGPASSWORD="$NEW_PASSWORD"`))
+	})
+})
@@ -0,0 +1,81 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	core "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	apiv1 "github.com/crudgen-org/crudgen-orchestrator/api/v1"
+)
+
+// resizeDatabaseVolumes expands the volumes of the database when the
+// requested size grows. The volume claim templates of the statefulset cannot
+// change, so the claims are patched directly; the storage class must allow
+// volume expansion. A smaller size is refused and reported in the
+// StorageReady condition. The volumes kept to roll back an upgrade are left
+// as they are.
+func (r *CRUDReconciler) resizeDatabaseVolumes(ctx context.Context, logger logr.Logger, crud *apiv1.CRUD) error {
+	pvcs, err := r.listDatabaseVolumes(ctx, crud)
+	if err != nil {
+		return err
+	}
+	requested := *crud.Spec.Database.Storage.Size
+
+	var volumes int
+	var shrunk, failed, resizing []string
+	for i := range pvcs.Items {
+		pvc := &pvcs.Items[i]
+		if !claimedBy(crud, crud.DatabaseVolumeClaimName(), pvc) {
+			// the volumes kept to roll back an upgrade
+			continue
+		}
+		volumes++
+		current := pvc.Spec.Resources.Requests[core.ResourceStorage]
+		switch requested.Cmp(current) {
+		case -1:
+			shrunk = append(shrunk, fmt.Sprintf("%s is %s", pvc.Name, current.String()))
+			continue
+		case 1:
+			logger.Info("expanding database volume", "pvc", pvc.Name, "from", current.String(), "to", requested.String())
+			patch := client.MergeFrom(pvc.DeepCopy())
+			pvc.Spec.Resources.Requests[core.ResourceStorage] = requested
+			switch err := r.Patch(ctx, pvc, patch); {
+			case apierrors.IsInvalid(err) || apierrors.IsForbidden(err):
+				// typically a storage class without volume expansion
+				failed = append(failed, err.Error())
+				logger.Error(err, "could not expand database volume", "pvc", pvc.Name)
+				continue
+			case err != nil:
+				return errors.Wrap(err, "could not expand database volume")
+			}
+		}
+		if capacity := pvc.Status.Capacity[core.ResourceStorage]; capacity.Cmp(requested) < 0 {
+			resizing = append(resizing, fmt.Sprintf("%s has %s", pvc.Name, capacity.String()))
+		}
+	}
+
+	var cond apiv1.Condition
+	switch {
+	case len(shrunk) > 0:
+		cond = newCondition(apiv1.ConditionStorageReady, false, "ShrinkRejected",
+			fmt.Sprintf("volumes cannot shrink to %s: %s", requested.String(), strings.Join(shrunk, ", ")))
+	case len(failed) > 0:
+		cond = newCondition(apiv1.ConditionStorageReady, false, "ExpansionFailed",
+			fmt.Sprintf("could not expand volumes to %s: %s", requested.String(), strings.Join(failed, ", ")))
+	case len(resizing) > 0:
+		cond = newCondition(apiv1.ConditionStorageReady, false, "Expanding",
+			fmt.Sprintf("expanding volumes to %s: %s", requested.String(), strings.Join(resizing, ", ")))
+	default:
+		cond = newCondition(apiv1.ConditionStorageReady, true, "VolumesReady",
+			fmt.Sprintf("%d database volumes of %s", volumes, requested.String()))
+	}
+	cond.ObservedGeneration = crud.Generation
+	crud.Status.SetCondition(cond)
+	return nil
+}
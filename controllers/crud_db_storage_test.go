@@ -0,0 +1,114 @@
+package controllers
+
+import (
+	"context"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	apps "k8s.io/api/apps/v1"
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	apiv1 "github.com/crudgen-org/crudgen-orchestrator/api/v1"
+)
+
+var _ = Describe("database storage", func() {
+	var (
+		ctx    context.Context
+		logger logr.Logger
+		r      *CRUDReconciler
+		crud   *apiv1.CRUD
+		pvc    *core.PersistentVolumeClaim
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		logger = logf.Log.WithName("test")
+		crud = newTestCRUD()
+		crud.SetDefaults()
+
+		size := resource.MustParse("3G")
+		pvc = &core.PersistentVolumeClaim{
+			ObjectMeta: meta.ObjectMeta{
+				Namespace: crud.Namespace,
+				Name:      "ordb-" + crud.DatabaseStatefulName() + "-0",
+				Labels:    crud.DatabaseLabel(),
+			},
+			Spec: core.PersistentVolumeClaimSpec{
+				Resources: core.ResourceRequirements{
+					Requests: core.ResourceList{core.ResourceStorage: size},
+				},
+			},
+			Status: core.PersistentVolumeClaimStatus{
+				Capacity: core.ResourceList{core.ResourceStorage: size},
+			},
+		}
+		s := testScheme()
+		r = &CRUDReconciler{Client: fake.NewFakeClientWithScheme(s, pvc), Scheme: s, DefaultStorageClass: "standard"}
+	})
+
+	resize := func(size string) *apiv1.Condition {
+		quantity := resource.MustParse(size)
+		crud.Spec.Database.Storage.Size = &quantity
+		Expect(r.resizeDatabaseVolumes(ctx, logger, crud)).To(Succeed())
+		Expect(r.Get(ctx, key(pvc), pvc)).To(Succeed())
+		return crud.Status.GetCondition(apiv1.ConditionStorageReady)
+	}
+
+	It("claims the volume in the configured class", func() {
+		Expect(*r.databaseVolumeClaims(crud)[0].Spec.StorageClassName).To(Equal("standard"))
+
+		crud.Spec.Database.Storage.StorageClassName = pointer.StringPtr("hiops")
+		Expect(*r.databaseVolumeClaims(crud)[0].Spec.StorageClassName).To(Equal("hiops"))
+
+		r.DefaultStorageClass = ""
+		crud.Spec.Database.Storage.StorageClassName = nil
+		Expect(r.databaseVolumeClaims(crud)[0].Spec.StorageClassName).To(BeNil())
+	})
+
+	It("mounts the volume where postgres stores its data", func() {
+		r.Client = &applyClient{r.Client}
+		Expect(r.ensureDatabseStatefulset(ctx, logger, crud)).To(Succeed())
+		sts := &apps.StatefulSet{}
+		stsKey := key(crud)
+		stsKey.Name = crud.DatabaseStatefulName()
+		Expect(r.Get(ctx, stsKey, sts)).To(Succeed())
+
+		pg := sts.Spec.Template.Spec.Containers[0]
+		Expect(pg.Env).To(ContainElement(core.EnvVar{Name: "PGDATA", Value: "/var/lib/postgresql/data"}))
+		Expect(pg.VolumeMounts).To(ContainElement(core.VolumeMount{
+			Name:      crud.DatabaseVolumeClaimName(),
+			MountPath: "/var/lib/postgresql/data",
+			SubPath:   "Postgres",
+		}))
+		Expect(sts.Spec.VolumeClaimTemplates[0].Name).To(Equal(crud.DatabaseVolumeClaimName()))
+	})
+
+	It("expands the volume when the size grows", func() {
+		cond := resize("3G")
+		Expect(cond.Status).To(Equal(core.ConditionTrue))
+
+		cond = resize("5G")
+		Expect(pvc.Spec.Resources.Requests.Storage().String()).To(Equal("5G"))
+		Expect(cond.Status).To(Equal(core.ConditionFalse))
+		Expect(cond.Reason).To(Equal("Expanding"))
+
+		pvc.Status.Capacity[core.ResourceStorage] = resource.MustParse("5G")
+		Expect(r.Status().Update(ctx, pvc)).To(Succeed())
+		cond = resize("5G")
+		Expect(cond.Status).To(Equal(core.ConditionTrue))
+	})
+
+	It("refuses to shrink the volume", func() {
+		cond := resize("1G")
+		Expect(cond.Status).To(Equal(core.ConditionFalse))
+		Expect(cond.Reason).To(Equal("ShrinkRejected"))
+		Expect(cond.Message).To(ContainSubstring("is 3G"))
+		Expect(pvc.Spec.Resources.Requests.Storage().String()).To(Equal("3G"))
+	})
+})
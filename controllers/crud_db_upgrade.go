@@ -0,0 +1,398 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	apps "k8s.io/api/apps/v1"
+	batch "k8s.io/api/batch/v1"
+	core "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	apiv1 "github.com/crudgen-org/crudgen-orchestrator/api/v1"
+)
+
+// upgradeDumpScript dumps the roles, passwords included, and the database
+// of the previous version with the client tools of the new one.
+const upgradeDumpScript = `set -e
+pg_dumpall --globals-only --file=/upgrade/globals.sql
+pg_dump --format=custom --file=/upgrade/database.dump`
+
+// upgradeRestoreScript restores the dump into the new version. initdb has
+// created the owner role already, so errors on the roles are not fatal.
+const upgradeRestoreScript = `set -e
+psql --dbname=postgres --file=/upgrade/globals.sql
+pg_restore --clean --if-exists --single-transaction --exit-on-error --dbname="$PGDATABASE" /upgrade/database.dump`
+
+// legacyDatabaseVersion is the version of the statefulsets created before
+// the version could be set.
+const legacyDatabaseVersion = "13"
+
+func upgradeVolumeName(crud *apiv1.CRUD) string {
+	return fmt.Sprintf("%s-upgrade", crud.Name)
+}
+
+func upgradeDumpJobName(crud *apiv1.CRUD) string {
+	return fmt.Sprintf("%s-upgrade-dump", crud.Name)
+}
+
+func upgradeRestoreJobName(crud *apiv1.CRUD) string {
+	return fmt.Sprintf("%s-upgrade-restore", crud.Name)
+}
+
+func setUpgradingCondition(crud *apiv1.CRUD, cond apiv1.Condition) {
+	cond.ObservedGeneration = crud.Generation
+	crud.Status.SetCondition(cond)
+}
+
+// reconcileDatabaseUpgrade moves an in-cluster database to the version of
+// the spec and reports whether the API has to stay scaled down meanwhile.
+// Minor versions roll the statefulset in place; a new major version is
+// dumped from the previous one and restored into new volumes, the previous
+// volumes being kept to roll back to. No upgrade starts during a restore.
+func (r *CRUDReconciler) reconcileDatabaseUpgrade(ctx context.Context, logger logr.Logger, crud *apiv1.CRUD, restoring bool) (bool, error) {
+	if !crud.InCluster() {
+		return false, nil
+	}
+	status := &crud.Status.Database
+	if status.Version == "" {
+		version, err := r.runningDatabaseVersion(ctx, crud)
+		if err != nil {
+			return false, err
+		}
+		status.Version = version
+	}
+	if !status.Upgrade.Running() && !restoring {
+		if err := r.startDatabaseUpgrade(ctx, logger, crud); err != nil {
+			return false, err
+		}
+	}
+
+	upgrade := status.Upgrade
+	if !upgrade.Running() {
+		if crud.Status.IsConditionTrue(apiv1.ConditionUpgrading) {
+			// the HPA does not scale a deployment with no replicas
+			if err := r.scaleDeployment(ctx, crud, *crud.Spec.Autoscaling.MinReplicas); err != nil {
+				return false, err
+			}
+		}
+		switch version := crud.Spec.Database.Version; {
+		case apiv1.MajorVersion(version) < apiv1.MajorVersion(status.Version):
+			setUpgradingCondition(crud, newCondition(apiv1.ConditionUpgrading, false, "DowngradeRejected",
+				fmt.Sprintf("the database cannot be downgraded from %s to %s", status.Version, version)))
+		case upgrade != nil:
+			setUpgradingCondition(crud, newCondition(apiv1.ConditionUpgrading, false, "Upgrade"+string(upgrade.Phase), upgrade.Message))
+		}
+		return false, nil
+	}
+
+	setUpgradingCondition(crud, newCondition(apiv1.ConditionUpgrading, true, "Upgrade"+string(upgrade.Phase), upgrade.Message))
+	if err := r.scaleDownAPI(ctx, crud); err != nil {
+		return false, err
+	}
+	switch upgrade.Phase {
+	case apiv1.DatabaseUpgradeDumping:
+		return true, r.dumpForUpgrade(ctx, logger, crud)
+	default:
+		return true, r.restoreForUpgrade(ctx, logger, crud)
+	}
+}
+
+// runningDatabaseVersion is the version the statefulset was created with,
+// read from the image of its postgres container. Statefulsets created
+// before the version was recorded ran postgres:13; a new database runs the
+// version of the spec.
+func (r *CRUDReconciler) runningDatabaseVersion(ctx context.Context, crud *apiv1.CRUD) (string, error) {
+	key := key(crud)
+	key.Name = crud.DatabaseStatefulName()
+	sts := &apps.StatefulSet{}
+	switch err := r.Get(ctx, key, sts); {
+	case apierrors.IsNotFound(err):
+		return crud.Spec.Database.Version, nil
+	case err != nil:
+		return "", errors.Wrap(err, "could not retrieve statefulset")
+	}
+	for _, container := range sts.Spec.Template.Spec.Containers {
+		if container.Name != "pg" {
+			continue
+		}
+		i := strings.LastIndex(container.Image, ":")
+		if i >= 0 && !strings.Contains(container.Image, "@") && apiv1.MajorVersion(container.Image[i+1:]) >= 0 {
+			return container.Image[i+1:], nil
+		}
+	}
+	return legacyDatabaseVersion, nil
+}
+
+// startDatabaseUpgrade compares the version of the spec with the one the
+// database runs, and starts an upgrade or a rollback when the major
+// versions differ. A failed upgrade is not retried until the version
+// changes.
+func (r *CRUDReconciler) startDatabaseUpgrade(ctx context.Context, logger logr.Logger, crud *apiv1.CRUD) error {
+	status := &crud.Status.Database
+	upgrade := status.Upgrade
+	version := crud.Spec.Database.Version
+
+	switch from, to := apiv1.MajorVersion(status.Version), apiv1.MajorVersion(version); {
+	case from == to:
+		// same data format, the statefulset rolls to the new image
+		status.Version = version
+
+	case upgrade != nil && upgrade.Phase == apiv1.DatabaseUpgradeFailed && upgrade.To == version:
+
+	case upgrade != nil && upgrade.Phase == apiv1.DatabaseUpgradeSucceeded && upgrade.From == version:
+		logger.Info("rolling back database upgrade", "from", upgrade.To, "to", upgrade.From)
+		upgraded := crud.DatabaseVolumeClaimName()
+		status.Version = upgrade.From
+		status.VolumeClaim = upgrade.RollbackVolumeClaim
+		status.Primary = ""
+		upgrade.RollbackVolumeClaim = ""
+		upgrade.Phase = apiv1.DatabaseUpgradeRolledBack
+		upgrade.Message = fmt.Sprintf("rolled back to the volumes of %s, changes made on %s are lost", upgrade.From, upgrade.To)
+		return r.deleteVolumes(ctx, logger, crud, upgraded)
+
+	case to < from:
+		// reported in the Upgrading condition
+
+	default:
+		if upgrade != nil && upgrade.RollbackVolumeClaim != "" {
+			// the rollback point of the previous upgrade
+			if err := r.deleteVolumes(ctx, logger, crud, upgrade.RollbackVolumeClaim); err != nil {
+				return err
+			}
+		}
+		logger.Info("upgrading database", "from", status.Version, "to", version)
+		now := meta.Now()
+		status.Upgrade = &apiv1.DatabaseUpgradeStatus{
+			From:      status.Version,
+			To:        version,
+			Phase:     apiv1.DatabaseUpgradeDumping,
+			Message:   fmt.Sprintf("dumping the database of %s to upgrade it to %s", status.Version, version),
+			StartTime: &now,
+		}
+	}
+	return nil
+}
+
+// dumpForUpgrade dumps the database once the API is down, then switches the
+// statefulset to new volumes and the new version.
+func (r *CRUDReconciler) dumpForUpgrade(ctx context.Context, logger logr.Logger, crud *apiv1.CRUD) error {
+	key := key(crud)
+	key.Name = crud.DeploymentName()
+	deploy := &apps.Deployment{}
+	switch err := r.Get(ctx, key, deploy); {
+	case apierrors.IsNotFound(err):
+	case err != nil:
+		return errors.Wrap(err, "could not retrieve deployment")
+	case deploy.Status.Replicas != 0:
+		// writes made after the dump would be lost
+		return nil
+	}
+	if err := r.ensureUpgradeVolume(ctx, crud); err != nil {
+		return err
+	}
+
+	cond, err := r.runUpgradeJob(ctx, logger, crud, upgradeDumpJobName(crud), upgradeDumpScript)
+	if err != nil || cond == nil {
+		return err
+	}
+	status := &crud.Status.Database
+	upgrade := status.Upgrade
+	if cond.Type == batch.JobFailed {
+		logger.Info("database dump failed, the database stays on "+upgrade.From, "reason", cond.Reason, "message", cond.Message)
+		now := meta.Now()
+		upgrade.Phase = apiv1.DatabaseUpgradeFailed
+		upgrade.Message = fmt.Sprintf("dumping the database of %s failed: %s", upgrade.From, cond.Message)
+		upgrade.CompletionTime = &now
+		return nil
+	}
+
+	upgrade.RollbackVolumeClaim = crud.DatabaseVolumeClaimName()
+	status.VolumeClaim = fmt.Sprintf("ordb-%d", apiv1.MajorVersion(upgrade.To))
+	status.Version = upgrade.To
+	status.Primary = ""
+	upgrade.Phase = apiv1.DatabaseUpgradeRestoring
+	upgrade.Message = fmt.Sprintf("restoring the database into %s", upgrade.To)
+	return nil
+}
+
+// restoreForUpgrade restores the dump once the new version is up. When the
+// restore fails, the statefulset goes back to the previous volumes.
+func (r *CRUDReconciler) restoreForUpgrade(ctx context.Context, logger logr.Logger, crud *apiv1.CRUD) error {
+	ready, err := r.upgradedPrimaryReady(ctx, crud)
+	if err != nil || !ready {
+		return err
+	}
+	cond, err := r.runUpgradeJob(ctx, logger, crud, upgradeRestoreJobName(crud), upgradeRestoreScript)
+	if err != nil || cond == nil {
+		return err
+	}
+
+	status := &crud.Status.Database
+	upgrade := status.Upgrade
+	now := meta.Now()
+	upgrade.CompletionTime = &now
+	if cond.Type == batch.JobComplete {
+		logger.Info("database upgraded", "from", upgrade.From, "to", upgrade.To)
+		upgrade.Phase = apiv1.DatabaseUpgradeSucceeded
+		upgrade.Message = fmt.Sprintf("upgraded from %s to %s, set the version back to %s to roll back", upgrade.From, upgrade.To, upgrade.From)
+		return nil
+	}
+
+	logger.Info("database restore failed, rolling back to "+upgrade.From, "reason", cond.Reason, "message", cond.Message)
+	upgraded := crud.DatabaseVolumeClaimName()
+	status.Version = upgrade.From
+	status.VolumeClaim = upgrade.RollbackVolumeClaim
+	status.Primary = ""
+	upgrade.RollbackVolumeClaim = ""
+	upgrade.Phase = apiv1.DatabaseUpgradeFailed
+	upgrade.Message = fmt.Sprintf("restoring the database into %s failed, rolled back to %s: %s", upgrade.To, upgrade.From, cond.Message)
+	return r.deleteVolumes(ctx, logger, crud, upgraded)
+}
+
+// upgradedPrimaryReady reports whether the primary runs the new version. The
+// pods of the previous statefulset may still be terminating.
+func (r *CRUDReconciler) upgradedPrimaryReady(ctx context.Context, crud *apiv1.CRUD) (bool, error) {
+	if crud.Status.Database.Primary == "" {
+		return false, nil
+	}
+	key := key(crud)
+	key.Name = crud.Status.Database.Primary
+	pod := &core.Pod{}
+	switch err := r.PodReader.Get(ctx, key, pod); {
+	case apierrors.IsNotFound(err):
+		return false, nil
+	case err != nil:
+		return false, errors.Wrap(err, "could not retrieve database primary")
+	}
+	ready, _ := podReady(pod)
+	return ready && pod.DeletionTimestamp == nil && len(pod.Spec.Containers) > 0 &&
+		pod.Spec.Containers[0].Image == crud.DatabaseServerImage() &&
+		pod.Labels[apiv1.DatabaseRoleLabel] == apiv1.DatabaseRolePrimary, nil
+}
+
+// ensureUpgradeVolume creates the volume the dump is written to. It is kept
+// with the previous volumes, and reused by the next upgrade.
+func (r *CRUDReconciler) ensureUpgradeVolume(ctx context.Context, crud *apiv1.CRUD) error {
+	key := key(crud)
+	key.Name = upgradeVolumeName(crud)
+	switch err := r.Get(ctx, key, &core.PersistentVolumeClaim{}); {
+	case err == nil:
+		return nil
+	case !apierrors.IsNotFound(err):
+		return errors.Wrap(err, "could not retrieve upgrade volume")
+	}
+
+	// the same class and size as the database volumes
+	pvc := &r.databaseVolumeClaims(crud)[0]
+	pvc.Name = key.Name
+	pvc.Namespace = crud.Namespace
+	if err := controllerutil.SetControllerReference(crud, pvc, r.Scheme); err != nil {
+		return errors.Wrap(err, "could not set owner reference on upgrade volume")
+	}
+	if err := r.Create(ctx, pvc); err != nil {
+		return errors.Wrap(err, "could not create upgrade volume")
+	}
+	return nil
+}
+
+// runUpgradeJob runs script against the database with the upgrade volume
+// mounted, and returns its Complete or Failed condition once it has
+// finished. A finished job is deleted so that the next upgrade can run it
+// again.
+func (r *CRUDReconciler) runUpgradeJob(ctx context.Context, logger logr.Logger, crud *apiv1.CRUD, name, script string) (*batch.JobCondition, error) {
+	key := key(crud)
+	key.Name = name
+
+	job := &batch.Job{}
+	switch err := r.Get(ctx, key, job); {
+	case apierrors.IsNotFound(err):
+		job = &batch.Job{
+			ObjectMeta: meta.ObjectMeta{
+				Name:      name,
+				Namespace: crud.Namespace,
+			},
+			Spec: batch.JobSpec{
+				BackoffLimit: pointer.Int32Ptr(3),
+				Template: core.PodTemplateSpec{
+					Spec: core.PodSpec{
+						RestartPolicy: core.RestartPolicyOnFailure,
+						Containers: []core.Container{
+							{
+								Name:    "psql",
+								Image:   crud.DatabaseImage(),
+								Command: []string{"sh", "-c", script},
+								Env:     databaseClientEnv(crud),
+								VolumeMounts: []core.VolumeMount{
+									{
+										Name:      "upgrade",
+										MountPath: "/upgrade",
+									},
+								},
+							},
+						},
+						Volumes: []core.Volume{
+							{
+								Name: "upgrade",
+								VolumeSource: core.VolumeSource{
+									PersistentVolumeClaim: &core.PersistentVolumeClaimVolumeSource{
+										ClaimName: upgradeVolumeName(crud),
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		}
+		if err := controllerutil.SetControllerReference(crud, job, r.Scheme); err != nil {
+			return nil, errors.Wrapf(err, "could not set owner reference on job %s", name)
+		}
+		logger.Info("starting database upgrade job", "job", name)
+		if err := r.Create(ctx, job); err != nil {
+			return nil, errors.Wrapf(err, "could not create job %s", name)
+		}
+		return nil, nil
+
+	case err != nil:
+		return nil, errors.Wrapf(err, "could not retrieve job %s", name)
+	}
+
+	cond := jobFinished(job)
+	if cond == nil {
+		return nil, nil
+	}
+	return cond, r.deleteJob(ctx, job)
+}
+
+// deleteVolumes deletes the database volumes of the claim template claim.
+func (r *CRUDReconciler) deleteVolumes(ctx context.Context, logger logr.Logger, crud *apiv1.CRUD, claim string) error {
+	pvcs, err := r.listDatabaseVolumes(ctx, crud)
+	if err != nil {
+		return err
+	}
+	for i := range pvcs.Items {
+		pvc := &pvcs.Items[i]
+		if !claimedBy(crud, claim, pvc) {
+			continue
+		}
+		logger.Info("deleting database volume", "pvc", pvc.Name)
+		if err := r.Delete(ctx, pvc); err != nil && !apierrors.IsNotFound(err) {
+			return errors.Wrap(err, "could not delete database volume")
+		}
+	}
+	return nil
+}
+
+// claimedBy reports whether the statefulset created pvc from the claim
+// template claim.
+func claimedBy(crud *apiv1.CRUD, claim string, pvc *core.PersistentVolumeClaim) bool {
+	ordinal := strings.TrimPrefix(pvc.Name, claim+"-"+crud.DatabaseStatefulName()+"-")
+	return ordinal != pvc.Name && podOrdinal(crud, crud.DatabaseStatefulName()+"-"+ordinal) >= 0
+}
@@ -0,0 +1,226 @@
+package controllers
+
+import (
+	"context"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	apps "k8s.io/api/apps/v1"
+	batch "k8s.io/api/batch/v1"
+	core "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	apiv1 "github.com/crudgen-org/crudgen-orchestrator/api/v1"
+)
+
+var _ = Describe("database upgrade", func() {
+	var (
+		ctx    context.Context
+		logger logr.Logger
+		r      *CRUDReconciler
+		crud   *apiv1.CRUD
+		deploy *apps.Deployment
+	)
+
+	volume := func(claim string) *core.PersistentVolumeClaim {
+		return &core.PersistentVolumeClaim{
+			ObjectMeta: meta.ObjectMeta{
+				Namespace: crud.Namespace,
+				Name:      claim + "-" + crud.DatabaseStatefulName() + "-0",
+				Labels:    crud.DatabaseLabel(),
+			},
+		}
+	}
+
+	volumeExists := func(claim string) bool {
+		err := r.Get(ctx, key(volume(claim)), &core.PersistentVolumeClaim{})
+		if apierrors.IsNotFound(err) {
+			return false
+		}
+		Expect(err).NotTo(HaveOccurred())
+		return true
+	}
+
+	reconcile := func() bool {
+		upgrading, err := r.reconcileDatabaseUpgrade(ctx, logger, crud, false)
+		Expect(err).NotTo(HaveOccurred())
+		return upgrading
+	}
+
+	// finish completes, or fails, the upgrade job name
+	finish := func(name string, condition batch.JobConditionType) {
+		job := &batch.Job{}
+		Expect(r.Get(ctx, key(&batch.Job{ObjectMeta: meta.ObjectMeta{Namespace: crud.Namespace, Name: name}}), job)).To(Succeed())
+		job.Status.Conditions = []batch.JobCondition{{Type: condition, Status: core.ConditionTrue}}
+		Expect(r.Update(ctx, job)).To(Succeed())
+	}
+
+	// startPrimary fakes the first pod of the recreated statefulset
+	startPrimary := func() {
+		crud.Status.Database.Primary = crud.DatabaseStatefulName() + "-0"
+		Expect(r.Create(ctx, &core.Pod{
+			ObjectMeta: meta.ObjectMeta{
+				Namespace: crud.Namespace,
+				Name:      crud.Status.Database.Primary,
+				Labels:    crud.DatabaseRoleLabels(apiv1.DatabaseRolePrimary),
+			},
+			Spec: core.PodSpec{
+				Containers: []core.Container{{Name: "pg", Image: crud.DatabaseServerImage()}},
+			},
+			Status: core.PodStatus{
+				Conditions: []core.PodCondition{{Type: core.PodReady, Status: core.ConditionTrue}},
+			},
+		})).To(Succeed())
+	}
+
+	// dump walks the upgrade to 13 through the dump
+	dump := func() {
+		Expect(reconcile()).To(BeTrue())
+		Expect(crud.Status.Database.Upgrade.Phase).To(Equal(apiv1.DatabaseUpgradeDumping))
+		Expect(crud.Status.IsConditionTrue(apiv1.ConditionUpgrading)).To(BeTrue())
+		Expect(r.Get(ctx, key(deploy), deploy)).To(Succeed())
+		Expect(*deploy.Spec.Replicas).To(BeZero())
+
+		// no dump while the API pods are terminating
+		Expect(reconcile()).To(BeTrue())
+		Expect(r.Get(ctx, key(&batch.Job{ObjectMeta: meta.ObjectMeta{Namespace: crud.Namespace, Name: upgradeDumpJobName(crud)}}), &batch.Job{})).NotTo(Succeed())
+		deploy.Status.Replicas = 0
+		Expect(r.Update(ctx, deploy)).To(Succeed())
+
+		Expect(reconcile()).To(BeTrue())
+		Expect(r.Get(ctx, key(&core.PersistentVolumeClaim{ObjectMeta: meta.ObjectMeta{Namespace: crud.Namespace, Name: upgradeVolumeName(crud)}}), &core.PersistentVolumeClaim{})).To(Succeed())
+		finish(upgradeDumpJobName(crud), batch.JobComplete)
+
+		Expect(reconcile()).To(BeTrue())
+		Expect(crud.Status.Database.Upgrade.Phase).To(Equal(apiv1.DatabaseUpgradeRestoring))
+		Expect(crud.Status.Database.Upgrade.RollbackVolumeClaim).To(Equal("ordb"))
+		Expect(crud.Status.Database.Version).To(Equal("13"))
+		Expect(crud.DatabaseVolumeClaimName()).To(Equal("ordb-13"))
+		Expect(crud.DatabaseServerImage()).To(Equal("postgres:13"))
+
+		// the statefulset is being recreated on the new volumes
+		Expect(reconcile()).To(BeTrue())
+		startPrimary()
+		Expect(r.Create(ctx, volume("ordb-13"))).To(Succeed())
+		Expect(reconcile()).To(BeTrue())
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		logger = logf.Log.WithName("test")
+		crud = newTestCRUD()
+		crud.Spec.Database.Version = "13"
+		crud.SetDefaults()
+		crud.Status.Database.Version = "12"
+
+		deploy = &apps.Deployment{
+			ObjectMeta: meta.ObjectMeta{Namespace: crud.Namespace, Name: crud.DeploymentName()},
+			Spec:       apps.DeploymentSpec{Replicas: pointer.Int32Ptr(2)},
+			Status:     apps.DeploymentStatus{Replicas: 2},
+		}
+		s := testScheme()
+		c := fake.NewFakeClientWithScheme(s, deploy.DeepCopy(), volume("ordb"))
+		r = &CRUDReconciler{Client: c, PodReader: c, Scheme: s}
+	})
+
+	It("rolls minor versions in place", func() {
+		crud.Spec.Database.Version = "12.6"
+		Expect(reconcile()).To(BeFalse())
+		Expect(crud.Status.Database.Upgrade).To(BeNil())
+		Expect(crud.DatabaseServerImage()).To(Equal("postgres:12.6"))
+		Expect(crud.DatabaseVolumeClaimName()).To(Equal("ordb"))
+	})
+
+	It("dumps and restores the database into new volumes", func() {
+		dump()
+		finish(upgradeRestoreJobName(crud), batch.JobComplete)
+		Expect(reconcile()).To(BeTrue())
+
+		// the API scales back up once the upgrade has finished
+		Expect(reconcile()).To(BeFalse())
+		upgrade := crud.Status.Database.Upgrade
+		Expect(upgrade.Phase).To(Equal(apiv1.DatabaseUpgradeSucceeded))
+		Expect(upgrade.CompletionTime).NotTo(BeNil())
+		cond := crud.Status.GetCondition(apiv1.ConditionUpgrading)
+		Expect(cond.Status).To(Equal(core.ConditionFalse))
+		Expect(cond.Reason).To(Equal("UpgradeSucceeded"))
+		Expect(r.Get(ctx, key(deploy), deploy)).To(Succeed())
+		Expect(*deploy.Spec.Replicas).To(Equal(*crud.Spec.Autoscaling.MinReplicas))
+		Expect(volumeExists("ordb")).To(BeTrue())
+
+		// back to the volumes of 12
+		crud.Spec.Database.Version = "12"
+		Expect(reconcile()).To(BeFalse())
+		Expect(crud.Status.Database.Upgrade.Phase).To(Equal(apiv1.DatabaseUpgradeRolledBack))
+		Expect(crud.DatabaseVolumeClaimName()).To(Equal("ordb"))
+		Expect(crud.DatabaseServerImage()).To(Equal("postgres:12"))
+		Expect(volumeExists("ordb-13")).To(BeFalse())
+	})
+
+	Context("without the version the database runs", func() {
+		statefulSet := func(image string) {
+			Expect(r.Create(ctx, &apps.StatefulSet{
+				ObjectMeta: meta.ObjectMeta{Namespace: crud.Namespace, Name: crud.DatabaseStatefulName()},
+				Spec: apps.StatefulSetSpec{Template: core.PodTemplateSpec{Spec: core.PodSpec{
+					Containers: []core.Container{{Name: "pg", Image: image}},
+				}}},
+			})).To(Succeed())
+		}
+
+		BeforeEach(func() {
+			crud.Spec.Database.Version = "14"
+			crud.Status.Database.Version = ""
+		})
+
+		It("upgrades the legacy statefulsets from 13", func() {
+			statefulSet("postgres:13")
+			Expect(reconcile()).To(BeTrue())
+			Expect(crud.Status.Database.Upgrade.From).To(Equal("13"))
+			Expect(crud.Status.Database.Upgrade.To).To(Equal("14"))
+			Expect(crud.DatabaseServerImage()).To(Equal("postgres:13"))
+		})
+
+		It("reads the version from the image of the statefulset", func() {
+			statefulSet("postgres:14.2")
+			Expect(reconcile()).To(BeFalse())
+			Expect(crud.Status.Database.Upgrade).To(BeNil())
+			Expect(crud.Status.Database.Version).To(Equal("14"))
+		})
+
+		It("creates a new database with the version of the spec", func() {
+			Expect(reconcile()).To(BeFalse())
+			Expect(crud.Status.Database.Upgrade).To(BeNil())
+			Expect(crud.DatabaseServerImage()).To(Equal("postgres:14"))
+		})
+	})
+
+	It("goes back to the previous volumes when the restore fails", func() {
+		dump()
+		finish(upgradeRestoreJobName(crud), batch.JobFailed)
+		Expect(reconcile()).To(BeTrue())
+
+		// the API scales back up once the upgrade has finished
+		Expect(reconcile()).To(BeFalse())
+		Expect(crud.Status.Database.Upgrade.Phase).To(Equal(apiv1.DatabaseUpgradeFailed))
+		Expect(crud.Status.Database.Version).To(Equal("12"))
+		Expect(crud.DatabaseVolumeClaimName()).To(Equal("ordb"))
+		Expect(volumeExists("ordb")).To(BeTrue())
+		Expect(volumeExists("ordb-13")).To(BeFalse())
+
+		// not retried until the version changes
+		Expect(reconcile()).To(BeFalse())
+		Expect(crud.Status.Database.Upgrade.Phase).To(Equal(apiv1.DatabaseUpgradeFailed))
+	})
+
+	It("does not downgrade the database", func() {
+		crud.Spec.Database.Version = "11"
+		Expect(reconcile()).To(BeFalse())
+		Expect(crud.Status.Database.Upgrade).To(BeNil())
+		Expect(crud.Status.GetCondition(apiv1.ConditionUpgrading).Reason).To(Equal("DowngradeRejected"))
+	})
+})
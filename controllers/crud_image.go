@@ -0,0 +1,107 @@
+package controllers
+
+import (
+	"context"
+	stderrors "errors"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	apiv1 "github.com/crudgen-org/crudgen-orchestrator/api/v1"
+	"github.com/crudgen-org/crudgen-orchestrator/pkg/apidescription"
+)
+
+// imageUpToDate reports whether Status.Image is ready and was built from the
+// current API description. Only such an image may be rolled out.
+//
+// Without a Builder, another system sets Image and ImageReady, and nothing
+// else: an image without a hash is taken as built from the current
+// description. reconcileImage records the hash of every image it builds.
+func imageUpToDate(crud *apiv1.CRUD) bool {
+	if !crud.Status.ImageReady || crud.Status.Image == "" {
+		return false
+	}
+	if crud.Status.APIDescriptionHash == "" {
+		return true
+	}
+	hash, err := apidescription.Hash(crud.Spec.APIDescription)
+	return err == nil && crud.Status.APIDescriptionHash == hash
+}
+
+// apiPort returns the port Status.Image listens on: the one it was built or
+// pinned with, or the deploy_strategy.port of the apiDescription.
+func apiPort(crud *apiv1.CRUD) int32 {
+	if crud.Status.Port != 0 {
+		return crud.Status.Port
+	}
+	return descriptionPort(crud.Spec.APIDescription)
+}
+
+// descriptionPort returns the deploy_strategy.port of description, 0 if it
+// cannot be decoded.
+func descriptionPort(description string) int32 {
+	desc, err := apidescription.Decode(description)
+	if err != nil {
+		return 0
+	}
+	return desc.DeployStrategy.Port
+}
+
+// reconcileImage builds the image of the current API description when the
+// one in the status was built from another description. The pods running the
+// previous image are kept until the new one is ready.
+func (r *CRUDReconciler) reconcileImage(ctx context.Context, logger logr.Logger, crud *apiv1.CRUD) error {
+	hash, err := apidescription.Hash(crud.Spec.APIDescription)
+	if err != nil {
+		return errors.Wrap(err, "could not hash apiDescription")
+	}
+	if crud.Status.APIDescriptionHash == hash && crud.Status.ImageReady {
+		return nil
+	}
+	if crud.Status.ImageReady {
+		logger.Info("image is stale", "image", crud.Status.Image, "hash", crud.Status.APIDescriptionHash)
+		crud.Status.ImageReady = false
+	}
+
+	build := &crud.Status.Build
+	var result *BuildResult
+	if build.APIDescriptionHash == hash {
+		result, err = r.Builder.Poll(ctx, crud, hash)
+	}
+	if build.APIDescriptionHash != hash || err == ErrBuildNotFound {
+		logger.Info("building image", "hash", hash)
+		if err := r.Builder.Submit(ctx, crud, hash); err != nil {
+			return err
+		}
+		now := meta.Now()
+		*build = apiv1.BuildStatus{APIDescriptionHash: hash, Phase: apiv1.BuildRunning, StartTime: &now}
+		return nil
+	}
+
+	var failed *BuildFailedError
+	switch {
+	case stderrors.As(err, &failed):
+		if build.Phase != apiv1.BuildFailed {
+			logger.Info("image build failed", "hash", hash, "message", failed.Message)
+		}
+		build.Phase = apiv1.BuildFailed
+		build.Message = failed.Message
+
+	case err != nil:
+		return err
+
+	case result == nil:
+		build.Phase = apiv1.BuildRunning
+
+	default:
+		logger.Info("image built", "image", result.Image)
+		build.Phase = apiv1.BuildSucceeded
+		build.Message = ""
+		crud.Status.Image = result.Image
+		crud.Status.Port = result.Port
+		crud.Status.APIDescriptionHash = hash
+		crud.Status.ImageReady = true
+	}
+	return nil
+}
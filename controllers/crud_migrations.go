@@ -0,0 +1,167 @@
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	apps "k8s.io/api/apps/v1"
+	batch "k8s.io/api/batch/v1"
+	core "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	apiv1 "github.com/crudgen-org/crudgen-orchestrator/api/v1"
+)
+
+// migrationLabel marks the jobs migrating the database of a CRUD.
+const migrationLabel = "api.crudgen.org/migration"
+
+// migrateCommand applies the migrations shipped with a generated image.
+var migrateCommand = []string{"python", "manage.py", "migrate", "--noinput"}
+
+func migrationJobName(crud *apiv1.CRUD, image string) string {
+	sum := sha256.Sum256([]byte(image))
+	return fmt.Sprintf("%s-migrate-%x", crud.Name, sum[:5])
+}
+
+// ensureMigrated runs the database migrations of Status.Image unless the
+// deployment already runs it, and reports whether the image can be rolled
+// out. The MigrationFailed condition reports the outcome.
+func (r *CRUDReconciler) ensureMigrated(ctx context.Context, logger logr.Logger, crud *apiv1.CRUD) (bool, error) {
+	deployed, err := r.deployedImage(ctx, crud)
+	if err != nil {
+		return false, err
+	}
+	if deployed == crud.Status.Image {
+		crud.Status.SetCondition(newCondition(apiv1.ConditionMigrationFailed, false, "Migrated", crud.Status.Image))
+		return true, nil
+	}
+
+	key := key(crud)
+	key.Name = migrationJobName(crud, crud.Status.Image)
+	job := &batch.Job{}
+	switch err := r.Get(ctx, key, job); {
+	case apierrors.IsNotFound(err):
+		if err := r.deleteMigrationJobs(ctx, crud); err != nil {
+			return false, err
+		}
+		job = r.migrationJob(crud, key.Name)
+		if err := controllerutil.SetControllerReference(crud, job, r.Scheme); err != nil {
+			return false, errors.Wrap(err, "could not set owner reference on migration job")
+		}
+		logger.Info("migrating database", "image", crud.Status.Image, "job", job.Name)
+		if err := r.Create(ctx, job); err != nil {
+			return false, errors.Wrap(err, "could not create migration job")
+		}
+		crud.Status.SetCondition(newCondition(apiv1.ConditionMigrationFailed, false, "Migrating", "migrating the database for "+crud.Status.Image))
+		return false, nil
+
+	case err != nil:
+		return false, errors.Wrap(err, "could not retrieve migration job")
+	}
+
+	switch cond := jobFinished(job); {
+	case cond == nil:
+		crud.Status.SetCondition(newCondition(apiv1.ConditionMigrationFailed, false, "Migrating", "migrating the database for "+crud.Status.Image))
+		return false, nil
+
+	case cond.Type == batch.JobFailed:
+		if !crud.Status.IsConditionTrue(apiv1.ConditionMigrationFailed) {
+			logger.Info("database migration failed, delete the job to retry", "job", job.Name, "reason", cond.Reason)
+		}
+		crud.Status.SetCondition(newCondition(apiv1.ConditionMigrationFailed, true, "MigrationFailed",
+			fmt.Sprintf("job %s failed, %s is still serving: %s", job.Name, deployedOrNone(deployed), cond.Message)))
+		return false, nil
+	}
+
+	// the job is not needed anymore once the image is rolled out
+	if err := r.deleteJob(ctx, job); err != nil {
+		return false, err
+	}
+	crud.Status.SetCondition(newCondition(apiv1.ConditionMigrationFailed, false, "Migrated", crud.Status.Image))
+	return true, nil
+}
+
+func deployedOrNone(image string) string {
+	if image == "" {
+		return "no image"
+	}
+	return image
+}
+
+// deployedImage returns the image of the API deployment, or "" if it does
+// not exist yet.
+func (r *CRUDReconciler) deployedImage(ctx context.Context, crud *apiv1.CRUD) (string, error) {
+	key := key(crud)
+	key.Name = crud.DeploymentName()
+
+	deploy := &apps.Deployment{}
+	switch err := r.Get(ctx, key, deploy); {
+	case apierrors.IsNotFound(err):
+		return "", nil
+	case err != nil:
+		return "", errors.Wrap(err, "could not retrieve deployment")
+	}
+	for _, container := range deploy.Spec.Template.Spec.Containers {
+		if container.Name == crud.Name {
+			return container.Image, nil
+		}
+	}
+	return "", nil
+}
+
+func (r *CRUDReconciler) migrationJob(crud *apiv1.CRUD, name string) *batch.Job {
+	labels := crud.LabelSelectors()
+	labels[migrationLabel] = "true"
+	return &batch.Job{
+		ObjectMeta: meta.ObjectMeta{
+			Name:      name,
+			Namespace: crud.Namespace,
+			Labels:    labels,
+		},
+		Spec: batch.JobSpec{
+			BackoffLimit: pointer.Int32Ptr(2),
+			Template: core.PodTemplateSpec{
+				Spec: core.PodSpec{
+					RestartPolicy: core.RestartPolicyNever,
+					// the first image is migrated while the database starts
+					InitContainers: []core.Container{waitForDatabase(crud)},
+					Containers: []core.Container{
+						{
+							Name:    "migrate",
+							Image:   crud.Status.Image,
+							Command: migrateCommand,
+							Env: []core.EnvVar{
+								secretEnv(crud, "DATABASE_URL", apiv1.DatabaseURLKey),
+							},
+							TerminationMessagePolicy: core.TerminationMessageFallbackToLogsOnError,
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// deleteMigrationJobs deletes the jobs migrating to images that were not
+// rolled out.
+func (r *CRUDReconciler) deleteMigrationJobs(ctx context.Context, crud *apiv1.CRUD) error {
+	labels := crud.LabelSelectors()
+	labels[migrationLabel] = "true"
+	jobs := &batch.JobList{}
+	if err := r.List(ctx, jobs, client.InNamespace(crud.Namespace), client.MatchingLabels(labels)); err != nil {
+		return errors.Wrap(err, "could not list migration jobs")
+	}
+	for i := range jobs.Items {
+		if err := r.deleteJob(ctx, &jobs.Items[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package controllers
+
+import (
+	"context"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	apps "k8s.io/api/apps/v1"
+	batch "k8s.io/api/batch/v1"
+	core "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	apiv1 "github.com/crudgen-org/crudgen-orchestrator/api/v1"
+)
+
+var _ = Describe("ensureMigrated", func() {
+	const (
+		oldImage = "registry/todolist@sha256:1"
+		newImage = "registry/todolist@sha256:2"
+	)
+
+	var (
+		ctx    context.Context
+		logger logr.Logger
+		r      *CRUDReconciler
+		crud   *apiv1.CRUD
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		logger = logf.Log.WithName("test")
+		crud = newTestCRUD()
+		crud.UID = "1234"
+		crud.Status.Image = newImage
+
+		deploy := &apps.Deployment{
+			ObjectMeta: meta.ObjectMeta{Namespace: crud.Namespace, Name: crud.DeploymentName()},
+			Spec: apps.DeploymentSpec{
+				Template: core.PodTemplateSpec{
+					Spec: core.PodSpec{
+						Containers: []core.Container{{Name: crud.Name, Image: oldImage}},
+					},
+				},
+			},
+		}
+		s := testScheme()
+		r = &CRUDReconciler{Client: fake.NewFakeClientWithScheme(s, crud.DeepCopy(), deploy), Scheme: s}
+	})
+
+	migrationJob := func() *batch.Job {
+		job := &batch.Job{}
+		jobKey := key(crud)
+		jobKey.Name = migrationJobName(crud, newImage)
+		Expect(r.Get(ctx, jobKey, job)).To(Succeed())
+		return job
+	}
+
+	finish := func(conditionType batch.JobConditionType) {
+		job := migrationJob()
+		job.Status.Conditions = []batch.JobCondition{{Type: conditionType, Status: core.ConditionTrue, Message: "BackoffLimitExceeded"}}
+		Expect(r.Update(ctx, job)).To(Succeed())
+	}
+
+	It("migrates with the new image before it is rolled out", func() {
+		migrated, err := r.ensureMigrated(ctx, logger, crud)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(migrated).To(BeFalse())
+		Expect(migrationJob().Spec.Template.Spec.Containers[0].Image).To(Equal(newImage))
+		Expect(migrationJob().Spec.Template.Spec.InitContainers[0].Name).To(Equal("wait-for-database"))
+		Expect(crud.Status.GetCondition(apiv1.ConditionMigrationFailed).Reason).To(Equal("Migrating"))
+
+		finish(batch.JobComplete)
+		migrated, err = r.ensureMigrated(ctx, logger, crud)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(migrated).To(BeTrue())
+		Expect(crud.Status.GetCondition(apiv1.ConditionMigrationFailed).Reason).To(Equal("Migrated"))
+
+		jobKey := key(crud)
+		jobKey.Name = migrationJobName(crud, newImage)
+		Expect(apierrors.IsNotFound(r.Get(ctx, jobKey, &batch.Job{}))).To(BeTrue())
+	})
+
+	It("keeps the old image serving when the migration fails", func() {
+		_, err := r.ensureMigrated(ctx, logger, crud)
+		Expect(err).NotTo(HaveOccurred())
+
+		finish(batch.JobFailed)
+		migrated, err := r.ensureMigrated(ctx, logger, crud)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(migrated).To(BeFalse())
+		Expect(crud.Status.IsConditionTrue(apiv1.ConditionMigrationFailed)).To(BeTrue())
+		Expect(crud.Status.GetCondition(apiv1.ConditionMigrationFailed).Message).To(ContainSubstring(oldImage))
+
+		Expect(r.updateConditions(ctx, crud, nil)).To(Succeed())
+		Expect(crud.Status.GetCondition(apiv1.ConditionReady).Message).To(ContainSubstring(apiv1.ConditionMigrationFailed))
+	})
+
+	It("does not migrate an image already rolled out", func() {
+		crud.Status.Image = oldImage
+		migrated, err := r.ensureMigrated(ctx, logger, crud)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(migrated).To(BeTrue())
+	})
+})
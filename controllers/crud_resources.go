@@ -3,152 +3,203 @@ package controllers
 import (
 	"context"
 	"fmt"
+
 	"github.com/go-logr/logr"
 	"github.com/pkg/errors"
 	apps "k8s.io/api/apps/v1"
 	autoscaling "k8s.io/api/autoscaling/v1"
 	core "k8s.io/api/core/v1"
 	networking "k8s.io/api/networking/v1beta1"
-	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/util/intstr"
-	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 
 	apiv1 "github.com/crudgen-org/crudgen-orchestrator/api/v1"
 )
 
+// fieldManager is the field manager used when applying child resources.
+const fieldManager = "crudgen-orchestrator"
+
+// apply server-side applies the desired state of a child resource of crud.
+// Only the fields set on obj are owned by the orchestrator; fields managed by
+// others, such as the replicas set by the HPA, are left alone.
+func (r *CRUDReconciler) apply(ctx context.Context, crud *apiv1.CRUD, obj runtime.Object) error {
+	gvk, err := apiutil.GVKForObject(obj, r.Scheme)
+	if err != nil {
+		return err
+	}
+	obj.GetObjectKind().SetGroupVersionKind(gvk)
+
+	object, ok := obj.(meta.Object)
+	if !ok {
+		return fmt.Errorf("%T is not a meta.Object", obj)
+	}
+	if err := controllerutil.SetControllerReference(crud, object, r.Scheme); err != nil {
+		return errors.Wrap(err, "could not set owner reference")
+	}
+	return r.Patch(ctx, obj, client.Apply, client.FieldOwner(fieldManager), client.ForceOwnership)
+}
+
+// ensureDeployment applies the API deployment. The deployment is applied on
+// every reconcile so that it is repaired and follows the spec, but the image
+// it runs only changes once rolloutImage allows it.
 func (r *CRUDReconciler) ensureDeployment(ctx context.Context, logger logr.Logger, crud *apiv1.CRUD) error {
-	deploy := &apps.Deployment{}
+	rollOut, err := r.rolloutImage(ctx, logger, crud)
+	if err != nil {
+		return err
+	}
+	image, port := crud.Status.Image, apiPort(crud)
+	if !rollOut {
+		if image, port, err = r.rolledOut(ctx, crud); err != nil {
+			return err
+		}
+	}
+	if image == "" {
+		// nothing to run yet
+		return nil
+	}
+
+	secretKey := key(crud)
+	secretKey.Name = crud.DatabaseSecretName()
+	secret := &core.Secret{}
+	if err := r.Get(ctx, secretKey, secret); err != nil {
+		return errors.Wrap(err, "could not retrieve database secret")
+	}
 
-	switch err := r.Get(ctx, key(crud), deploy); {
-	case apierrors.IsNotFound(err):
-		deploy = &apps.Deployment{
-			ObjectMeta: meta.ObjectMeta{
-				Name:      crud.DeploymentName(),
-				Namespace: crud.Namespace,
+	maxUnavailable := intstr.FromInt(0)
+	deploy := &apps.Deployment{
+		ObjectMeta: meta.ObjectMeta{
+			Name:      crud.DeploymentName(),
+			Namespace: crud.Namespace,
+		},
+		Spec: apps.DeploymentSpec{
+			// Replicas are left to the HPA
+			Selector: &meta.LabelSelector{
+				MatchLabels: crud.LabelSelectors(),
 			},
-			Spec: apps.DeploymentSpec{
-				Replicas: pointer.Int32Ptr(1),
-				Selector: &meta.LabelSelector{
-					MatchLabels: crud.LabelSelectors(),
+			// keep serving while pods are replaced, e.g. after a credentials
+			// rotation
+			Strategy: apps.DeploymentStrategy{
+				Type: apps.RollingUpdateDeploymentStrategyType,
+				RollingUpdate: &apps.RollingUpdateDeployment{
+					MaxUnavailable: &maxUnavailable,
 				},
-				Template: core.PodTemplateSpec{
-					ObjectMeta: meta.ObjectMeta{
-						Labels: crud.LabelSelectors(),
+			},
+			Template: core.PodTemplateSpec{
+				ObjectMeta: meta.ObjectMeta{
+					Labels: crud.LabelSelectors(),
+					Annotations: map[string]string{
+						credentialsHashAnnotation: credentialsHash(secret),
 					},
-					Spec: core.PodSpec{
-						Containers: []core.Container{
-							{
-								Name:  crud.Name,
-								Image: crud.Status.Image,
-								Env: []core.EnvVar{
-									{
-										Name:  "DATABASE_URL",
-										Value: crud.DatabaseHost(),
-									},
+				},
+				Spec: core.PodSpec{
+					InitContainers: []core.Container{waitForDatabase(crud)},
+					Containers: []core.Container{
+						{
+							Name:      crud.Name,
+							Image:     image,
+							Resources: crud.Spec.Resources,
+							Ports: []core.ContainerPort{
+								{
+									Name:          "api",
+									ContainerPort: port,
 								},
 							},
+							Env: []core.EnvVar{
+								secretEnv(crud, "DATABASE_URL", apiv1.DatabaseURLKey),
+							},
 						},
 					},
 				},
 			},
-		}
-		if err := controllerutil.SetControllerReference(crud, deploy, r.Scheme); err != nil {
-			return errors.Wrap(err, "could not set owner reference on deployment")
-		}
-		if err := r.Create(ctx, deploy); err != nil {
-			return errors.Wrap(err, "could not update deployment")
-		}
-
-	case err != nil:
-		return errors.Wrap(err, "could not retrieve deployment")
+		},
+	}
+	if err := r.apply(ctx, crud, deploy); err != nil {
+		return errors.Wrap(err, "could not apply deployment")
+	}
+	if !rollOut {
+		return nil
+	}
+	return r.recordRevision(ctx, logger, crud)
+}
 
-	default:
-		updateDeploy := false
-		if deploy.Spec.Template.Spec.Containers == nil ||
-			len(deploy.Spec.Template.Spec.Containers) == 0 {
-			return errors.New("containers in deployment is nil.")
-		}
-		if deploy.Spec.Template.Spec.Containers[0].Image != crud.Status.Image {
-			deploy.Spec.Template.Spec.Containers[0].Image = crud.Status.Image
-			updateDeploy = true
-		}
-		if updateDeploy {
-			if err := r.Update(ctx, deploy); err != nil {
-				return errors.Wrap(err, "could not update deployment")
-			}
-		}
+// rolloutImage reports whether Status.Image may replace the image the API
+// runs: it must be built from the current apiDescription, without
+// destructive changes, and the database migrated for it.
+func (r *CRUDReconciler) rolloutImage(ctx context.Context, logger logr.Logger, crud *apiv1.CRUD) (bool, error) {
+	switch {
+	case !imageUpToDate(crud):
+		// the pods keep running the image they have until the one of the
+		// current apiDescription is built
+		logger.Info("not rolling out an image built from another apiDescription",
+			"image", crud.Status.Image, "hash", crud.Status.APIDescriptionHash)
+		return false, nil
+	case !schemaCompatible(crud):
+		logger.Info("not rolling out an apiDescription with destructive changes")
+		return false, nil
+	case !crud.InCluster() && crud.Status.Database.Server == "":
+		logger.Info("waiting for the database to be created on the external server")
+		return false, nil
 	}
-	return nil
+	// new pods must not start against an old schema
+	return r.ensureMigrated(ctx, logger, crud)
 }
 
+// ensureService applies the API service, targeting the port of the image the
+// deployment runs.
 func (r *CRUDReconciler) ensureService(ctx context.Context, logger logr.Logger, crud *apiv1.CRUD) error {
-	service := &core.Service{}
-
-	switch err := r.Get(ctx, key(crud), service); {
-	case apierrors.IsNotFound(err):
-		service := &core.Service{
-			ObjectMeta: meta.ObjectMeta{
-				Name:      crud.ServiceName(),
-				Namespace: crud.Namespace,
-			},
-			Spec: core.ServiceSpec{
-				Ports: []core.ServicePort{
-					{
-						Name: "api",
-						Port: crud.Status.Port,
-						TargetPort: intstr.IntOrString{
-							IntVal: crud.Status.Port,
-						},
-					},
+	_, port, err := r.rolledOut(ctx, crud)
+	if err != nil {
+		return err
+	}
+	service := &core.Service{
+		ObjectMeta: meta.ObjectMeta{
+			Name:      crud.ServiceName(),
+			Namespace: crud.Namespace,
+		},
+		Spec: core.ServiceSpec{
+			Ports: []core.ServicePort{
+				{
+					Name:       "api",
+					Port:       port,
+					TargetPort: intstr.FromInt(int(port)),
 				},
-				Selector: crud.LabelSelectors(),
-				Type:     core.ServiceTypeClusterIP,
 			},
-		}
-		if err := controllerutil.SetControllerReference(crud, service, r.Scheme); err != nil {
-			return errors.Wrap(err, "could not set controller reference on service")
-		}
-		if err := r.Create(ctx, service); err != nil {
-			return errors.Wrap(err, "could not create service")
-		}
-
-	case err != nil:
-		return errors.Wrap(err, "could not get service")
-
-	default:
-		// TODO: update if necessary
+			Selector: crud.LabelSelectors(),
+			Type:     core.ServiceTypeClusterIP,
+		},
+	}
+	if err := r.apply(ctx, crud, service); err != nil {
+		return errors.Wrap(err, "could not apply service")
 	}
 	return nil
 }
 
 func (r *CRUDReconciler) ensureIngress(ctx context.Context, logger logr.Logger, crud *apiv1.CRUD) error {
+	_, port, err := r.rolledOut(ctx, crud)
+	if err != nil {
+		return err
+	}
 	fullDomain := fmt.Sprintf("%s.%s", crud.Spec.DomainPrefix, r.RootDomain)
-	ingress := &networking.Ingress{}
-
-	switch err := r.Get(ctx, key(crud), ingress); {
-	case apierrors.IsNotFound(err):
-		ingress = &networking.Ingress{
-			ObjectMeta: meta.ObjectMeta{
-				Name:      crud.Name,
-				Namespace: crud.Namespace,
-			},
-			Spec: networking.IngressSpec{
-				TLS: nil,
-				Rules: []networking.IngressRule{
-					{
-						Host: fullDomain,
-						IngressRuleValue: networking.IngressRuleValue{
-							HTTP: &networking.HTTPIngressRuleValue{
-								Paths: []networking.HTTPIngressPath{
-									{
-										Backend: networking.IngressBackend{
-											ServiceName: crud.ServiceName(),
-											ServicePort: intstr.IntOrString{
-												IntVal: crud.Status.Port,
-											},
-										},
+	ingress := &networking.Ingress{
+		ObjectMeta: meta.ObjectMeta{
+			Name:      crud.Name,
+			Namespace: crud.Namespace,
+		},
+		Spec: networking.IngressSpec{
+			Rules: []networking.IngressRule{
+				{
+					Host: fullDomain,
+					IngressRuleValue: networking.IngressRuleValue{
+						HTTP: &networking.HTTPIngressRuleValue{
+							Paths: []networking.HTTPIngressPath{
+								{
+									Backend: networking.IngressBackend{
+										ServiceName: crud.ServiceName(),
+										ServicePort: intstr.FromInt(int(port)),
 									},
 								},
 							},
@@ -156,67 +207,44 @@ func (r *CRUDReconciler) ensureIngress(ctx context.Context, logger logr.Logger,
 					},
 				},
 			},
+		},
+	}
+	if crud.Spec.EnableTLS {
+		ingress.Annotations = map[string]string{
+			"cert-manager.io/cluster-issuer": r.ClusterIssuer,
+		}
+		ingress.Spec.TLS = []networking.IngressTLS{
+			{
+				Hosts:      []string{fullDomain},
+				SecretName: crud.TLSSecretName(),
+			},
 		}
-		if crud.Spec.EnableTLS {
-			ingress.Annotations = map[string]string{
-				"cert-manager.io/cluster-issuer": r.ClusterIssuer,
-			}
-			ingress.Spec.TLS = []networking.IngressTLS{
-				{
-					Hosts:      []string{fullDomain},
-					SecretName: crud.TLSSecretName(),
-				},
-			}
-		}
-		if err := controllerutil.SetControllerReference(crud, ingress, r.Scheme); err != nil {
-			return errors.Wrap(err, "could not set controller reference on ingress")
-		}
-		if err := r.Create(ctx, ingress); err != nil {
-			return errors.Wrap(err, "could not create ingress")
-		}
-
-	case err != nil:
-		return errors.Wrap(err, "could not get ingress")
-
-	default:
-		// TODO: update if necessary
+	}
+	if err := r.apply(ctx, crud, ingress); err != nil {
+		return errors.Wrap(err, "could not apply ingress")
 	}
 	return nil
 }
 
 func (r *CRUDReconciler) ensureHPA(ctx context.Context, logger logr.Logger, crud *apiv1.CRUD) error {
-	hpa := &autoscaling.HorizontalPodAutoscaler{}
-
-	switch err := r.Get(ctx, key(crud), hpa); {
-	case apierrors.IsNotFound(err):
-		hpa = &autoscaling.HorizontalPodAutoscaler{
-			ObjectMeta: meta.ObjectMeta{
-				Name:      crud.Name,
-				Namespace: crud.Namespace,
+	hpa := &autoscaling.HorizontalPodAutoscaler{
+		ObjectMeta: meta.ObjectMeta{
+			Name:      crud.Name,
+			Namespace: crud.Namespace,
+		},
+		Spec: autoscaling.HorizontalPodAutoscalerSpec{
+			ScaleTargetRef: autoscaling.CrossVersionObjectReference{
+				Kind:       "Deployment",
+				Name:       crud.DeploymentName(),
+				APIVersion: "apps/v1",
 			},
-			Spec: autoscaling.HorizontalPodAutoscalerSpec{
-				ScaleTargetRef: autoscaling.CrossVersionObjectReference{
-					Kind:       "Deployment",
-					Name:       crud.DeploymentName(),
-					APIVersion: "apps/v1",
-				},
-				MinReplicas:                    pointer.Int32Ptr(1),
-				MaxReplicas:                    10,
-				TargetCPUUtilizationPercentage: pointer.Int32Ptr(80),
-			},
-		}
-		if err := controllerutil.SetControllerReference(crud, hpa, r.Scheme); err != nil {
-			return errors.Wrap(err, "could not set owner reference on hpa")
-		}
-		if err := r.Create(ctx, hpa); err != nil {
-			return errors.Wrap(err, "could not update hpa")
-		}
-
-	case err != nil:
-		return errors.Wrap(err, "could not retrieve hpa")
-
-	default:
-		// TODO change this if crud changes
+			MinReplicas:                    crud.Spec.Autoscaling.MinReplicas,
+			MaxReplicas:                    crud.Spec.Autoscaling.MaxReplicas,
+			TargetCPUUtilizationPercentage: crud.Spec.Autoscaling.TargetCPUUtilizationPercentage,
+		},
+	}
+	if err := r.apply(ctx, crud, hpa); err != nil {
+		return errors.Wrap(err, "could not apply hpa")
 	}
 	return nil
 }
@@ -0,0 +1,221 @@
+package controllers
+
+import (
+	"context"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	apps "k8s.io/api/apps/v1"
+	autoscaling "k8s.io/api/autoscaling/v1"
+	batch "k8s.io/api/batch/v1"
+	core "k8s.io/api/core/v1"
+	networking "k8s.io/api/networking/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	apiv1 "github.com/crudgen-org/crudgen-orchestrator/api/v1"
+	"github.com/crudgen-org/crudgen-orchestrator/pkg/apidescription"
+)
+
+// applyClient emulates server-side apply, which the fake client does not
+// support, with a merge patch of the applied object: the fields it does not
+// set are left alone. It checks that objects are applied by the
+// orchestrator's field manager.
+type applyClient struct {
+	client.Client
+}
+
+func (c *applyClient) Patch(ctx context.Context, obj runtime.Object, patch client.Patch, opts ...client.PatchOption) error {
+	if patch.Type() != types.ApplyPatchType {
+		return c.Client.Patch(ctx, obj, patch, opts...)
+	}
+	options := &client.PatchOptions{}
+	options.ApplyOptions(opts)
+	Expect(options.FieldManager).To(Equal(fieldManager))
+	Expect(options.Force).NotTo(BeNil())
+	Expect(*options.Force).To(BeTrue())
+
+	data, err := patch.Data(obj)
+	if err != nil {
+		return err
+	}
+	switch err := c.Get(ctx, key(obj.(meta.Object)), obj.DeepCopyObject()); {
+	case apierrors.IsNotFound(err):
+		return c.Create(ctx, obj)
+	case err != nil:
+		return err
+	}
+	return c.Client.Patch(ctx, obj, client.RawPatch(types.MergePatchType, data))
+}
+
+var _ = Describe("ensureDeployment", func() {
+	var (
+		ctx    context.Context
+		logger logr.Logger
+		r      *CRUDReconciler
+		crud   *apiv1.CRUD
+		hash   string
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		logger = logf.Log.WithName("test")
+		crud = newTestCRUD()
+		crud.SetDefaults()
+		var err error
+		hash, err = apidescription.Hash(crud.Spec.APIDescription)
+		Expect(err).NotTo(HaveOccurred())
+
+		secret := &core.Secret{
+			ObjectMeta: meta.ObjectMeta{Namespace: crud.Namespace, Name: crud.DatabaseSecretName()},
+			Data:       map[string][]byte{apiv1.DatabaseURLKey: []byte("psql://u:p@db/d")},
+		}
+		s := testScheme()
+		r = &CRUDReconciler{Client: &applyClient{fake.NewFakeClientWithScheme(s, secret)}, Scheme: s}
+	})
+
+	deployment := func() *apps.Deployment {
+		deploy := &apps.Deployment{}
+		deployKey := key(crud)
+		deployKey.Name = crud.DeploymentName()
+		Expect(r.Get(ctx, deployKey, deploy)).To(Succeed())
+		return deploy
+	}
+
+	image := func() string {
+		return deployment().Spec.Template.Spec.Containers[0].Image
+	}
+
+	// ports returns the ports of the deployment, the service and the ingress
+	ports := func() []int32 {
+		Expect(r.ensureService(ctx, logger, crud)).To(Succeed())
+		Expect(r.ensureIngress(ctx, logger, crud)).To(Succeed())
+		service := &core.Service{}
+		serviceKey := key(crud)
+		serviceKey.Name = crud.ServiceName()
+		Expect(r.Get(ctx, serviceKey, service)).To(Succeed())
+		ingress := &networking.Ingress{}
+		Expect(r.Get(ctx, key(crud), ingress)).To(Succeed())
+		return []int32{
+			deployment().Spec.Template.Spec.Containers[0].Ports[0].ContainerPort,
+			service.Spec.Ports[0].TargetPort.IntVal,
+			ingress.Spec.Rules[0].HTTP.Paths[0].Backend.ServicePort.IntVal,
+		}
+	}
+
+	// migrate completes the migration job of the image in the status
+	migrate := func() {
+		Expect(r.ensureDeployment(ctx, logger, crud)).To(Succeed())
+		job := &batch.Job{}
+		jobKey := key(crud)
+		jobKey.Name = migrationJobName(crud, crud.Status.Image)
+		Expect(r.Get(ctx, jobKey, job)).To(Succeed())
+		job.Status.Conditions = []batch.JobCondition{{Type: batch.JobComplete, Status: core.ConditionTrue}}
+		Expect(r.Update(ctx, job)).To(Succeed())
+	}
+
+	rollOut := func(image string) {
+		crud.Status.Image = image
+		crud.Status.ImageReady = true
+		crud.Status.APIDescriptionHash = hash
+		migrate()
+		Expect(r.ensureDeployment(ctx, logger, crud)).To(Succeed())
+	}
+
+	It("rolls out the image of an external builder that does not record the hash", func() {
+		crud.Status.Image = "registry/todolist:v1"
+		crud.Status.ImageReady = true
+		Expect(imageUpToDate(crud)).To(BeTrue())
+		Expect(imageCondition(crud).Status).To(Equal(core.ConditionTrue))
+
+		migrate()
+		Expect(r.ensureDeployment(ctx, logger, crud)).To(Succeed())
+		Expect(image()).To(Equal("registry/todolist:v1"))
+		Expect(crud.Status.Revision).To(Equal(int64(1)))
+		// the port of the apiDescription, the builder did not set one
+		Expect(ports()).To(Equal([]int32{8080, 8080, 8080}))
+	})
+
+	It("serves the port the image was built with", func() {
+		crud.Status.Port = 9000
+		rollOut("registry/todolist:v1")
+		Expect(ports()).To(Equal([]int32{9000, 9000, 9000}))
+
+		// until the image listening on another port is rolled out
+		crud.Status.Port = 9001
+		crud.Status.SetCondition(newCondition(apiv1.ConditionSchemaCompatible, false, "DestructiveChanges", ""))
+		Expect(r.ensureDeployment(ctx, logger, crud)).To(Succeed())
+		Expect(ports()).To(Equal([]int32{9000, 9000, 9000}))
+
+		crud.Status.SetCondition(newCondition(apiv1.ConditionSchemaCompatible, true, "NoDestructiveChanges", ""))
+		rollOut("registry/todolist:v2")
+		Expect(ports()).To(Equal([]int32{9001, 9001, 9001}))
+	})
+
+	It("does not create the deployment before an image is ready", func() {
+		Expect(r.ensureDeployment(ctx, logger, crud)).To(Succeed())
+		deployKey := key(crud)
+		deployKey.Name = crud.DeploymentName()
+		Expect(apierrors.IsNotFound(r.Get(ctx, deployKey, &apps.Deployment{}))).To(BeTrue())
+	})
+
+	It("keeps applying the image rolled out while the new one is held back", func() {
+		rollOut("registry/todolist:v1")
+		Expect(image()).To(Equal("registry/todolist:v1"))
+
+		// a stale image, and a deleted deployment
+		crud.Status.Image = "registry/todolist:v2"
+		crud.Status.APIDescriptionHash = "0123456789abcdef"
+		crud.Spec.Resources.Limits = core.ResourceList{core.ResourceMemory: resource.MustParse("1Gi")}
+		Expect(r.Delete(ctx, deployment())).To(Succeed())
+
+		Expect(r.ensureDeployment(ctx, logger, crud)).To(Succeed())
+		Expect(image()).To(Equal("registry/todolist:v1"))
+		Expect(deployment().Spec.Template.Spec.Containers[0].Resources.Limits.Memory().String()).To(Equal("1Gi"))
+		Expect(crud.Status.Revision).To(Equal(int64(1)))
+
+		// destructive changes
+		crud.Status.APIDescriptionHash = hash
+		crud.Status.SetCondition(newCondition(apiv1.ConditionSchemaCompatible, false, "DestructiveChanges", ""))
+		Expect(r.ensureDeployment(ctx, logger, crud)).To(Succeed())
+		Expect(image()).To(Equal("registry/todolist:v1"))
+	})
+
+	It("leaves the replicas to the HPA", func() {
+		rollOut("registry/todolist:v1")
+		Expect(r.ensureHPA(ctx, logger, crud)).To(Succeed())
+		scaled := deployment()
+		scaled.Spec.Replicas = pointer.Int32Ptr(7)
+		Expect(r.Update(ctx, scaled)).To(Succeed())
+
+		crud.Spec.Autoscaling.MaxReplicas = 20
+		Expect(r.ensureDeployment(ctx, logger, crud)).To(Succeed())
+		Expect(r.ensureHPA(ctx, logger, crud)).To(Succeed())
+		Expect(*deployment().Spec.Replicas).To(Equal(int32(7)))
+		hpa := &autoscaling.HorizontalPodAutoscaler{}
+		Expect(r.Get(ctx, key(crud), hpa)).To(Succeed())
+		Expect(hpa.Spec.MaxReplicas).To(Equal(int32(20)))
+		Expect(hpa.OwnerReferences).To(HaveLen(1))
+		Expect(*hpa.OwnerReferences[0].Controller).To(BeTrue())
+	})
+
+	It("follows the changes of the spec", func() {
+		crud.Spec.EnableTLS = true
+		Expect(r.ensureIngress(ctx, logger, crud)).To(Succeed())
+		crud.Spec.DomainPrefix = "todos"
+		Expect(r.ensureIngress(ctx, logger, crud)).To(Succeed())
+
+		ingress := &networking.Ingress{}
+		Expect(r.Get(ctx, key(crud), ingress)).To(Succeed())
+		Expect(ingress.Spec.Rules[0].Host).To(HavePrefix("todos."))
+		Expect(ingress.Spec.TLS[0].Hosts).To(ConsistOf(ingress.Spec.Rules[0].Host))
+	})
+})
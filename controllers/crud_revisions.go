@@ -0,0 +1,192 @@
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	apps "k8s.io/api/apps/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	apiv1 "github.com/crudgen-org/crudgen-orchestrator/api/v1"
+)
+
+// +kubebuilder:rbac:groups=apps,resources=controllerrevisions,verbs=get;list;watch;create;update;patch;delete
+
+// Annotations of the revisions recording when and by whom they were last
+// rolled out. The data of a ControllerRevision is immutable.
+const (
+	revisionDeployedAtAnnotation = "api.crudgen.org/deployed-at"
+	revisionDeployedByAnnotation = "api.crudgen.org/deployed-by"
+)
+
+// revisionData is the content of the ControllerRevisions recording the
+// descriptions rolled out for a CRUD.
+type revisionData struct {
+	APIDescription     string `json:"apiDescription"`
+	APIDescriptionHash string `json:"apiDescriptionHash"`
+	Image              string `json:"image"`
+	Port               int32  `json:"port"`
+}
+
+func revisionName(crud *apiv1.CRUD, data *revisionData) string {
+	sum := sha256.Sum256([]byte(data.APIDescriptionHash + "@" + data.Image))
+	return fmt.Sprintf("%s-%x", crud.Name, sum[:5])
+}
+
+// listRevisions returns the revisions of crud, oldest first.
+func (r *CRUDReconciler) listRevisions(ctx context.Context, crud *apiv1.CRUD) ([]apps.ControllerRevision, error) {
+	list := &apps.ControllerRevisionList{}
+	if err := r.List(ctx, list, client.InNamespace(crud.Namespace), client.MatchingLabels(crud.LabelSelectors())); err != nil {
+		return nil, errors.Wrap(err, "could not list revisions")
+	}
+	revisions := list.Items
+	sort.Slice(revisions, func(i, j int) bool {
+		return revisions[i].Revision < revisions[j].Revision
+	})
+	return revisions, nil
+}
+
+// rolledOutRevision returns the content of the revision last rolled out, or
+// nil if none has been recorded.
+func (r *CRUDReconciler) rolledOutRevision(ctx context.Context, crud *apiv1.CRUD) (*revisionData, error) {
+	if crud.Status.Revision == 0 {
+		return nil, nil
+	}
+	revisions, err := r.listRevisions(ctx, crud)
+	if err != nil {
+		return nil, err
+	}
+	revision := findRevision(revisions, crud.Status.Revision)
+	if revision == nil {
+		return nil, nil
+	}
+	data := &revisionData{}
+	if err := json.Unmarshal(revision.Data.Raw, data); err != nil {
+		return nil, errors.Wrapf(err, "could not decode revision %d", revision.Revision)
+	}
+	return data, nil
+}
+
+// rolledOut returns the image and port of the revision last rolled out. If
+// no revision was recorded, it returns the image the deployment runs, "" if
+// there is none, and the port of Status.Image.
+func (r *CRUDReconciler) rolledOut(ctx context.Context, crud *apiv1.CRUD) (string, int32, error) {
+	data, err := r.rolledOutRevision(ctx, crud)
+	switch {
+	case err != nil:
+		return "", 0, err
+	case data == nil:
+		image, err := r.deployedImage(ctx, crud)
+		return image, apiPort(crud), err
+	case data.Port == 0:
+		// recorded before the port of the image was
+		return data.Image, descriptionPort(data.APIDescription), nil
+	}
+	return data.Image, data.Port, nil
+}
+
+// recordRevision records the description and image being rolled out as the
+// newest revision of crud, then prunes the revisions beyond the history
+// limit. Rolling out a previous revision again renumbers it.
+func (r *CRUDReconciler) recordRevision(ctx context.Context, logger logr.Logger, crud *apiv1.CRUD) error {
+	revisions, err := r.listRevisions(ctx, crud)
+	if err != nil {
+		return err
+	}
+
+	data := &revisionData{
+		APIDescription:     crud.Spec.APIDescription,
+		APIDescriptionHash: crud.Status.APIDescriptionHash,
+		Image:              crud.Status.Image,
+		Port:               crud.Status.Port,
+	}
+	name := revisionName(crud, data)
+	var latest int64
+	var current *apps.ControllerRevision
+	for i := range revisions {
+		if revisions[i].Revision > latest {
+			latest = revisions[i].Revision
+		}
+		if revisions[i].Name == name {
+			current = &revisions[i]
+		}
+	}
+	annotations := map[string]string{
+		revisionDeployedAtAnnotation: time.Now().UTC().Format(time.RFC3339),
+		revisionDeployedByAnnotation: crud.Annotations[apiv1.ChangedByAnnotation],
+	}
+
+	switch {
+	case current != nil && current.Revision == latest:
+		// already the newest revision
+
+	case current != nil:
+		logger.Info("rolling out previous revision again", "revision", current.Revision, "newRevision", latest+1)
+		patch := client.MergeFrom(current.DeepCopy())
+		current.Revision = latest + 1
+		current.Annotations = annotations
+		if err := r.Patch(ctx, current, patch); err != nil {
+			return errors.Wrap(err, "could not update revision")
+		}
+
+	default:
+		raw, err := json.Marshal(data)
+		if err != nil {
+			return errors.Wrap(err, "could not encode revision")
+		}
+		revision := apps.ControllerRevision{
+			ObjectMeta: meta.ObjectMeta{
+				Name:        name,
+				Namespace:   crud.Namespace,
+				Labels:      crud.LabelSelectors(),
+				Annotations: annotations,
+			},
+			Data:     runtime.RawExtension{Raw: raw},
+			Revision: latest + 1,
+		}
+		if err := controllerutil.SetControllerReference(crud, &revision, r.Scheme); err != nil {
+			return errors.Wrap(err, "could not set owner reference on revision")
+		}
+		logger.Info("recording revision", "revision", revision.Revision, "image", data.Image)
+		if err := r.Create(ctx, &revision); err != nil && !apierrors.IsAlreadyExists(err) {
+			return errors.Wrap(err, "could not create revision")
+		}
+		revisions = append(revisions, revision)
+		current = &revisions[len(revisions)-1]
+	}
+	crud.Status.Revision = current.Revision
+	if err := r.consumeDestructiveChangesAllowance(ctx, crud); err != nil {
+		return err
+	}
+
+	return r.pruneRevisions(ctx, logger, crud, revisions)
+}
+
+// pruneRevisions deletes the oldest revisions beyond the history limit.
+func (r *CRUDReconciler) pruneRevisions(ctx context.Context, logger logr.Logger, crud *apiv1.CRUD, revisions []apps.ControllerRevision) error {
+	sort.Slice(revisions, func(i, j int) bool {
+		return revisions[i].Revision < revisions[j].Revision
+	})
+	limit := int(*crud.Spec.RevisionHistoryLimit)
+	for i := 0; i < len(revisions)-limit; i++ {
+		revision := &revisions[i]
+		if revision.Revision == crud.Status.Revision {
+			continue
+		}
+		logger.Info("pruning revision", "revision", revision.Revision)
+		if err := r.Delete(ctx, revision); err != nil && !apierrors.IsNotFound(err) {
+			return errors.Wrap(err, "could not delete revision")
+		}
+	}
+	return nil
+}
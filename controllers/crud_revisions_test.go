@@ -0,0 +1,94 @@
+package controllers
+
+import (
+	"context"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	apps "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	apiv1 "github.com/crudgen-org/crudgen-orchestrator/api/v1"
+)
+
+func testScheme() *runtime.Scheme {
+	s := runtime.NewScheme()
+	Expect(clientgoscheme.AddToScheme(s)).To(Succeed())
+	Expect(apiv1.AddToScheme(s)).To(Succeed())
+	return s
+}
+
+var _ = Describe("recordRevision", func() {
+	var (
+		ctx    context.Context
+		logger logr.Logger
+		r      *CRUDReconciler
+		crud   *apiv1.CRUD
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		logger = logf.Log.WithName("test")
+		crud = newTestCRUD()
+		crud.UID = "1234"
+		crud.Annotations = map[string]string{apiv1.ChangedByAnnotation: "alice"}
+		crud.Spec.RevisionHistoryLimit = pointer.Int32Ptr(2)
+		s := testScheme()
+		r = &CRUDReconciler{Client: fake.NewFakeClientWithScheme(s, crud.DeepCopy()), Scheme: s}
+	})
+
+	rollOut := func(hash, image string) {
+		crud.Status.APIDescriptionHash = hash
+		crud.Status.Image = image
+		Expect(r.recordRevision(ctx, logger, crud)).To(Succeed())
+	}
+
+	revisions := func() map[string]int64 {
+		list := &apps.ControllerRevisionList{}
+		Expect(r.List(ctx, list, client.InNamespace(crud.Namespace))).To(Succeed())
+		numbers := map[string]int64{}
+		for _, rev := range list.Items {
+			numbers[rev.Name] = rev.Revision
+		}
+		return numbers
+	}
+
+	It("records each rolled out image once", func() {
+		rollOut("aaa", "registry/todolist@sha256:1")
+		rollOut("aaa", "registry/todolist@sha256:1")
+		rollOut("bbb", "registry/todolist@sha256:2")
+
+		Expect(revisions()).To(HaveLen(2))
+		Expect(crud.Status.Revision).To(Equal(int64(2)))
+
+		list := &apps.ControllerRevisionList{}
+		Expect(r.List(ctx, list)).To(Succeed())
+		for _, rev := range list.Items {
+			Expect(rev.Annotations[revisionDeployedByAnnotation]).To(Equal("alice"))
+			Expect(rev.OwnerReferences).To(HaveLen(1))
+		}
+	})
+
+	It("renumbers a revision rolled out again", func() {
+		rollOut("aaa", "registry/todolist@sha256:1")
+		rollOut("bbb", "registry/todolist@sha256:2")
+		rollOut("aaa", "registry/todolist@sha256:1")
+
+		Expect(crud.Status.Revision).To(Equal(int64(3)))
+		Expect(revisions()).To(ConsistOf(int64(2), int64(3)))
+	})
+
+	It("prunes the revisions beyond the history limit", func() {
+		rollOut("aaa", "registry/todolist@sha256:1")
+		rollOut("bbb", "registry/todolist@sha256:2")
+		rollOut("ccc", "registry/todolist@sha256:3")
+
+		Expect(revisions()).To(ConsistOf(int64(2), int64(3)))
+	})
+})
@@ -0,0 +1,195 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	apps "k8s.io/api/apps/v1"
+	batch "k8s.io/api/batch/v1"
+	core "k8s.io/api/core/v1"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	apiv1 "github.com/crudgen-org/crudgen-orchestrator/api/v1"
+	"github.com/crudgen-org/crudgen-orchestrator/pkg/apidescription"
+)
+
+// checkTablesEmptyScript fails if one of the tables listed in TABLES exists
+// and holds rows.
+const checkTablesEmptyScript = `for table in $TABLES; do
+  rows=$(psql -v ON_ERROR_STOP=1 -tA -v table="$table" <<'EOF'
+SELECT format('SELECT count(*) FROM (SELECT 1 FROM %I LIMIT 1) AS t', :'table') WHERE to_regclass(:'table') IS NOT NULL \gexec
+EOF
+) || exit 1
+  if [ -n "$rows" ] && [ "$rows" != "0" ]; then
+    echo "table $table holds data" >&2
+    exit 1
+  fi
+done`
+
+func rollbackCheckJobName(crud *apiv1.CRUD) string {
+	return fmt.Sprintf("%s-rollback-check", crud.Name)
+}
+
+// reconcileRollback handles the rollback-to annotation. The apiDescription
+// of the requested revision is restored and its image pinned in the status,
+// so that the rest of the reconciliation rolls it out like any other image.
+// The rollback is refused if it would drop tables that hold data; once the
+// tables are checked empty, dropping them is allowed like with the
+// allow-destructive-changes annotation.
+func (r *CRUDReconciler) reconcileRollback(ctx context.Context, logger logr.Logger, crud *apiv1.CRUD) error {
+	request, ok := crud.Annotations[apiv1.RollbackToAnnotation]
+	if !ok {
+		return nil
+	}
+	logger = logger.WithValues("rollbackTo", request)
+
+	number, err := strconv.ParseInt(request, 10, 64)
+	if err != nil || number < 1 {
+		return r.refuseRollback(ctx, logger, crud, "InvalidRevision", fmt.Sprintf("%q is not a revision number", request))
+	}
+	revisions, err := r.listRevisions(ctx, crud)
+	if err != nil {
+		return err
+	}
+	target := findRevision(revisions, number)
+	if target == nil {
+		return r.refuseRollback(ctx, logger, crud, "RevisionNotFound", fmt.Sprintf("revision %d does not exist", number))
+	}
+	data := &revisionData{}
+	if err := json.Unmarshal(target.Data.Raw, data); err != nil {
+		return r.refuseRollback(ctx, logger, crud, "InvalidRevision", fmt.Sprintf("could not decode revision %d: %v", number, err))
+	}
+	desc, err := apidescription.Decode(data.APIDescription)
+	if err != nil {
+		return r.refuseRollback(ctx, logger, crud, "InvalidRevision", fmt.Sprintf("could not decode revision %d: %v", number, err))
+	}
+
+	deployed := revisionDescription(findRevision(revisions, crud.Status.Revision))
+	current, _ := apidescription.Decode(crud.Spec.APIDescription)
+	allowDrop := false
+	if dropped := droppedTables(desc, current, deployed); len(dropped) > 0 {
+		job, err := r.ensureDatabaseJob(ctx, logger, crud, rollbackCheckJobName(crud), checkTablesEmptyScript, []core.EnvVar{
+			{Name: "TABLES", Value: strings.Join(dropped, " ")},
+		})
+		if err != nil || job == nil {
+			return err
+		}
+		cond := jobFinished(job)
+		if cond == nil {
+			return nil
+		}
+		if err := r.deleteJob(ctx, job); err != nil {
+			return err
+		}
+		if cond.Type == batch.JobFailed {
+			return r.refuseRollback(ctx, logger, crud, "DataLoss", fmt.Sprintf(
+				"rolling back to revision %d would drop tables %s, which hold data or could not be checked",
+				number, strings.Join(dropped, ", ")))
+		}
+		// the tables dropped from the revision rolled out are empty, the
+		// allowance is consumed when the rollback is rolled out
+		allowDrop = len(droppedTables(desc, deployed)) > 0
+	}
+
+	logger.Info("rolling back", "revision", number, "image", data.Image)
+	patch := client.MergeFromWithOptions(crud.DeepCopy(), client.MergeFromWithOptimisticLock{})
+	crud.Spec.APIDescription = data.APIDescription
+	delete(crud.Annotations, apiv1.RollbackToAnnotation)
+	if allowDrop {
+		crud.Annotations[apiv1.AllowDestructiveChangesAnnotation] = "true"
+	}
+	if err := r.Patch(ctx, crud, patch); err != nil {
+		return errors.Wrap(err, "could not restore apiDescription")
+	}
+	if err := r.pinImage(ctx, crud, data); err != nil {
+		return err
+	}
+	crud.Status.SetCondition(newCondition(apiv1.ConditionRolledBack, true, "RolledBack",
+		fmt.Sprintf("rolled back to revision %d", number)))
+	return nil
+}
+
+func findRevision(revisions []apps.ControllerRevision, number int64) *apps.ControllerRevision {
+	for i := range revisions {
+		if revisions[i].Revision == number {
+			return &revisions[i]
+		}
+	}
+	return nil
+}
+
+// droppedTables returns the tables of the from descriptions that to does not
+// have. Nil descriptions are skipped.
+func droppedTables(to *apidescription.Description, from ...*apidescription.Description) []string {
+	seen := map[string]bool{}
+	dropped := []string{}
+	for _, desc := range from {
+		if desc == nil {
+			continue
+		}
+		for _, table := range apidescription.DroppedTables(desc, to) {
+			if !seen[table] {
+				seen[table] = true
+				dropped = append(dropped, table)
+			}
+		}
+	}
+	return dropped
+}
+
+// revisionDescription decodes the apiDescription of revision, nil if there
+// is no revision or it cannot be decoded.
+func revisionDescription(revision *apps.ControllerRevision) *apidescription.Description {
+	if revision == nil {
+		return nil
+	}
+	data := &revisionData{}
+	if err := json.Unmarshal(revision.Data.Raw, data); err != nil {
+		return nil
+	}
+	desc, err := apidescription.Decode(data.APIDescription)
+	if err != nil {
+		return nil
+	}
+	return desc
+}
+
+// pinImage records the image of a revision as the image of crud, whatever
+// builder is in use.
+func (r *CRUDReconciler) pinImage(ctx context.Context, crud *apiv1.CRUD, data *revisionData) error {
+	crud.Status.Image = data.Image
+	crud.Status.Port = data.Port
+	crud.Status.APIDescriptionHash = data.APIDescriptionHash
+	crud.Status.ImageReady = true
+	crud.Status.Build = apiv1.BuildStatus{}
+
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		latest := &apiv1.CRUD{}
+		if err := r.Get(ctx, key(crud), latest); err != nil {
+			return err
+		}
+		base := latest.DeepCopy()
+		copyImageStatus(&crud.Status, &latest.Status)
+		latest.Status.Port = crud.Status.Port
+		return r.Status().Patch(ctx, latest, client.MergeFromWithOptions(base, client.MergeFromWithOptimisticLock{}))
+	})
+	return errors.Wrap(err, "could not pin image")
+}
+
+// refuseRollback reports why a rollback was refused and drops the request.
+func (r *CRUDReconciler) refuseRollback(ctx context.Context, logger logr.Logger, crud *apiv1.CRUD, reason, message string) error {
+	logger.Info("refusing rollback", "reason", reason, "message", message)
+	patch := client.MergeFromWithOptions(crud.DeepCopy(), client.MergeFromWithOptimisticLock{})
+	delete(crud.Annotations, apiv1.RollbackToAnnotation)
+	if err := r.Patch(ctx, crud, patch); err != nil {
+		return errors.Wrap(err, "could not remove rollback request")
+	}
+	crud.Status.SetCondition(newCondition(apiv1.ConditionRolledBack, false, reason, message))
+	return nil
+}
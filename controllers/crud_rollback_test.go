@@ -0,0 +1,176 @@
+package controllers
+
+import (
+	"context"
+	"strings"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	apps "k8s.io/api/apps/v1"
+	batch "k8s.io/api/batch/v1"
+	core "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	apiv1 "github.com/crudgen-org/crudgen-orchestrator/api/v1"
+	"github.com/crudgen-org/crudgen-orchestrator/pkg/apidescription"
+)
+
+var _ = Describe("reconcileRollback", func() {
+	const (
+		oldImage = "registry/todolist@sha256:1"
+		newImage = "registry/todolist@sha256:2"
+	)
+
+	var (
+		ctx    context.Context
+		logger logr.Logger
+		r      *CRUDReconciler
+		crud   *apiv1.CRUD
+	)
+
+	// withModel adds a model to the test description.
+	withModel := func(name string) string {
+		return strings.Replace(testDescription, `"models": [{`,
+			`"models": [{"name": "`+name+`", "fields": [{"name": "label", "field_type": "TextField"}], "serializers": []}, {`, 1)
+	}
+
+	hash := func(description string) string {
+		hash, err := apidescription.Hash(description)
+		Expect(err).NotTo(HaveOccurred())
+		return hash
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		logger = logf.Log.WithName("test")
+		crud = newTestCRUD()
+		crud.UID = "1234"
+		crud.Spec.RevisionHistoryLimit = pointer.Int32Ptr(10)
+		secret := &core.Secret{
+			ObjectMeta: meta.ObjectMeta{Namespace: crud.Namespace, Name: crud.DatabaseSecretName()},
+			Data:       map[string][]byte{apiv1.DatabaseURLKey: []byte("psql://u:p@db/d")},
+		}
+		s := testScheme()
+		r = &CRUDReconciler{
+			Client:   &applyClient{fake.NewFakeClientWithScheme(s, crud, secret)},
+			Scheme:   s,
+			Recorder: record.NewFakeRecorder(10),
+		}
+
+		// revision 1 runs the test description, revision 2 adds a model
+		crud.Status.APIDescriptionHash, crud.Status.Image = hash(testDescription), oldImage
+		Expect(r.recordRevision(ctx, logger, crud)).To(Succeed())
+		crud.Spec.APIDescription = withModel("Tag")
+		crud.Status.APIDescriptionHash, crud.Status.Image = hash(withModel("Tag")), newImage
+		Expect(r.recordRevision(ctx, logger, crud)).To(Succeed())
+		Expect(r.Update(ctx, crud)).To(Succeed())
+	})
+
+	requestRollback := func(revision string) {
+		crud.Annotations = map[string]string{apiv1.RollbackToAnnotation: revision}
+		Expect(r.Update(ctx, crud)).To(Succeed())
+		Expect(r.reconcileRollback(ctx, logger, crud)).To(Succeed())
+	}
+
+	It("refuses unknown revisions", func() {
+		requestRollback("7")
+
+		Expect(crud.Annotations).NotTo(HaveKey(apiv1.RollbackToAnnotation))
+		cond := crud.Status.GetCondition(apiv1.ConditionRolledBack)
+		Expect(cond.Status).To(Equal(core.ConditionFalse))
+		Expect(cond.Reason).To(Equal("RevisionNotFound"))
+	})
+
+	It("restores the description and pins the image of the revision", func() {
+		// revision 3 drops the model added by revision 2
+		crud.Spec.APIDescription = testDescription
+		crud.Status.APIDescriptionHash, crud.Status.Image = "ccc", "registry/todolist@sha256:3"
+		Expect(r.recordRevision(ctx, logger, crud)).To(Succeed())
+		Expect(r.Update(ctx, crud)).To(Succeed())
+
+		requestRollback("2")
+
+		latest := &apiv1.CRUD{}
+		Expect(r.Get(ctx, key(crud), latest)).To(Succeed())
+		Expect(latest.Spec.APIDescription).To(Equal(withModel("Tag")))
+		Expect(latest.Annotations).NotTo(HaveKey(apiv1.RollbackToAnnotation))
+		Expect(latest.Status.Image).To(Equal(newImage))
+		Expect(latest.Status.APIDescriptionHash).To(Equal(hash(withModel("Tag"))))
+		Expect(latest.Status.ImageReady).To(BeTrue())
+		Expect(crud.Status.IsConditionTrue(apiv1.ConditionRolledBack)).To(BeTrue())
+	})
+
+	// finish completes, or fails, the job name
+	finish := func(name string, condition batch.JobConditionType) {
+		job := &batch.Job{}
+		jobKey := key(crud)
+		jobKey.Name = name
+		Expect(r.Get(ctx, jobKey, job)).To(Succeed())
+		job.Status.Conditions = []batch.JobCondition{{Type: condition, Status: core.ConditionTrue}}
+		Expect(r.Update(ctx, job)).To(Succeed())
+	}
+
+	It("checks that the dropped tables are empty", func() {
+		requestRollback("1")
+
+		job := &batch.Job{}
+		jobKey := key(crud)
+		jobKey.Name = rollbackCheckJobName(crud)
+		Expect(r.Get(ctx, jobKey, job)).To(Succeed())
+		Expect(job.Spec.Template.Spec.Containers[0].Env).To(ContainElement(core.EnvVar{Name: "TABLES", Value: "todo_tag"}))
+
+		finish(rollbackCheckJobName(crud), batch.JobFailed)
+		Expect(r.reconcileRollback(ctx, logger, crud)).To(Succeed())
+
+		Expect(crud.Annotations).NotTo(HaveKey(apiv1.RollbackToAnnotation))
+		Expect(crud.Spec.APIDescription).To(Equal(withModel("Tag")))
+		Expect(crud.Status.GetCondition(apiv1.ConditionRolledBack).Reason).To(Equal("DataLoss"))
+	})
+
+	It("rolls out a rollback that drops empty tables", func() {
+		requestRollback("1")
+		finish(rollbackCheckJobName(crud), batch.JobComplete)
+		Expect(r.reconcileRollback(ctx, logger, crud)).To(Succeed())
+		Expect(crud.Spec.APIDescription).To(Equal(testDescription))
+		Expect(crud.Annotations).To(HaveKeyWithValue(apiv1.AllowDestructiveChangesAnnotation, "true"))
+
+		desc, errs := crud.ParseAPIDescription()
+		Expect(errs).To(BeEmpty())
+		compatible, err := r.checkSchemaChanges(ctx, logger, crud, desc)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(compatible).To(BeTrue())
+		Expect(crud.Status.GetCondition(apiv1.ConditionSchemaCompatible).Reason).To(Equal("DestructiveChangesAllowed"))
+
+		// the pinned image is rolled out once migrated
+		Expect(r.ensureDeployment(ctx, logger, crud)).To(Succeed())
+		finish(migrationJobName(crud, oldImage), batch.JobComplete)
+		Expect(r.ensureDeployment(ctx, logger, crud)).To(Succeed())
+
+		deploy := &apps.Deployment{}
+		deployKey := key(crud)
+		deployKey.Name = crud.DeploymentName()
+		Expect(r.Get(ctx, deployKey, deploy)).To(Succeed())
+		Expect(deploy.Spec.Template.Spec.Containers[0].Image).To(Equal(oldImage))
+		Expect(crud.Status.Revision).To(Equal(int64(3)))
+		latest := &apiv1.CRUD{}
+		Expect(r.Get(ctx, key(crud), latest)).To(Succeed())
+		Expect(latest.Annotations).NotTo(HaveKey(apiv1.AllowDestructiveChangesAnnotation))
+	})
+
+	It("does not allow the drop of tables that were never rolled out", func() {
+		// the description adds a model that revision 2 does not have
+		crud.Spec.APIDescription = withModel("Note")
+		Expect(r.Update(ctx, crud)).To(Succeed())
+
+		requestRollback("2")
+		finish(rollbackCheckJobName(crud), batch.JobComplete)
+		Expect(r.reconcileRollback(ctx, logger, crud)).To(Succeed())
+		Expect(crud.Spec.APIDescription).To(Equal(withModel("Tag")))
+		Expect(crud.Annotations).NotTo(HaveKey(apiv1.AllowDestructiveChangesAnnotation))
+	})
+})
@@ -0,0 +1,127 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	core "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	apiv1 "github.com/crudgen-org/crudgen-orchestrator/api/v1"
+	"github.com/crudgen-org/crudgen-orchestrator/pkg/apidescription"
+)
+
+// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+
+// checkSchemaChanges diffs the apiDescription against the one of the
+// revision rolled out and records the changes in the status. It reports
+// whether the description may be rolled out: destructive changes need the
+// allow-destructive-changes annotation.
+func (r *CRUDReconciler) checkSchemaChanges(ctx context.Context, logger logr.Logger, crud *apiv1.CRUD, desc *apidescription.Description) (bool, error) {
+	revisions, err := r.listRevisions(ctx, crud)
+	if err != nil {
+		return false, err
+	}
+	revision := findRevision(revisions, crud.Status.Revision)
+	if revision == nil {
+		crud.Status.SchemaChanges = nil
+		r.setSchemaCondition(crud, newCondition(apiv1.ConditionSchemaCompatible, true, "FirstRevision",
+			"no revision rolled out yet"))
+		return true, nil
+	}
+	data := &revisionData{}
+	if err := json.Unmarshal(revision.Data.Raw, data); err != nil {
+		return false, errors.Wrapf(err, "could not decode revision %d", revision.Revision)
+	}
+	deployed, err := apidescription.Decode(data.APIDescription)
+	if err != nil {
+		return false, errors.Wrapf(err, "could not decode revision %d", revision.Revision)
+	}
+
+	changes := apidescription.Diff(deployed, desc)
+	crud.Status.SchemaChanges = make([]apiv1.SchemaChange, 0, len(changes))
+	destructive := []string{}
+	for _, change := range changes {
+		crud.Status.SchemaChanges = append(crud.Status.SchemaChanges, apiv1.SchemaChange{
+			Kind:    apiv1.SchemaChangeKind(change.Kind),
+			Path:    change.Path,
+			Message: change.Message,
+		})
+		if change.Kind == apidescription.Destructive {
+			destructive = append(destructive, fmt.Sprintf("%s: %s", change.Path, change.Message))
+		}
+	}
+	if len(crud.Status.SchemaChanges) == 0 {
+		crud.Status.SchemaChanges = nil
+	}
+
+	switch {
+	case len(destructive) == 0:
+		r.setSchemaCondition(crud, newCondition(apiv1.ConditionSchemaCompatible, true, "NoDestructiveChanges",
+			fmt.Sprintf("%d changes from revision %d", len(changes), revision.Revision)))
+		return true, nil
+
+	case crud.Annotations[apiv1.AllowDestructiveChangesAnnotation] == "true":
+		r.setSchemaCondition(crud, newCondition(apiv1.ConditionSchemaCompatible, true, "DestructiveChangesAllowed",
+			fmt.Sprintf("destructive changes from revision %d allowed: %s", revision.Revision, strings.Join(destructive, "; "))))
+		return true, nil
+
+	default:
+		logger.Info("refusing destructive changes", "revision", revision.Revision, "changes", destructive)
+		r.setSchemaCondition(crud, newCondition(apiv1.ConditionSchemaCompatible, false, "DestructiveChanges",
+			fmt.Sprintf("destructive changes from revision %d, set the %s annotation to \"true\" to roll them out: %s",
+				revision.Revision, apiv1.AllowDestructiveChangesAnnotation, strings.Join(destructive, "; "))))
+		return false, nil
+	}
+}
+
+// setSchemaCondition sets the SchemaCompatible condition and reports it in
+// an event when its message changes.
+func (r *CRUDReconciler) setSchemaCondition(crud *apiv1.CRUD, cond apiv1.Condition) {
+	if previous := crud.Status.GetCondition(cond.Type); previous == nil || previous.Message != cond.Message {
+		eventType := core.EventTypeNormal
+		if cond.Status != core.ConditionTrue {
+			eventType = core.EventTypeWarning
+		}
+		if cond.Reason != "FirstRevision" {
+			r.Recorder.Event(crud, eventType, cond.Reason, cond.Message)
+		}
+	}
+	cond.ObservedGeneration = crud.Generation
+	crud.Status.SetCondition(cond)
+}
+
+// schemaCompatible reports whether the apiDescription may be rolled out.
+func schemaCompatible(crud *apiv1.CRUD) bool {
+	cond := crud.Status.GetCondition(apiv1.ConditionSchemaCompatible)
+	return cond == nil || cond.Status == core.ConditionTrue
+}
+
+// consumeDestructiveChangesAllowance removes the allow-destructive-changes
+// annotation once destructive changes have been rolled out, so that it does
+// not allow the next ones.
+func (r *CRUDReconciler) consumeDestructiveChangesAllowance(ctx context.Context, crud *apiv1.CRUD) error {
+	if _, ok := crud.Annotations[apiv1.AllowDestructiveChangesAnnotation]; !ok {
+		return nil
+	}
+	destructive := false
+	for _, change := range crud.Status.SchemaChanges {
+		destructive = destructive || change.Kind == apiv1.SchemaChangeDestructive
+	}
+	if !destructive {
+		return nil
+	}
+	// patch a copy, the status of crud is not written yet
+	latest := crud.DeepCopy()
+	patch := client.MergeFrom(crud.DeepCopy())
+	delete(latest.Annotations, apiv1.AllowDestructiveChangesAnnotation)
+	if err := r.Patch(ctx, latest, patch); err != nil {
+		return errors.Wrap(err, "could not remove allow-destructive-changes annotation")
+	}
+	crud.Annotations = latest.Annotations
+	return nil
+}
@@ -0,0 +1,102 @@
+package controllers
+
+import (
+	"context"
+	"strings"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	core "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	apiv1 "github.com/crudgen-org/crudgen-orchestrator/api/v1"
+)
+
+var _ = Describe("checkSchemaChanges", func() {
+	var (
+		ctx      context.Context
+		logger   logr.Logger
+		recorder *record.FakeRecorder
+		r        *CRUDReconciler
+		crud     *apiv1.CRUD
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		logger = logf.Log.WithName("test")
+		crud = newTestCRUD()
+		crud.UID = "1234"
+		crud.Spec.RevisionHistoryLimit = pointer.Int32Ptr(10)
+		s := testScheme()
+		recorder = record.NewFakeRecorder(10)
+		r = &CRUDReconciler{Client: fake.NewFakeClientWithScheme(s, crud), Scheme: s, Recorder: recorder}
+	})
+
+	check := func(description string) bool {
+		crud.Spec.APIDescription = description
+		desc, errs := crud.ParseAPIDescription()
+		Expect(errs).To(BeEmpty())
+		compatible, err := r.checkSchemaChanges(ctx, logger, crud, desc)
+		Expect(err).NotTo(HaveOccurred())
+		return compatible
+	}
+
+	It("accepts any description before the first rollout", func() {
+		Expect(check(testDescription)).To(BeTrue())
+		Expect(crud.Status.GetCondition(apiv1.ConditionSchemaCompatible).Reason).To(Equal("FirstRevision"))
+		Expect(crud.Status.SchemaChanges).To(BeEmpty())
+	})
+
+	Context("once a revision is rolled out", func() {
+		BeforeEach(func() {
+			crud.Status.APIDescriptionHash, crud.Status.Image = "aaa", "registry/todolist@sha256:1"
+			Expect(r.recordRevision(ctx, logger, crud)).To(Succeed())
+		})
+
+		It("accepts additive changes", func() {
+			Expect(check(strings.Replace(testDescription, `"fields": [`,
+				`"fields": [{"name": "due", "field_type": "DateField"}, `, 1))).To(BeTrue())
+
+			Expect(crud.Status.SchemaChanges).To(Equal([]apiv1.SchemaChange{{
+				Kind:    apiv1.SchemaChangeAdditive,
+				Path:    "apps[todo].models[List].fields[due]",
+				Message: "DateField added",
+			}}))
+			Expect(crud.Status.GetCondition(apiv1.ConditionSchemaCompatible).Reason).To(Equal("NoDestructiveChanges"))
+		})
+
+		It("blocks destructive changes until they are allowed", func() {
+			narrowed := strings.Replace(testDescription, `"max_length": 30`, `"max_length": 10`, 1)
+			Expect(check(narrowed)).To(BeFalse())
+
+			cond := crud.Status.GetCondition(apiv1.ConditionSchemaCompatible)
+			Expect(cond.Status).To(Equal(core.ConditionFalse))
+			Expect(cond.Reason).To(Equal("DestructiveChanges"))
+			Expect(cond.Message).To(ContainSubstring("apps[todo].models[List].fields[title].max_length"))
+			Expect(schemaCompatible(crud)).To(BeFalse())
+			Expect(recorder.Events).To(Receive(HavePrefix("Warning DestructiveChanges")))
+
+			// reconciling again does not repeat the event
+			Expect(check(narrowed)).To(BeFalse())
+			Expect(recorder.Events).NotTo(Receive())
+
+			crud.Annotations = map[string]string{apiv1.AllowDestructiveChangesAnnotation: "true"}
+			Expect(r.Update(ctx, crud)).To(Succeed())
+			Expect(check(narrowed)).To(BeTrue())
+			Expect(crud.Status.GetCondition(apiv1.ConditionSchemaCompatible).Reason).To(Equal("DestructiveChangesAllowed"))
+
+			// rolling the changes out consumes the allowance
+			crud.Status.APIDescriptionHash, crud.Status.Image = "bbb", "registry/todolist@sha256:2"
+			Expect(r.recordRevision(ctx, logger, crud)).To(Succeed())
+			latest := &apiv1.CRUD{}
+			Expect(r.Get(ctx, key(crud), latest)).To(Succeed())
+			Expect(latest.Annotations).NotTo(HaveKey(apiv1.AllowDestructiveChangesAnnotation))
+			Expect(check(narrowed)).To(BeTrue())
+			Expect(crud.Status.SchemaChanges).To(BeEmpty())
+		})
+	})
+})
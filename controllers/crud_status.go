@@ -0,0 +1,242 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	apps "k8s.io/api/apps/v1"
+	core "k8s.io/api/core/v1"
+	networking "k8s.io/api/networking/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+
+	apiv1 "github.com/crudgen-org/crudgen-orchestrator/api/v1"
+)
+
+// updateConditions derives every condition of the CRUD from the current
+// state of the objects it owns. descErr is the validation error of the API
+// description, if any.
+func (r *CRUDReconciler) updateConditions(ctx context.Context, crud *apiv1.CRUD, descErr error) error {
+	conditions := []apiv1.Condition{imageCondition(crud)}
+	for _, derive := range []func(context.Context, *apiv1.CRUD) (apiv1.Condition, error){
+		r.databaseCondition,
+		r.deploymentCondition,
+		r.ingressCondition,
+		r.certificateCondition,
+	} {
+		cond, err := derive(ctx, crud)
+		if err != nil {
+			return err
+		}
+		conditions = append(conditions, cond)
+	}
+	blocking := conditions
+	for _, conditionType := range []string{apiv1.ConditionMigrationFailed, apiv1.ConditionRestoring, apiv1.ConditionUpgrading} {
+		// set by ensureDeployment, reconcileRestore and
+		// reconcileDatabaseUpgrade, True when the API cannot serve
+		if cond := crud.Status.GetCondition(conditionType); cond != nil && cond.Status == core.ConditionTrue {
+			blocking = append(blocking[:len(blocking):len(blocking)], newCondition(cond.Type, false, cond.Reason, cond.Message))
+		}
+	}
+	if cond := crud.Status.GetCondition(apiv1.ConditionSchemaCompatible); cond != nil {
+		// set by checkSchemaChanges
+		blocking = append(blocking[:len(blocking):len(blocking)], *cond)
+	}
+	conditions = append(conditions, readyCondition(blocking, descErr))
+
+	for _, cond := range conditions {
+		cond.ObservedGeneration = crud.Generation
+		crud.Status.SetCondition(cond)
+	}
+	crud.Status.ObservedGeneration = crud.Generation
+	crud.Status.Deployed = crud.Status.IsConditionTrue(apiv1.ConditionDeploymentAvailable)
+	return nil
+}
+
+// copyReconcilerStatus copies the status fields written by the reconciler.
+// The remaining fields belong to the image builder, see copyImageStatus.
+func copyReconcilerStatus(from, to *apiv1.CRUDStatus) {
+	to.ObservedGeneration = from.ObservedGeneration
+	to.Deployed = from.Deployed
+	to.Port = from.Port
+	to.Database = from.Database
+	to.Revision = from.Revision
+	to.SchemaChanges = from.SchemaChanges
+	for _, cond := range from.Conditions {
+		to.SetCondition(cond)
+	}
+}
+
+// copyImageStatus copies the status fields written by the image builder.
+func copyImageStatus(from, to *apiv1.CRUDStatus) {
+	to.ImageReady = from.ImageReady
+	to.Image = from.Image
+	to.APIDescriptionHash = from.APIDescriptionHash
+	to.Build = from.Build
+}
+
+func newCondition(conditionType string, ok bool, reason, message string) apiv1.Condition {
+	status := core.ConditionFalse
+	if ok {
+		status = core.ConditionTrue
+	}
+	return apiv1.Condition{
+		Type:    conditionType,
+		Status:  status,
+		Reason:  reason,
+		Message: message,
+	}
+}
+
+func imageCondition(crud *apiv1.CRUD) apiv1.Condition {
+	switch build := crud.Status.Build; {
+	case build.Phase == apiv1.BuildFailed:
+		return newCondition(apiv1.ConditionImageReady, false, "BuildFailed", build.Message)
+	case build.Phase == apiv1.BuildRunning:
+		return newCondition(apiv1.ConditionImageReady, false, "Building", "building image "+build.APIDescriptionHash)
+	case crud.Status.Image == "":
+		return newCondition(apiv1.ConditionImageReady, false, "ImageNotReady", "waiting for the image to be built")
+	case !imageUpToDate(crud):
+		return newCondition(apiv1.ConditionImageReady, false, "ImageStale",
+			"image "+crud.Status.Image+" was not built from the current apiDescription")
+	}
+	return newCondition(apiv1.ConditionImageReady, true, "ImageAvailable", crud.Status.Image)
+}
+
+func (r *CRUDReconciler) databaseCondition(ctx context.Context, crud *apiv1.CRUD) (apiv1.Condition, error) {
+	if crud.Spec.Database.Mode == apiv1.DatabaseModePool && crud.Status.Database.Pool == "" {
+		return newCondition(apiv1.ConditionDatabaseReady, false, "NoPoolAvailable",
+			"no database pool has room for the database"), nil
+	}
+	if !crud.InCluster() {
+		if crud.Status.Database.Server == "" {
+			return newCondition(apiv1.ConditionDatabaseReady, false, "DatabaseCreating",
+				"creating the database on the external server"), nil
+		}
+		return newCondition(apiv1.ConditionDatabaseReady, true, "ExternalDatabase", crud.Status.Database.Server), nil
+	}
+
+	key := key(crud)
+	key.Name = crud.DatabaseStatefulName()
+
+	sts := &apps.StatefulSet{}
+	switch err := r.Get(ctx, key, sts); {
+	case apierrors.IsNotFound(err):
+		return newCondition(apiv1.ConditionDatabaseReady, false, "StatefulSetNotFound", "database statefulset does not exist"), nil
+	case err != nil:
+		return apiv1.Condition{}, errors.Wrap(err, "could not retrieve statefulset")
+	}
+
+	desired := int32(1)
+	if sts.Spec.Replicas != nil {
+		desired = *sts.Spec.Replicas
+	}
+	replicas := fmt.Sprintf("%d of %d database replicas ready", sts.Status.ReadyReplicas, desired)
+
+	// the API only needs the primary, the standbys may lag behind
+	primary := crud.Status.Database.Primary
+	if primary == "" {
+		return newCondition(apiv1.ConditionDatabaseReady, false, "StatefulSetNotReady", replicas), nil
+	}
+	key.Name = primary
+	pod := &core.Pod{}
+	switch err := r.PodReader.Get(ctx, key, pod); {
+	case apierrors.IsNotFound(err):
+		return newCondition(apiv1.ConditionDatabaseReady, false, "PrimaryNotReady",
+			fmt.Sprintf("primary %s does not exist, %s", primary, replicas)), nil
+	case err != nil:
+		return apiv1.Condition{}, errors.Wrap(err, "could not retrieve database primary")
+	}
+	if ready, _ := podReady(pod); !ready || pod.Labels[apiv1.DatabaseRoleLabel] != apiv1.DatabaseRolePrimary {
+		return newCondition(apiv1.ConditionDatabaseReady, false, "PrimaryNotReady",
+			fmt.Sprintf("primary %s is not ready, %s", primary, replicas)), nil
+	}
+	return newCondition(apiv1.ConditionDatabaseReady, true, "PrimaryReady",
+		fmt.Sprintf("primary %s, %s", primary, replicas)), nil
+}
+
+func (r *CRUDReconciler) deploymentCondition(ctx context.Context, crud *apiv1.CRUD) (apiv1.Condition, error) {
+	key := key(crud)
+	key.Name = crud.DeploymentName()
+
+	deploy := &apps.Deployment{}
+	switch err := r.Get(ctx, key, deploy); {
+	case apierrors.IsNotFound(err):
+		return newCondition(apiv1.ConditionDeploymentAvailable, false, "DeploymentNotFound", "deployment does not exist"), nil
+	case err != nil:
+		return apiv1.Condition{}, errors.Wrap(err, "could not retrieve deployment")
+	}
+
+	if deploy.Status.ObservedGeneration < deploy.Generation {
+		return newCondition(apiv1.ConditionDeploymentAvailable, false, "DeploymentProgressing", "deployment spec not yet observed"), nil
+	}
+	for _, cond := range deploy.Status.Conditions {
+		if cond.Type != apps.DeploymentAvailable {
+			continue
+		}
+		return newCondition(apiv1.ConditionDeploymentAvailable, cond.Status == core.ConditionTrue, cond.Reason, cond.Message), nil
+	}
+	return newCondition(apiv1.ConditionDeploymentAvailable, false, "DeploymentProgressing", "deployment has not reported availability"), nil
+}
+
+func (r *CRUDReconciler) ingressCondition(ctx context.Context, crud *apiv1.CRUD) (apiv1.Condition, error) {
+	ingress := &networking.Ingress{}
+	switch err := r.Get(ctx, key(crud), ingress); {
+	case apierrors.IsNotFound(err):
+		return newCondition(apiv1.ConditionIngressReady, false, "IngressNotFound", "ingress does not exist"), nil
+	case err != nil:
+		return apiv1.Condition{}, errors.Wrap(err, "could not retrieve ingress")
+	}
+
+	if len(ingress.Status.LoadBalancer.Ingress) == 0 {
+		return newCondition(apiv1.ConditionIngressReady, false, "LoadBalancerPending", "ingress has no address yet"), nil
+	}
+	addresses := []string{}
+	for _, lb := range ingress.Status.LoadBalancer.Ingress {
+		if lb.IP != "" {
+			addresses = append(addresses, lb.IP)
+		} else {
+			addresses = append(addresses, lb.Hostname)
+		}
+	}
+	return newCondition(apiv1.ConditionIngressReady, true, "LoadBalancerAssigned", strings.Join(addresses, ",")), nil
+}
+
+func (r *CRUDReconciler) certificateCondition(ctx context.Context, crud *apiv1.CRUD) (apiv1.Condition, error) {
+	if !crud.Spec.EnableTLS {
+		return newCondition(apiv1.ConditionCertificateReady, true, "TLSDisabled", "TLS is disabled"), nil
+	}
+
+	key := key(crud)
+	key.Name = crud.TLSSecretName()
+
+	secret := &core.Secret{}
+	switch err := r.Get(ctx, key, secret); {
+	case apierrors.IsNotFound(err):
+		return newCondition(apiv1.ConditionCertificateReady, false, "CertificatePending", "waiting for the certificate to be issued"), nil
+	case err != nil:
+		return apiv1.Condition{}, errors.Wrap(err, "could not retrieve tls secret")
+	}
+
+	if len(secret.Data[core.TLSCertKey]) == 0 {
+		return newCondition(apiv1.ConditionCertificateReady, false, "CertificatePending", "tls secret has no certificate"), nil
+	}
+	return newCondition(apiv1.ConditionCertificateReady, true, "CertificateIssued", secret.Name), nil
+}
+
+func readyCondition(conditions []apiv1.Condition, descErr error) apiv1.Condition {
+	if descErr != nil {
+		return newCondition(apiv1.ConditionReady, false, "InvalidAPIDescription", descErr.Error())
+	}
+	notReady := []string{}
+	for _, cond := range conditions {
+		if cond.Status != core.ConditionTrue {
+			notReady = append(notReady, cond.Type)
+		}
+	}
+	if len(notReady) > 0 {
+		return newCondition(apiv1.ConditionReady, false, "NotReady", "not ready: "+strings.Join(notReady, ", "))
+	}
+	return newCondition(apiv1.ConditionReady, true, "Ready", "all components are ready")
+}
@@ -0,0 +1,306 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	apps "k8s.io/api/apps/v1"
+	batch "k8s.io/api/batch/v1"
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/pointer"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	apiv1 "github.com/crudgen-org/crudgen-orchestrator/api/v1"
+)
+
+// restorePollInterval is how often a restore waiting for the CRUD is checked
+// again.
+const restorePollInterval = 10 * time.Second
+
+// restoreScript replaces the content of the database with the backup in
+// BACKUP_FILE, in a single transaction. Owners and privileges are those of
+// the target database, so that a backup of another CRUD can be restored.
+const restoreScript = `pg_restore --clean --if-exists --no-owner --no-acl --single-transaction --exit-on-error \
+  --dbname="$PGDATABASE" "$BACKUP_FILE"`
+
+// s3DownloadScript downloads the backup BACKUP to BACKUP_DIR.
+const s3DownloadScript = s3Script + `mc cp "$target$BACKUP" "$BACKUP_DIR/"`
+
+// CRUDRestoreReconciler reconciles a CRUDRestore object
+type CRUDRestoreReconciler struct {
+	client.Client
+	Log    logr.Logger
+	Scheme *runtime.Scheme
+
+	// BackupImage provides the minio client downloading backups from S3.
+	BackupImage string
+}
+
+// +kubebuilder:rbac:groups=api.crudgen.org,resources=crudrestores,verbs=get;list;watch
+// +kubebuilder:rbac:groups=api.crudgen.org,resources=crudrestores/status,verbs=get;update;patch
+
+func (r *CRUDRestoreReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
+	ctx := context.Background()
+	logger := r.Log.WithValues("crudrestore", req.NamespacedName)
+
+	restore := &apiv1.CRUDRestore{}
+	switch err := r.Get(ctx, req.NamespacedName, restore); {
+	case apierrors.IsNotFound(err):
+		return ctrl.Result{}, nil
+	case err != nil:
+		logger.Error(err, "could not retrieve crudrestore object")
+		return ctrl.Result{}, err
+	}
+	if restore.Status.Finished() {
+		return ctrl.Result{}, nil
+	}
+
+	base := restore.DeepCopy()
+	result, err := r.reconcile(ctx, logger, restore)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if !equality.Semantic.DeepEqual(base.Status, restore.Status) {
+		if err := r.Status().Patch(ctx, restore, client.MergeFrom(base)); err != nil {
+			return ctrl.Result{}, errors.Wrap(err, "could not update crudrestore status")
+		}
+	}
+	return result, nil
+}
+
+// reconcile moves the restore one phase forward: it takes hold of the CRUD
+// through the restore annotation, waits for the API to be scaled down, runs
+// the restore job and then releases the CRUD.
+func (r *CRUDRestoreReconciler) reconcile(ctx context.Context, logger logr.Logger, restore *apiv1.CRUDRestore) (ctrl.Result, error) {
+	wait := ctrl.Result{RequeueAfter: restorePollInterval}
+
+	crud := &apiv1.CRUD{}
+	switch err := r.Get(ctx, types.NamespacedName{Namespace: restore.Namespace, Name: restore.Spec.CRUD}, crud); {
+	case apierrors.IsNotFound(err):
+		setRestorePhase(restore, apiv1.RestorePending, fmt.Sprintf("waiting for CRUD %s", restore.Spec.CRUD))
+		return wait, nil
+	case err != nil:
+		return ctrl.Result{}, errors.Wrap(err, "could not retrieve crud")
+	}
+	crud.SetDefaults()
+
+	source := restore.Spec.Source.DeepCopy()
+	if source == nil && crud.Spec.Database.Backup != nil {
+		source = &crud.Spec.Database.Backup.Destination
+	}
+	if source != nil {
+		source.SetDefaults()
+	}
+	if source == nil || (source.PersistentVolumeClaim == nil) == (source.S3 == nil) {
+		setRestorePhase(restore, apiv1.RestoreFailed, "exactly one of persistentVolumeClaim and s3 must be set in the source, "+
+			"or in the backup destination of the CRUD")
+		return ctrl.Result{}, nil
+	}
+
+	switch holder := crud.Annotations[apiv1.RestoreAnnotation]; {
+	case holder != "" && holder != restore.Name:
+		setRestorePhase(restore, apiv1.RestorePending, fmt.Sprintf("waiting for restore %s to complete", holder))
+		return wait, nil
+
+	case holder == "" && crud.Status.IsConditionTrue(apiv1.ConditionUpgrading):
+		setRestorePhase(restore, apiv1.RestorePending, fmt.Sprintf("waiting for the database upgrade of CRUD %s", crud.Name))
+		return wait, nil
+
+	case holder == "" && !crud.Status.IsConditionTrue(apiv1.ConditionDatabaseReady):
+		setRestorePhase(restore, apiv1.RestorePending, fmt.Sprintf("waiting for the database of CRUD %s", crud.Name))
+		return wait, nil
+
+	case holder == "":
+		logger.Info("scaling down the API", "crud", crud.Name)
+		patch := client.MergeFromWithOptions(crud.DeepCopy(), client.MergeFromWithOptimisticLock{})
+		if crud.Annotations == nil {
+			crud.Annotations = map[string]string{}
+		}
+		crud.Annotations[apiv1.RestoreAnnotation] = restore.Name
+		if err := r.Patch(ctx, crud, patch); err != nil {
+			return ctrl.Result{}, errors.Wrap(err, "could not annotate crud")
+		}
+		now := meta.Now()
+		restore.Status.StartTime = &now
+		setRestorePhase(restore, apiv1.RestoreScalingDown, "waiting for the API to be scaled down")
+		return wait, nil
+	}
+
+	key := key(crud)
+	key.Name = crud.DeploymentName()
+	deploy := &apps.Deployment{}
+	switch err := r.Get(ctx, key, deploy); {
+	case apierrors.IsNotFound(err):
+		deploy = nil
+	case err != nil:
+		return ctrl.Result{}, errors.Wrap(err, "could not retrieve deployment")
+	case deploy.Spec.Replicas == nil || *deploy.Spec.Replicas != 0 || deploy.Status.Replicas != 0:
+		setRestorePhase(restore, apiv1.RestoreScalingDown, "waiting for the API to be scaled down")
+		return wait, nil
+	}
+
+	key = types.NamespacedName{Namespace: restore.Namespace, Name: restore.JobName()}
+	job := &batch.Job{}
+	switch err := r.Get(ctx, key, job); {
+	case apierrors.IsNotFound(err):
+		job = r.restoreJob(restore, crud, source, deploy)
+		if err := controllerutil.SetControllerReference(restore, job, r.Scheme); err != nil {
+			return ctrl.Result{}, errors.Wrap(err, "could not set owner reference on restore job")
+		}
+		logger.Info("restoring database", "crud", crud.Name, "backup", restore.Spec.Backup)
+		if err := r.Create(ctx, job); err != nil {
+			return ctrl.Result{}, errors.Wrap(err, "could not create restore job")
+		}
+		setRestorePhase(restore, apiv1.RestoreRunning, "restoring "+restore.Spec.Backup)
+		return ctrl.Result{}, nil
+
+	case err != nil:
+		return ctrl.Result{}, errors.Wrap(err, "could not retrieve restore job")
+	}
+
+	cond := jobFinished(job)
+	if cond == nil {
+		setRestorePhase(restore, apiv1.RestoreRunning, "restoring "+restore.Spec.Backup)
+		return ctrl.Result{}, nil
+	}
+	// scale the API up again either way
+	patch := client.MergeFrom(crud.DeepCopy())
+	delete(crud.Annotations, apiv1.RestoreAnnotation)
+	if err := r.Patch(ctx, crud, patch); err != nil {
+		return ctrl.Result{}, errors.Wrap(err, "could not release crud")
+	}
+	now := meta.Now()
+	restore.Status.CompletionTime = &now
+	if cond.Type == batch.JobFailed {
+		logger.Info("restore failed", "crud", crud.Name, "reason", cond.Reason)
+		setRestorePhase(restore, apiv1.RestoreFailed, fmt.Sprintf("job %s failed: %s", job.Name, cond.Message))
+		return ctrl.Result{}, nil
+	}
+	logger.Info("database restored", "crud", crud.Name, "backup", restore.Spec.Backup)
+	setRestorePhase(restore, apiv1.RestoreSucceeded, "restored "+restore.Spec.Backup)
+	return ctrl.Result{}, nil
+}
+
+func setRestorePhase(restore *apiv1.CRUDRestore, phase apiv1.RestorePhase, message string) {
+	restore.Status.Phase = phase
+	restore.Status.Message = message
+}
+
+// restoreJob downloads the backup if needed, restores it and migrates the
+// database to the image of the API, deploy, when there is one. Each step is
+// an init container of the next one.
+func (r *CRUDRestoreReconciler) restoreJob(restore *apiv1.CRUDRestore, crud *apiv1.CRUD, source *apiv1.BackupDestination, deploy *apps.Deployment) *batch.Job {
+	steps := []core.Container{}
+	var volume core.Volume
+	var dir string
+
+	if s3 := source.S3; s3 != nil {
+		dir = backupDumpDir
+		volume = core.Volume{
+			Name:         "backup",
+			VolumeSource: core.VolumeSource{EmptyDir: &core.EmptyDirVolumeSource{}},
+		}
+		steps = append(steps, core.Container{
+			Name:    "download",
+			Image:   r.BackupImage,
+			Command: []string{"sh", "-c", s3DownloadScript},
+			Env: append([]core.EnvVar{
+				{Name: "BACKUP", Value: restore.Spec.Backup},
+				{Name: "BACKUP_DIR", Value: dir},
+			}, s3Env(s3)...),
+		})
+	} else {
+		dir = backupVolumeDir
+		volume = core.Volume{
+			Name: "backup",
+			VolumeSource: core.VolumeSource{
+				PersistentVolumeClaim: &core.PersistentVolumeClaimVolumeSource{
+					ClaimName: source.PersistentVolumeClaim.ClaimName,
+					ReadOnly:  true,
+				},
+			},
+		}
+	}
+
+	steps = append(steps, core.Container{
+		Name:    "pg-restore",
+		Image:   crud.DatabaseImage(),
+		Command: []string{"sh", "-c", restoreScript},
+		Env: append(databaseClientEnv(crud),
+			core.EnvVar{Name: "BACKUP_FILE", Value: path.Join(dir, restore.Spec.Backup)}),
+	})
+
+	if deploy != nil {
+		for _, container := range deploy.Spec.Template.Spec.Containers {
+			if container.Name != crud.Name {
+				continue
+			}
+			// the backup may come from an older apiDescription
+			steps = append(steps, core.Container{
+				Name:    "migrate",
+				Image:   container.Image,
+				Command: migrateCommand,
+				Env: []core.EnvVar{
+					secretEnv(crud, "DATABASE_URL", apiv1.DatabaseURLKey),
+				},
+			})
+		}
+	}
+
+	for i := range steps {
+		steps[i].VolumeMounts = []core.VolumeMount{{Name: volume.Name, MountPath: dir}}
+		steps[i].TerminationMessagePolicy = core.TerminationMessageFallbackToLogsOnError
+	}
+	return &batch.Job{
+		ObjectMeta: meta.ObjectMeta{
+			Name:      restore.JobName(),
+			Namespace: restore.Namespace,
+		},
+		Spec: batch.JobSpec{
+			// a failed restore is retried by creating another CRUDRestore
+			BackoffLimit: pointer.Int32Ptr(0),
+			Template: core.PodTemplateSpec{
+				Spec: core.PodSpec{
+					RestartPolicy:  core.RestartPolicyNever,
+					InitContainers: steps[:len(steps)-1],
+					Containers:     steps[len(steps)-1:],
+					Volumes:        []core.Volume{volume},
+				},
+			},
+		},
+	}
+}
+
+func (r *CRUDRestoreReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&apiv1.CRUDRestore{}).
+		Owns(&batch.Job{}).
+		Complete(r)
+}
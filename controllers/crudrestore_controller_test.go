@@ -0,0 +1,188 @@
+package controllers
+
+import (
+	"context"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	apps "k8s.io/api/apps/v1"
+	batch "k8s.io/api/batch/v1"
+	core "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/pointer"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	apiv1 "github.com/crudgen-org/crudgen-orchestrator/api/v1"
+)
+
+var _ = Describe("CRUDRestore", func() {
+	const image = "registry/todolist@sha256:1"
+
+	var (
+		ctx     context.Context
+		logger  logr.Logger
+		r       *CRUDRestoreReconciler
+		crudR   *CRUDReconciler
+		crud    *apiv1.CRUD
+		restore *apiv1.CRUDRestore
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		logger = logf.Log.WithName("test")
+		crud = newTestCRUD()
+		crud.Spec.Database.Backup = &apiv1.DatabaseBackupSpec{
+			Schedule: "0 3 * * *",
+			Destination: apiv1.BackupDestination{
+				PersistentVolumeClaim: &apiv1.PVCBackupDestination{ClaimName: "backups"},
+			},
+		}
+		crud.SetDefaults()
+		// the restore takes hold of the CRUD with an optimistic lock
+		crud.ResourceVersion = "1"
+		crud.Status.SetCondition(newCondition(apiv1.ConditionDatabaseReady, true, "StatefulSetReady", "1 of 1 database replicas ready"))
+
+		deploy := &apps.Deployment{
+			ObjectMeta: meta.ObjectMeta{Namespace: crud.Namespace, Name: crud.DeploymentName()},
+			Spec: apps.DeploymentSpec{
+				Replicas: pointer.Int32Ptr(2),
+				Template: core.PodTemplateSpec{
+					Spec: core.PodSpec{
+						Containers: []core.Container{{Name: crud.Name, Image: image}},
+					},
+				},
+			},
+			Status: apps.DeploymentStatus{Replicas: 2},
+		}
+		restore = &apiv1.CRUDRestore{
+			ObjectMeta: meta.ObjectMeta{Namespace: crud.Namespace, Name: "clone"},
+			Spec:       apiv1.CRUDRestoreSpec{CRUD: crud.Name, Backup: "production-20210102030000.dump"},
+		}
+		s := testScheme()
+		c := fake.NewFakeClientWithScheme(s, crud.DeepCopy(), deploy, restore.DeepCopy())
+		r = &CRUDRestoreReconciler{Client: c, Log: logger, Scheme: s, BackupImage: "minio/mc"}
+		crudR = &CRUDReconciler{Client: c, Scheme: s}
+	})
+
+	reconcile := func(name string) *apiv1.CRUDRestore {
+		_, err := r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Namespace: crud.Namespace, Name: name}})
+		Expect(err).NotTo(HaveOccurred())
+		latest := &apiv1.CRUDRestore{}
+		Expect(r.Get(ctx, types.NamespacedName{Namespace: crud.Namespace, Name: name}, latest)).To(Succeed())
+		return latest
+	}
+
+	reconcileCRUD := func() bool {
+		latest := &apiv1.CRUD{}
+		Expect(r.Get(ctx, key(crud), latest)).To(Succeed())
+		latest.SetDefaults()
+		latest.Status = crud.Status
+		restoring, err := crudR.reconcileRestore(ctx, logger, latest)
+		Expect(err).NotTo(HaveOccurred())
+		crud = latest
+		return restoring
+	}
+
+	deployment := func() *apps.Deployment {
+		deploy := &apps.Deployment{}
+		deployKey := key(crud)
+		deployKey.Name = crud.DeploymentName()
+		Expect(r.Get(ctx, deployKey, deploy)).To(Succeed())
+		return deploy
+	}
+
+	restoreJob := func() *batch.Job {
+		job := &batch.Job{}
+		Expect(r.Get(ctx, types.NamespacedName{Namespace: crud.Namespace, Name: restore.JobName()}, job)).To(Succeed())
+		return job
+	}
+
+	It("scales the API down while the backup is restored", func() {
+		Expect(reconcile("clone").Status.Phase).To(Equal(apiv1.RestoreScalingDown))
+
+		Expect(reconcileCRUD()).To(BeTrue())
+		Expect(crud.Annotations).To(HaveKeyWithValue(apiv1.RestoreAnnotation, "clone"))
+		Expect(crud.Status.IsConditionTrue(apiv1.ConditionRestoring)).To(BeTrue())
+		deploy := deployment()
+		Expect(*deploy.Spec.Replicas).To(BeZero())
+
+		// the pods are still terminating
+		Expect(reconcile("clone").Status.Phase).To(Equal(apiv1.RestoreScalingDown))
+		deploy.Status.Replicas = 0
+		Expect(r.Update(ctx, deploy)).To(Succeed())
+
+		Expect(reconcile("clone").Status.Phase).To(Equal(apiv1.RestoreRunning))
+		pod := restoreJob().Spec.Template.Spec
+		Expect(pod.InitContainers).To(HaveLen(1))
+		Expect(pod.InitContainers[0].Name).To(Equal("pg-restore"))
+		Expect(pod.InitContainers[0].Env).To(ContainElement(core.EnvVar{
+			Name: "BACKUP_FILE", Value: backupVolumeDir + "/production-20210102030000.dump",
+		}))
+		Expect(pod.Containers[0].Name).To(Equal("migrate"))
+		Expect(pod.Containers[0].Image).To(Equal(image))
+		Expect(pod.Volumes[0].PersistentVolumeClaim.ClaimName).To(Equal("backups"))
+
+		job := restoreJob()
+		job.Status.Conditions = []batch.JobCondition{{Type: batch.JobComplete, Status: core.ConditionTrue}}
+		Expect(r.Update(ctx, job)).To(Succeed())
+		latest := reconcile("clone")
+		Expect(latest.Status.Phase).To(Equal(apiv1.RestoreSucceeded))
+		Expect(latest.Status.StartTime).NotTo(BeNil())
+		Expect(latest.Status.CompletionTime).NotTo(BeNil())
+
+		Expect(reconcileCRUD()).To(BeFalse())
+		Expect(crud.Annotations).NotTo(HaveKey(apiv1.RestoreAnnotation))
+		Expect(crud.Status.GetCondition(apiv1.ConditionRestoring).Reason).To(Equal("RestoreFinished"))
+		Expect(*deployment().Spec.Replicas).To(Equal(*crud.Spec.Autoscaling.MinReplicas))
+	})
+
+	It("downloads the backup of another CRUD from S3", func() {
+		source := &apiv1.BackupDestination{
+			S3: &apiv1.S3BackupDestination{Bucket: "backups", Prefix: "production", CredentialsSecret: "minio"},
+		}
+		restore.Spec.Source = source
+		pod := r.restoreJob(restore, crud, source, nil).Spec.Template.Spec
+
+		Expect(pod.InitContainers).To(HaveLen(1))
+		download := pod.InitContainers[0]
+		Expect(download.Image).To(Equal("minio/mc"))
+		Expect(download.Env).To(ContainElements(s3Env(source.S3)))
+		Expect(pod.Containers[0].Name).To(Equal("pg-restore"))
+		Expect(pod.Containers[0].VolumeMounts[0].MountPath).To(Equal(backupDumpDir))
+		Expect(pod.Volumes[0].EmptyDir).NotTo(BeNil())
+	})
+
+	It("waits for the restore holding the CRUD", func() {
+		Expect(reconcile("clone").Status.Phase).To(Equal(apiv1.RestoreScalingDown))
+
+		other := restore.DeepCopy()
+		other.Name = "other"
+		Expect(r.Create(ctx, other)).To(Succeed())
+		latest := reconcile("other")
+		Expect(latest.Status.Phase).To(Equal(apiv1.RestorePending))
+		Expect(latest.Status.Message).To(ContainSubstring("clone"))
+	})
+
+	It("drops the annotation of a deleted restore", func() {
+		Expect(reconcile("clone").Status.Phase).To(Equal(apiv1.RestoreScalingDown))
+		Expect(reconcileCRUD()).To(BeTrue())
+		Expect(r.Delete(ctx, restore)).To(Succeed())
+
+		Expect(reconcileCRUD()).To(BeFalse())
+		Expect(crud.Annotations).NotTo(HaveKey(apiv1.RestoreAnnotation))
+		Expect(*deployment().Spec.Replicas).To(Equal(*crud.Spec.Autoscaling.MinReplicas))
+	})
+
+	It("fails without a source", func() {
+		crud.Spec.Database.Backup = nil
+		Expect(r.Update(ctx, crud.DeepCopy())).NotTo(HaveOccurred())
+
+		latest := reconcile("clone")
+		Expect(latest.Status.Phase).To(Equal(apiv1.RestoreFailed))
+		Expect(latest.Status.Finished()).To(BeTrue())
+	})
+})
@@ -0,0 +1,108 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	apiv1 "github.com/crudgen-org/crudgen-orchestrator/api/v1"
+)
+
+// DatabasePoolReconciler reconciles a DatabasePool object. Databases are
+// allocated by the CRUD reconciler; this one releases the allocations of
+// deleted CRUDs and reports which databases are ready.
+type DatabasePoolReconciler struct {
+	client.Client
+	Log    logr.Logger
+	Scheme *runtime.Scheme
+}
+
+// +kubebuilder:rbac:groups=api.crudgen.org,resources=databasepools,verbs=get;list;watch
+// +kubebuilder:rbac:groups=api.crudgen.org,resources=databasepools/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=api.crudgen.org,resources=cruds,verbs=get;list;watch
+
+func (r *DatabasePoolReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
+	ctx := context.Background()
+	logger := r.Log.WithValues("databasepool", req.Name)
+
+	pool := &apiv1.DatabasePool{}
+	switch err := r.Get(ctx, req.NamespacedName, pool); {
+	case apierrors.IsNotFound(err):
+		return ctrl.Result{}, nil
+	case err != nil:
+		logger.Error(err, "could not retrieve databasepool object")
+		return ctrl.Result{}, err
+	}
+
+	base := pool.DeepCopy()
+	databases := pool.Status.Databases[:0:0]
+	for _, db := range pool.Status.Databases {
+		crud := &apiv1.CRUD{}
+		switch err := r.Get(ctx, types.NamespacedName{Namespace: db.Namespace, Name: db.CRUD}, crud); {
+		case apierrors.IsNotFound(err):
+			logger.Info("releasing database of deleted CRUD", "namespace", db.Namespace, "crud", db.CRUD)
+			continue
+		case err != nil:
+			return ctrl.Result{}, errors.Wrap(err, "could not retrieve crud")
+		}
+		// a CRUD that has not recorded its allocation yet keeps it
+		if crud.Status.Database.Pool != "" && crud.Status.Database.Pool != pool.Name {
+			continue
+		}
+		db.Ready = crud.Status.Database.Server != ""
+		databases = append(databases, db)
+	}
+	pool.Status.Databases = databases
+	pool.Status.Allocated = int32(len(databases))
+	pool.Status.Available = poolRoom(pool)
+
+	if !equality.Semantic.DeepEqual(base.Status, pool.Status) {
+		// the lock keeps allocations made meanwhile by the CRUD reconciler
+		patch := client.MergeFromWithOptions(base, client.MergeFromWithOptimisticLock{})
+		if err := r.Status().Patch(ctx, pool, patch); err != nil {
+			return ctrl.Result{}, errors.Wrap(err, "could not update databasepool status")
+		}
+	}
+	return ctrl.Result{}, nil
+}
+
+func (r *DatabasePoolReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&apiv1.DatabasePool{}).
+		Watches(&source.Kind{Type: &apiv1.CRUD{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: handler.ToRequestsFunc(func(o handler.MapObject) []reconcile.Request {
+				crud, ok := o.Object.(*apiv1.CRUD)
+				if !ok || crud.Status.Database.Pool == "" {
+					return nil
+				}
+				return []reconcile.Request{{NamespacedName: types.NamespacedName{Name: crud.Status.Database.Pool}}}
+			}),
+		}).
+		Complete(r)
+}
@@ -0,0 +1,67 @@
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	core "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	apiv1 "github.com/crudgen-org/crudgen-orchestrator/api/v1"
+)
+
+var _ = Describe("DatabasePoolReconciler", func() {
+	It("releases the databases of deleted CRUDs and reports the ready ones", func() {
+		ctx := context.Background()
+
+		ready := newTestCRUD()
+		ready.Name = "ready"
+		ready.Status.Database.Pool = "shared"
+		ready.Status.Database.Server = "db.example.com:5432"
+		creating := newTestCRUD()
+		creating.Name = "creating"
+		moved := newTestCRUD()
+		moved.Name = "moved"
+		moved.Status.Database.Pool = "other"
+
+		pool := &apiv1.DatabasePool{
+			ObjectMeta: meta.ObjectMeta{Name: "shared", ResourceVersion: "1"},
+			Spec: apiv1.DatabasePoolSpec{
+				AdminSecret:  core.SecretReference{Namespace: "db", Name: "admin"},
+				MaxDatabases: 5,
+			},
+			Status: apiv1.DatabasePoolStatus{
+				Allocated: 4,
+				Available: 1,
+				Databases: []apiv1.PoolDatabase{
+					{Namespace: ready.Namespace, CRUD: "ready"},
+					{Namespace: ready.Namespace, CRUD: "creating"},
+					{Namespace: ready.Namespace, CRUD: "moved"},
+					{Namespace: ready.Namespace, CRUD: "deleted"},
+				},
+			},
+		}
+
+		s := testScheme()
+		r := &DatabasePoolReconciler{
+			Client: fake.NewFakeClientWithScheme(s, pool, ready, creating, moved),
+			Log:    logf.Log.WithName("test"),
+			Scheme: s,
+		}
+		_, err := r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Name: "shared"}})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(r.Get(ctx, types.NamespacedName{Name: "shared"}, pool)).To(Succeed())
+		Expect(pool.Status.Databases).To(Equal([]apiv1.PoolDatabase{
+			{Namespace: ready.Namespace, CRUD: "ready", Ready: true},
+			{Namespace: ready.Namespace, CRUD: "creating"},
+		}))
+		Expect(pool.Status.Allocated).To(Equal(int32(2)))
+		Expect(pool.Status.Available).To(Equal(int32(3)))
+	})
+})
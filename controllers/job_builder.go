@@ -0,0 +1,265 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	batch "k8s.io/api/batch/v1"
+	core "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	apiv1 "github.com/crudgen-org/crudgen-orchestrator/api/v1"
+)
+
+const (
+	// buildHashLabel marks build jobs with the hash of the description they
+	// build.
+	buildHashLabel = "api.crudgen.org/build-hash"
+	// buildLogTailLines is how much of the logs of a failed build ends up in
+	// the ImageReady condition.
+	buildLogTailLines = 20
+	buildWorkspace    = "/workspace"
+)
+
+// +kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch
+
+var _ Builder = &JobBuilder{}
+
+// JobBuilder builds the image of a CRUD in a Job of its namespace. The
+// generator image gets the description in the API_DESCRIPTION environment
+// variable and must write a docker build context to /workspace, which
+// kaniko then builds and pushes to Registry.
+type JobBuilder struct {
+	client.Client
+	// PodReader reads the build pods directly from the API server, so that
+	// the manager does not cache every pod of the cluster.
+	PodReader client.Reader
+	Scheme    *runtime.Scheme
+
+	Registry       string
+	GeneratorImage string
+	KanikoImage    string
+	// PushSecret is the name of a docker config secret, in the namespace
+	// of the CRUD, holding the credentials to push to Registry.
+	PushSecret string
+}
+
+func buildJobName(crud *apiv1.CRUD, hash string) string {
+	return fmt.Sprintf("%s-build-%s", crud.Name, hash[:10])
+}
+
+func (b *JobBuilder) repository(crud *apiv1.CRUD) string {
+	return fmt.Sprintf("%s/%s-%s", strings.TrimSuffix(b.Registry, "/"), crud.Namespace, crud.Name)
+}
+
+func (b *JobBuilder) buildLabels(crud *apiv1.CRUD, hash string) map[string]string {
+	labels := crud.LabelSelectors()
+	labels[buildHashLabel] = hash[:16]
+	return labels
+}
+
+// Submit implements Builder. It also deletes the jobs of previous builds.
+func (b *JobBuilder) Submit(ctx context.Context, crud *apiv1.CRUD, hash string) error {
+	jobs := &batch.JobList{}
+	if err := b.List(ctx, jobs, client.InNamespace(crud.Namespace), client.MatchingLabels(crud.LabelSelectors()),
+		client.HasLabels{buildHashLabel}); err != nil {
+		return errors.Wrap(err, "could not list build jobs")
+	}
+	for i := range jobs.Items {
+		job := &jobs.Items[i]
+		if job.Name == buildJobName(crud, hash) {
+			continue
+		}
+		if err := b.Delete(ctx, job, client.PropagationPolicy(meta.DeletePropagationBackground)); err != nil && !apierrors.IsNotFound(err) {
+			return errors.Wrapf(err, "could not delete build job %s", job.Name)
+		}
+	}
+
+	job := b.buildJob(crud, hash)
+	if err := controllerutil.SetControllerReference(crud, job, b.Scheme); err != nil {
+		return errors.Wrap(err, "could not set owner reference on build job")
+	}
+	if err := b.Create(ctx, job); err != nil && !apierrors.IsAlreadyExists(err) {
+		return errors.Wrap(err, "could not create build job")
+	}
+	return nil
+}
+
+func (b *JobBuilder) buildJob(crud *apiv1.CRUD, hash string) *batch.Job {
+	workspace := []core.VolumeMount{{Name: "workspace", MountPath: buildWorkspace}}
+	volumes := []core.Volume{{
+		Name:         "workspace",
+		VolumeSource: core.VolumeSource{EmptyDir: &core.EmptyDirVolumeSource{}},
+	}}
+	kanikoMounts := workspace
+	if b.PushSecret != "" {
+		kanikoMounts = append(kanikoMounts, core.VolumeMount{Name: "docker-config", MountPath: "/kaniko/.docker"})
+		volumes = append(volumes, core.Volume{
+			Name: "docker-config",
+			VolumeSource: core.VolumeSource{
+				Secret: &core.SecretVolumeSource{
+					SecretName: b.PushSecret,
+					Items: []core.KeyToPath{
+						{Key: core.DockerConfigJsonKey, Path: "config.json"},
+					},
+				},
+			},
+		})
+	}
+
+	return &batch.Job{
+		ObjectMeta: meta.ObjectMeta{
+			Name:      buildJobName(crud, hash),
+			Namespace: crud.Namespace,
+			Labels:    b.buildLabels(crud, hash),
+		},
+		Spec: batch.JobSpec{
+			BackoffLimit: pointer.Int32Ptr(2),
+			Template: core.PodTemplateSpec{
+				Spec: core.PodSpec{
+					RestartPolicy: core.RestartPolicyNever,
+					InitContainers: []core.Container{
+						{
+							Name:  "generate",
+							Image: b.GeneratorImage,
+							Env: []core.EnvVar{
+								{Name: "API_DESCRIPTION", Value: crud.Spec.APIDescription},
+							},
+							VolumeMounts:             workspace,
+							TerminationMessagePolicy: core.TerminationMessageFallbackToLogsOnError,
+						},
+					},
+					Containers: []core.Container{
+						{
+							Name:  "kaniko",
+							Image: b.KanikoImage,
+							Args: []string{
+								"--context=dir://" + buildWorkspace,
+								fmt.Sprintf("--destination=%s:%s", b.repository(crud), hash[:16]),
+								// the digest becomes the termination message of
+								// the container, where Poll reads it
+								"--digest-file=" + core.TerminationMessagePathDefault,
+							},
+							VolumeMounts:             kanikoMounts,
+							TerminationMessagePolicy: core.TerminationMessageFallbackToLogsOnError,
+						},
+					},
+					Volumes: volumes,
+				},
+			},
+		},
+	}
+}
+
+// Poll implements Builder. The message of a failed build is the tail of the
+// logs of the container that failed.
+func (b *JobBuilder) Poll(ctx context.Context, crud *apiv1.CRUD, hash string) (*BuildResult, error) {
+	key := key(crud)
+	key.Name = buildJobName(crud, hash)
+
+	job := &batch.Job{}
+	switch err := b.Get(ctx, key, job); {
+	case apierrors.IsNotFound(err):
+		return nil, ErrBuildNotFound
+	case err != nil:
+		return nil, errors.Wrap(err, "could not retrieve build job")
+	}
+
+	for _, cond := range job.Status.Conditions {
+		if cond.Status != core.ConditionTrue {
+			continue
+		}
+		switch cond.Type {
+		case batch.JobComplete:
+			return b.buildResult(ctx, crud, job)
+		case batch.JobFailed:
+			message, err := b.failureMessage(ctx, job)
+			if err != nil {
+				return nil, err
+			}
+			if message == "" {
+				message = cond.Message
+			}
+			return nil, &BuildFailedError{Message: message}
+		}
+	}
+	return nil, nil
+}
+
+func (b *JobBuilder) listBuildPods(ctx context.Context, job *batch.Job) (*core.PodList, error) {
+	pods := &core.PodList{}
+	if err := b.PodReader.List(ctx, pods, client.InNamespace(job.Namespace), client.MatchingLabels{"job-name": job.Name}); err != nil {
+		return nil, errors.Wrap(err, "could not list build pods")
+	}
+	return pods, nil
+}
+
+func (b *JobBuilder) buildResult(ctx context.Context, crud *apiv1.CRUD, job *batch.Job) (*BuildResult, error) {
+	pods, err := b.listBuildPods(ctx, job)
+	if err != nil {
+		return nil, err
+	}
+	for _, pod := range pods.Items {
+		if pod.Status.Phase != core.PodSucceeded {
+			continue
+		}
+		for _, status := range pod.Status.ContainerStatuses {
+			terminated := status.State.Terminated
+			if status.Name != "kaniko" || terminated == nil || terminated.ExitCode != 0 {
+				continue
+			}
+			digest := strings.TrimSpace(terminated.Message)
+			if !strings.HasPrefix(digest, "sha256:") {
+				return nil, &BuildFailedError{Message: fmt.Sprintf("build reported an invalid image digest %q", digest)}
+			}
+			desc, errs := crud.ParseAPIDescription()
+			if len(errs) > 0 {
+				return nil, errs.ToAggregate()
+			}
+			return &BuildResult{
+				Image: b.repository(crud) + "@" + digest,
+				Port:  desc.DeployStrategy.Port,
+			}, nil
+		}
+	}
+	return nil, &BuildFailedError{Message: "build completed without reporting an image digest"}
+}
+
+// failureMessage returns the tail of the logs of the last container that
+// failed in the build pods.
+func (b *JobBuilder) failureMessage(ctx context.Context, job *batch.Job) (string, error) {
+	pods, err := b.listBuildPods(ctx, job)
+	if err != nil {
+		return "", err
+	}
+	var message string
+	var finishedAt meta.Time
+	for _, pod := range pods.Items {
+		statuses := append(append([]core.ContainerStatus{}, pod.Status.InitContainerStatuses...), pod.Status.ContainerStatuses...)
+		for _, status := range statuses {
+			terminated := status.State.Terminated
+			if terminated == nil || terminated.ExitCode == 0 || terminated.FinishedAt.Before(&finishedAt) {
+				continue
+			}
+			finishedAt = terminated.FinishedAt
+			message = fmt.Sprintf("%s exited with code %d: %s", status.Name, terminated.ExitCode, tail(terminated.Message, buildLogTailLines))
+		}
+	}
+	return message, nil
+}
+
+// tail returns the last n lines of s.
+func tail(s string, n int) string {
+	lines := strings.Split(strings.TrimRight(s, "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,167 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	batch "k8s.io/api/batch/v1"
+	core "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	apiv1 "github.com/crudgen-org/crudgen-orchestrator/api/v1"
+	"github.com/crudgen-org/crudgen-orchestrator/pkg/apidescription"
+)
+
+var _ = Describe("JobBuilder", func() {
+	var (
+		ctx     context.Context
+		builder *JobBuilder
+		crud    *apiv1.CRUD
+		hash    string
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		crud = newTestCRUD()
+		crud.UID = "1234"
+		var err error
+		hash, err = apidescription.Hash(crud.Spec.APIDescription)
+		Expect(err).NotTo(HaveOccurred())
+
+		s := testScheme()
+		c := fake.NewFakeClientWithScheme(s)
+		builder = &JobBuilder{
+			Client:         c,
+			PodReader:      c,
+			Scheme:         s,
+			Registry:       "registry.example.com/apis/",
+			GeneratorImage: "crudgen/generator:1",
+			KanikoImage:    "gcr.io/kaniko-project/executor:v1.0.0",
+			PushSecret:     "registry-push",
+		}
+	})
+
+	job := func() *batch.Job {
+		job := &batch.Job{}
+		jobKey := key(crud)
+		jobKey.Name = buildJobName(crud, hash)
+		Expect(builder.Get(ctx, jobKey, job)).To(Succeed())
+		return job
+	}
+
+	// finish marks the build job with condition and creates its pod with
+	// the given container statuses
+	finish := func(condition batch.JobConditionType, phase core.PodPhase, init []core.ContainerStatus, containers ...core.ContainerStatus) {
+		j := job()
+		j.Status.Conditions = []batch.JobCondition{{Type: condition, Status: core.ConditionTrue, Message: "BackoffLimitExceeded"}}
+		Expect(builder.Update(ctx, j)).To(Succeed())
+		Expect(builder.Create(ctx, &core.Pod{
+			ObjectMeta: meta.ObjectMeta{
+				Namespace: crud.Namespace,
+				Name:      j.Name + "-x1",
+				Labels:    map[string]string{"job-name": j.Name},
+			},
+			Status: core.PodStatus{Phase: phase, InitContainerStatuses: init, ContainerStatuses: containers},
+		})).To(Succeed())
+	}
+
+	terminated := func(name string, code int32, message string, finishedAt time.Time) core.ContainerStatus {
+		return core.ContainerStatus{Name: name, State: core.ContainerState{Terminated: &core.ContainerStateTerminated{
+			ExitCode: code, Message: message, FinishedAt: meta.NewTime(finishedAt),
+		}}}
+	}
+
+	It("generates the build context and builds it with kaniko", func() {
+		Expect(builder.Submit(ctx, crud, hash)).To(Succeed())
+
+		j := job()
+		Expect(j.Labels).To(HaveKeyWithValue(buildHashLabel, hash[:16]))
+		Expect(j.OwnerReferences).To(HaveLen(1))
+		pod := j.Spec.Template.Spec
+		Expect(pod.RestartPolicy).To(Equal(core.RestartPolicyNever))
+
+		generate := pod.InitContainers[0]
+		Expect(generate.Image).To(Equal("crudgen/generator:1"))
+		Expect(generate.Env).To(ContainElement(core.EnvVar{Name: "API_DESCRIPTION", Value: crud.Spec.APIDescription}))
+		Expect(generate.VolumeMounts).To(ContainElement(core.VolumeMount{Name: "workspace", MountPath: buildWorkspace}))
+
+		kaniko := pod.Containers[0]
+		Expect(kaniko.Image).To(Equal("gcr.io/kaniko-project/executor:v1.0.0"))
+		Expect(kaniko.Args).To(ConsistOf(
+			"--context=dir:///workspace",
+			"--destination=registry.example.com/apis/default-todolist:"+hash[:16],
+			"--digest-file=/dev/termination-log",
+		))
+		Expect(kaniko.VolumeMounts).To(ContainElement(core.VolumeMount{Name: "docker-config", MountPath: "/kaniko/.docker"}))
+		Expect(pod.Volumes[1].Secret.SecretName).To(Equal("registry-push"))
+	})
+
+	It("replaces the jobs of previous builds", func() {
+		previous, err := apidescription.Hash(strings.Replace(testDescription, "8080", "8081", 1))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(builder.Submit(ctx, crud, previous)).To(Succeed())
+		Expect(builder.Submit(ctx, crud, hash)).To(Succeed())
+		Expect(builder.Submit(ctx, crud, hash)).To(Succeed())
+
+		jobs := &batch.JobList{}
+		Expect(builder.List(ctx, jobs)).To(Succeed())
+		Expect(jobs.Items).To(HaveLen(1))
+		Expect(jobs.Items[0].Name).To(Equal(buildJobName(crud, hash)))
+	})
+
+	It("reports an unknown build", func() {
+		_, err := builder.Poll(ctx, crud, hash)
+		Expect(err).To(Equal(ErrBuildNotFound))
+	})
+
+	It("reads the digest of the image from the termination message", func() {
+		Expect(builder.Submit(ctx, crud, hash)).To(Succeed())
+		result, err := builder.Poll(ctx, crud, hash)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(BeNil())
+
+		finish(batch.JobComplete, core.PodSucceeded, nil, terminated("kaniko", 0, "sha256:abcd\n", time.Now()))
+		result, err = builder.Poll(ctx, crud, hash)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(&BuildResult{Image: "registry.example.com/apis/default-todolist@sha256:abcd", Port: 8080}))
+	})
+
+	It("fails a build without a digest", func() {
+		Expect(builder.Submit(ctx, crud, hash)).To(Succeed())
+		finish(batch.JobComplete, core.PodSucceeded, nil, terminated("kaniko", 0, "done", time.Now()))
+		_, err := builder.Poll(ctx, crud, hash)
+		Expect(err).To(BeAssignableToTypeOf(&BuildFailedError{}))
+		Expect(err.Error()).To(ContainSubstring("invalid image digest"))
+	})
+
+	It("reports the tail of the logs of the container that failed last", func() {
+		Expect(builder.Submit(ctx, crud, hash)).To(Succeed())
+		logs := []string{}
+		for i := 1; i <= 30; i++ {
+			logs = append(logs, fmt.Sprintf("line %d", i))
+		}
+		start := time.Now()
+		finish(batch.JobFailed, core.PodFailed,
+			[]core.ContainerStatus{terminated("generate", 2, "invalid description", start)},
+			terminated("kaniko", 1, strings.Join(logs, "\n")+"\n", start.Add(time.Minute)))
+
+		_, err := builder.Poll(ctx, crud, hash)
+		failed, ok := err.(*BuildFailedError)
+		Expect(ok).To(BeTrue())
+		Expect(failed.Message).To(HavePrefix("kaniko exited with code 1: line 11\n"))
+		Expect(failed.Message).To(HaveSuffix("line 30"))
+		Expect(strings.Count(failed.Message, "\n")).To(Equal(buildLogTailLines - 1))
+	})
+
+	It("falls back to the condition of the job without failed containers", func() {
+		Expect(builder.Submit(ctx, crud, hash)).To(Succeed())
+		finish(batch.JobFailed, core.PodFailed, nil)
+		_, err := builder.Poll(ctx, crud, hash)
+		Expect(err).To(Equal(&BuildFailedError{Message: "BackoffLimitExceeded"}))
+	})
+})
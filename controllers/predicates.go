@@ -0,0 +1,40 @@
+package controllers
+
+import (
+	"k8s.io/apimachinery/pkg/api/equality"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	apiv1 "github.com/crudgen-org/crudgen-orchestrator/api/v1"
+)
+
+// crudChangedPredicate skips CRUD updates that only touch the status fields
+// written by the reconciler itself, so that patching the conditions does not
+// trigger another reconcile.
+type crudChangedPredicate struct {
+	predicate.Funcs
+}
+
+func (crudChangedPredicate) Update(e event.UpdateEvent) bool {
+	oldCRUD, ok := e.ObjectOld.(*apiv1.CRUD)
+	if !ok {
+		return true
+	}
+	newCRUD, ok := e.ObjectNew.(*apiv1.CRUD)
+	if !ok {
+		return true
+	}
+	if oldCRUD.Generation != newCRUD.Generation ||
+		!newCRUD.DeletionTimestamp.Equal(oldCRUD.DeletionTimestamp) ||
+		!equality.Semantic.DeepEqual(oldCRUD.Finalizers, newCRUD.Finalizers) ||
+		!equality.Semantic.DeepEqual(oldCRUD.Annotations, newCRUD.Annotations) {
+		return true
+	}
+
+	// compare the status without the fields owned by the reconciler
+	oldStatus, newStatus := oldCRUD.Status.DeepCopy(), newCRUD.Status.DeepCopy()
+	copyReconcilerStatus(&apiv1.CRUDStatus{}, oldStatus)
+	copyReconcilerStatus(&apiv1.CRUDStatus{}, newStatus)
+	oldStatus.Conditions, newStatus.Conditions = nil, nil
+	return !equality.Semantic.DeepEqual(oldStatus, newStatus)
+}
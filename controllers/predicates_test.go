@@ -0,0 +1,59 @@
+package controllers
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	apiv1 "github.com/crudgen-org/crudgen-orchestrator/api/v1"
+)
+
+var _ = Describe("crudChangedPredicate", func() {
+	var old *apiv1.CRUD
+
+	BeforeEach(func() {
+		old = newTestCRUD()
+		old.Generation = 1
+		old.Status.Image, old.Status.ImageReady = "registry/todolist@sha256:1", true
+		old.Status.SetCondition(newCondition(apiv1.ConditionReady, false, "NotReady", ""))
+	})
+
+	changed := func(update func(crud *apiv1.CRUD)) bool {
+		crud := old.DeepCopy()
+		update(crud)
+		return crudChangedPredicate{}.Update(event.UpdateEvent{
+			MetaOld: old, ObjectOld: old, MetaNew: crud, ObjectNew: crud,
+		})
+	}
+
+	It("skips resyncs and the status written by the reconciler", func() {
+		Expect(changed(func(crud *apiv1.CRUD) {})).To(BeFalse())
+		Expect(changed(func(crud *apiv1.CRUD) {
+			crud.ResourceVersion = "2"
+			crud.Status.Deployed = true
+			crud.Status.Revision = 3
+			crud.Status.SetCondition(newCondition(apiv1.ConditionReady, true, "Ready", ""))
+		})).To(BeFalse())
+	})
+
+	It("passes spec changes", func() {
+		Expect(changed(func(crud *apiv1.CRUD) { crud.Generation = 2 })).To(BeTrue())
+	})
+
+	It("passes request annotations, finalizers and deletions", func() {
+		Expect(changed(func(crud *apiv1.CRUD) {
+			crud.Annotations = map[string]string{apiv1.RollbackToAnnotation: "1"}
+		})).To(BeTrue())
+		Expect(changed(func(crud *apiv1.CRUD) { crud.Finalizers = []string{apiv1.CRUDFinalizer} })).To(BeTrue())
+		Expect(changed(func(crud *apiv1.CRUD) {
+			now := meta.Now()
+			crud.DeletionTimestamp = &now
+		})).To(BeTrue())
+	})
+
+	It("passes the image status written by an external builder", func() {
+		Expect(changed(func(crud *apiv1.CRUD) { crud.Status.Image = "registry/todolist@sha256:2" })).To(BeTrue())
+		Expect(changed(func(crud *apiv1.CRUD) { crud.Status.APIDescriptionHash = "abc" })).To(BeTrue())
+	})
+})
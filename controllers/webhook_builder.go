@@ -0,0 +1,251 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	apiv1 "github.com/crudgen-org/crudgen-orchestrator/api/v1"
+)
+
+const (
+	// buildResultAnnotation stores the last result reported by the build
+	// service, so that it survives restarts and reaches the leader whichever
+	// replica received the callback.
+	buildResultAnnotation = "api.crudgen.org/build-result"
+	// SignatureHeader holds the HMAC-SHA256 of the body of the requests
+	// exchanged with the build service, as "sha256=<hex>".
+	SignatureHeader = "X-Crudgen-Signature"
+
+	maxCallbackSize = 1 << 20
+	// maxCallbackAge is how far the timestamp of a callback may be from
+	// the current time, so that a captured callback cannot be replayed
+	// later on.
+	maxCallbackAge = 5 * time.Minute
+)
+
+// BuildRequest is sent to the build service to start a build. The service
+// must ignore a request for a build it is already running.
+type BuildRequest struct {
+	Namespace          string `json:"namespace"`
+	Name               string `json:"name"`
+	APIDescriptionHash string `json:"apiDescriptionHash"`
+	APIDescription     string `json:"apiDescription"`
+	CallbackURL        string `json:"callbackURL"`
+}
+
+// BuildCallback is sent back by the build service once a build is over.
+type BuildCallback struct {
+	Namespace          string `json:"namespace"`
+	Name               string `json:"name"`
+	APIDescriptionHash string `json:"apiDescriptionHash"`
+	Image              string `json:"image,omitempty"`
+	Port               int32  `json:"port,omitempty"`
+	// Error describes why the build failed, with the tail of its logs.
+	Error string `json:"error,omitempty"`
+	// Timestamp is when the callback was sent, in seconds since the epoch.
+	// Callbacks older than a few minutes are rejected.
+	Timestamp int64 `json:"timestamp,omitempty"`
+}
+
+var _ Builder = &WebhookBuilder{}
+
+// WebhookBuilder delegates the builds to an external HTTP build service.
+// Builds are posted to URL and the service reports their result to
+// CallbackURL, served on CallbackAddr. Both ways, the body is signed with
+// Secret in the SignatureHeader.
+type WebhookBuilder struct {
+	client.Client
+	Log        logr.Logger
+	HTTPClient *http.Client
+
+	URL          string
+	CallbackURL  string
+	CallbackAddr string
+	Secret       []byte
+	// Timeout is how long a build may run without a callback before it is
+	// taken as lost and submitted again. Zero waits forever.
+	Timeout time.Duration
+}
+
+func (b *WebhookBuilder) sign(body []byte) string {
+	mac := hmac.New(sha256.New, b.Secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (b *WebhookBuilder) verify(body []byte, signature string) bool {
+	return hmac.Equal([]byte(b.sign(body)), []byte(signature))
+}
+
+// Submit implements Builder.
+func (b *WebhookBuilder) Submit(ctx context.Context, crud *apiv1.CRUD, hash string) error {
+	body, err := json.Marshal(BuildRequest{
+		Namespace:          crud.Namespace,
+		Name:               crud.Name,
+		APIDescriptionHash: hash,
+		APIDescription:     crud.Spec.APIDescription,
+		CallbackURL:        b.CallbackURL,
+	})
+	if err != nil {
+		return errors.Wrap(err, "could not encode build request")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.URL, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "could not create build request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SignatureHeader, b.sign(body))
+
+	resp, err := b.HTTPClient.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "could not submit build")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.Errorf("could not submit build: build service returned %s", resp.Status)
+	}
+	return nil
+}
+
+// Poll implements Builder. It reads the result the build service reported
+// to the callback, if any. A build without a result after Timeout is
+// reported as ErrBuildNotFound, so that it is submitted again.
+func (b *WebhookBuilder) Poll(ctx context.Context, crud *apiv1.CRUD, hash string) (*BuildResult, error) {
+	result := BuildCallback{}
+	if raw, ok := crud.Annotations[buildResultAnnotation]; ok {
+		if err := json.Unmarshal([]byte(raw), &result); err != nil {
+			return nil, errors.Wrap(err, "could not decode build result")
+		}
+	}
+	switch {
+	case result.APIDescriptionHash != hash:
+		// no result yet, or the one of a previous build
+		if b.timedOut(crud) {
+			return nil, ErrBuildNotFound
+		}
+		return nil, nil
+	case result.Error != "":
+		return nil, &BuildFailedError{Message: result.Error}
+	case result.Image == "":
+		return nil, &BuildFailedError{Message: "build service reported no image"}
+	}
+	return &BuildResult{Image: result.Image, Port: result.Port}, nil
+}
+
+// timedOut reports whether the build in the status of crud has been running
+// for longer than Timeout. Builds started before their start time was
+// recorded are timed out right away.
+func (b *WebhookBuilder) timedOut(crud *apiv1.CRUD) bool {
+	start := crud.Status.Build.StartTime
+	return b.Timeout > 0 && (start == nil || time.Since(start.Time) > b.Timeout)
+}
+
+// ServeHTTP receives the callbacks of the build service and stores their
+// result on the CRUD, which triggers its reconciliation.
+func (b *WebhookBuilder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, maxCallbackSize))
+	if err != nil {
+		http.Error(w, "could not read body", http.StatusBadRequest)
+		return
+	}
+	if !b.verify(body, req.Header.Get(SignatureHeader)) {
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+	callback := BuildCallback{}
+	if err := json.Unmarshal(body, &callback); err != nil {
+		http.Error(w, "could not decode body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if callback.Namespace == "" || callback.Name == "" || callback.APIDescriptionHash == "" || callback.Timestamp == 0 {
+		http.Error(w, "namespace, name, apiDescriptionHash and timestamp are required", http.StatusBadRequest)
+		return
+	}
+	if age := time.Since(time.Unix(callback.Timestamp, 0)); age > maxCallbackAge || age < -maxCallbackAge {
+		http.Error(w, "stale callback", http.StatusUnauthorized)
+		return
+	}
+
+	logger := b.Log.WithValues("crud", types.NamespacedName{Namespace: callback.Namespace, Name: callback.Name})
+	if err := b.storeResult(req.Context(), &callback); err != nil {
+		if apierrors.IsNotFound(errors.Cause(err)) {
+			http.Error(w, "crud not found", http.StatusNotFound)
+			return
+		}
+		logger.Error(err, "could not store build result")
+		http.Error(w, "could not store build result", http.StatusInternalServerError)
+		return
+	}
+	logger.Info("build result received", "hash", callback.APIDescriptionHash, "image", callback.Image)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (b *WebhookBuilder) storeResult(ctx context.Context, callback *BuildCallback) error {
+	crud := &apiv1.CRUD{}
+	if err := b.Get(ctx, types.NamespacedName{Namespace: callback.Namespace, Name: callback.Name}, crud); err != nil {
+		return errors.Wrap(err, "could not retrieve crud")
+	}
+	result, err := json.Marshal(BuildCallback{
+		APIDescriptionHash: callback.APIDescriptionHash,
+		Image:              callback.Image,
+		Port:               callback.Port,
+		Error:              callback.Error,
+	})
+	if err != nil {
+		return errors.Wrap(err, "could not encode build result")
+	}
+
+	patch := client.MergeFrom(crud.DeepCopy())
+	if crud.Annotations == nil {
+		crud.Annotations = map[string]string{}
+	}
+	crud.Annotations[buildResultAnnotation] = string(result)
+	if err := b.Patch(ctx, crud, patch); err != nil {
+		return errors.Wrap(err, "could not patch crud")
+	}
+	return nil
+}
+
+// Start serves the callbacks until stop is closed. It implements
+// manager.Runnable.
+func (b *WebhookBuilder) Start(stop <-chan struct{}) error {
+	server := &http.Server{Addr: b.CallbackAddr, Handler: b}
+	errs := make(chan error, 1)
+	go func() {
+		b.Log.Info("serving build callbacks", "addr", b.CallbackAddr)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			errs <- err
+		}
+		close(errs)
+	}()
+
+	select {
+	case <-stop:
+		return server.Shutdown(context.Background())
+	case err := <-errs:
+		return errors.Wrap(err, "could not serve build callbacks")
+	}
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable: every
+// replica can store the results it receives.
+func (b *WebhookBuilder) NeedLeaderElection() bool {
+	return false
+}
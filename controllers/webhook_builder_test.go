@@ -0,0 +1,132 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	apiv1 "github.com/crudgen-org/crudgen-orchestrator/api/v1"
+)
+
+var _ = Describe("WebhookBuilder", func() {
+	var (
+		ctx     context.Context
+		crud    *apiv1.CRUD
+		builder *WebhookBuilder
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		crud = newTestCRUD()
+
+		builder = &WebhookBuilder{
+			Client:      fake.NewFakeClientWithScheme(testScheme(), crud.DeepCopy()),
+			Log:         logf.Log.WithName("test"),
+			HTTPClient:  http.DefaultClient,
+			CallbackURL: "https://orchestrator.example.com/build",
+			Secret:      []byte("s3cr3t"),
+		}
+	})
+
+	// callback sends body as a callback sent now, unless it has a timestamp
+	callback := func(body BuildCallback, signature func([]byte) string) int {
+		if body.Timestamp == 0 {
+			body.Timestamp = time.Now().Unix()
+		}
+		raw, err := json.Marshal(body)
+		Expect(err).NotTo(HaveOccurred())
+		req := httptest.NewRequest(http.MethodPost, "/build", bytes.NewReader(raw))
+		req.Header.Set(SignatureHeader, signature(raw))
+		rec := httptest.NewRecorder()
+		builder.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	It("posts a signed build request", func() {
+		var received BuildRequest
+		service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			raw := new(bytes.Buffer)
+			_, _ = raw.ReadFrom(req.Body)
+			Expect(builder.verify(raw.Bytes(), req.Header.Get(SignatureHeader))).To(BeTrue())
+			Expect(json.Unmarshal(raw.Bytes(), &received)).To(Succeed())
+			w.WriteHeader(http.StatusAccepted)
+		}))
+		defer service.Close()
+		builder.URL = service.URL
+
+		Expect(builder.Submit(ctx, crud, "abc")).To(Succeed())
+		Expect(received.Name).To(Equal("todolist"))
+		Expect(received.APIDescriptionHash).To(Equal("abc"))
+		Expect(received.CallbackURL).To(Equal(builder.CallbackURL))
+	})
+
+	It("rejects callbacks with an invalid signature", func() {
+		code := callback(BuildCallback{Namespace: "default", Name: "todolist", APIDescriptionHash: "abc", Image: "evil"},
+			func([]byte) string { return "sha256=00" })
+		Expect(code).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("makes the result of a signed callback available to Poll", func() {
+		code := callback(BuildCallback{Namespace: "default", Name: "todolist", APIDescriptionHash: "abc", Image: "registry/todolist@sha256:1234", Port: 8080},
+			builder.sign)
+		Expect(code).To(Equal(http.StatusNoContent))
+
+		updated := &apiv1.CRUD{}
+		Expect(builder.Get(ctx, key(crud), updated)).To(Succeed())
+		result, err := builder.Poll(ctx, updated, "abc")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(&BuildResult{Image: "registry/todolist@sha256:1234", Port: 8080}))
+
+		result, err = builder.Poll(ctx, updated, "def")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(BeNil())
+	})
+
+	It("reports failed builds", func() {
+		code := callback(BuildCallback{Namespace: "default", Name: "todolist", APIDescriptionHash: "abc", Error: "generator crashed"},
+			builder.sign)
+		Expect(code).To(Equal(http.StatusNoContent))
+
+		updated := &apiv1.CRUD{}
+		Expect(builder.Get(ctx, key(crud), updated)).To(Succeed())
+		_, err := builder.Poll(ctx, updated, "abc")
+		Expect(err).To(MatchError(&BuildFailedError{Message: "generator crashed"}))
+	})
+
+	It("rejects stale callbacks", func() {
+		code := callback(BuildCallback{Namespace: "default", Name: "todolist", APIDescriptionHash: "abc", Image: "registry/todolist@sha256:1234",
+			Timestamp: time.Now().Add(-time.Hour).Unix()}, builder.sign)
+		Expect(code).To(Equal(http.StatusUnauthorized))
+
+		updated := &apiv1.CRUD{}
+		Expect(builder.Get(ctx, key(crud), updated)).To(Succeed())
+		Expect(updated.Annotations).NotTo(HaveKey(buildResultAnnotation))
+	})
+
+	It("gives up on builds without a result after the timeout", func() {
+		builder.Timeout = time.Hour
+		started := meta.NewTime(time.Now().Add(-time.Minute))
+		crud.Status.Build = apiv1.BuildStatus{APIDescriptionHash: "abc", Phase: apiv1.BuildRunning, StartTime: &started}
+		result, err := builder.Poll(ctx, crud, "abc")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(BeNil())
+
+		started = meta.NewTime(time.Now().Add(-2 * time.Hour))
+		_, err = builder.Poll(ctx, crud, "abc")
+		Expect(err).To(Equal(ErrBuildNotFound))
+
+		// builds started before their start time was recorded
+		crud.Status.Build.StartTime = nil
+		_, err = builder.Poll(ctx, crud, "abc")
+		Expect(err).To(Equal(ErrBuildNotFound))
+	})
+})
@@ -19,7 +19,10 @@ package main
 import (
 	"flag"
 	"log"
+	"net/http"
 	"os"
+	"strings"
+	"time"
 
 	networking "k8s.io/api/networking/v1beta1"
 	"k8s.io/apimachinery/pkg/runtime"
@@ -50,9 +53,33 @@ func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
 	var rootDomain, clusterIssuer string
+	var builderKind, imageRegistry, generatorImage, kanikoImage, registrySecret string
+	var buildServiceURL, buildCallbackURL, buildCallbackAddr string
+	var buildTimeout time.Duration
+	var backupImage string
+	var defaultStorageClass, databaseVersions string
 	flag.StringVar(&metricsAddr, "metrics-addr", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&rootDomain, "root-domain", "", "[Required] Root domain used for ingresses")
 	flag.StringVar(&clusterIssuer, "cluster-issuer", "", "[Required] Name of the cluster issuer")
+	flag.StringVar(&builderKind, "builder", "none",
+		"How the images of the CRUDs are built: job (in-cluster), webhook (external build service) or none (image, imageReady and optionally apiDescriptionHash set in the status by another system)")
+	flag.StringVar(&imageRegistry, "image-registry", "", "Registry the job builder pushes the images of the CRUDs to")
+	flag.StringVar(&generatorImage, "generator-image", "crudgen/crudgen:latest", "Image of the crudgen generator")
+	flag.StringVar(&kanikoImage, "kaniko-image", "gcr.io/kaniko-project/executor:v1.3.0", "Image of the kaniko executor")
+	flag.StringVar(&registrySecret, "registry-secret", "",
+		"Name of the docker config secret, in the namespace of each CRUD, used to push to the image registry")
+	flag.StringVar(&buildServiceURL, "build-service-url", "", "URL the webhook builder posts builds to")
+	flag.StringVar(&buildCallbackURL, "build-callback-url", "",
+		"URL the build service reports build results to, reaching --build-callback-addr")
+	flag.StringVar(&buildCallbackAddr, "build-callback-addr", ":8082", "The address the build callback endpoint binds to.")
+	flag.DurationVar(&buildTimeout, "build-timeout", time.Hour,
+		"How long the webhook builder waits for the result of a build before submitting it again")
+	flag.StringVar(&defaultStorageClass, "default-storage-class", "",
+		"Storage class of the database volumes of CRUDs that do not set one, the default class of the cluster when empty")
+	flag.StringVar(&databaseVersions, "database-versions", "",
+		"Comma-separated postgres versions CRUDs may run, any version when empty. "+
+			"CRUDs that do not set one run the highest major version listed")
+	flag.StringVar(&backupImage, "backup-image", "minio/mc:latest", "Image of the minio client transferring database backups to and from S3")
 	flag.BoolVar(&enableLeaderElection, "enable-leader-election", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
@@ -63,6 +90,9 @@ func main() {
 	if clusterIssuer == "" {
 		log.Fatal("--cluster-issuer must be set.")
 	}
+	if databaseVersions != "" {
+		apiv1.AllowedDatabaseVersions = strings.Split(databaseVersions, ",")
+	}
 
 	ctrl.SetLogger(zap.New(zap.UseDevMode(true)))
 
@@ -78,16 +108,89 @@ func main() {
 		os.Exit(1)
 	}
 
+	var imageBuilder controllers.Builder
+	switch builderKind {
+	case "job":
+		if imageRegistry == "" {
+			log.Fatal("--image-registry must be set for the job builder.")
+		}
+		imageBuilder = &controllers.JobBuilder{
+			Client:         mgr.GetClient(),
+			PodReader:      mgr.GetAPIReader(),
+			Scheme:         mgr.GetScheme(),
+			Registry:       imageRegistry,
+			GeneratorImage: generatorImage,
+			KanikoImage:    kanikoImage,
+			PushSecret:     registrySecret,
+		}
+
+	case "webhook":
+		if buildServiceURL == "" || buildCallbackURL == "" {
+			log.Fatal("--build-service-url and --build-callback-url must be set for the webhook builder.")
+		}
+		secret := os.Getenv("BUILD_SERVICE_SECRET")
+		if secret == "" {
+			log.Fatal("BUILD_SERVICE_SECRET must be set for the webhook builder.")
+		}
+		webhookBuilder := &controllers.WebhookBuilder{
+			Client:       mgr.GetClient(),
+			Log:          ctrl.Log.WithName("builder"),
+			HTTPClient:   &http.Client{Timeout: 30 * time.Second},
+			URL:          buildServiceURL,
+			CallbackURL:  buildCallbackURL,
+			CallbackAddr: buildCallbackAddr,
+			Secret:       []byte(secret),
+			Timeout:      buildTimeout,
+		}
+		if err := mgr.Add(webhookBuilder); err != nil {
+			setupLog.Error(err, "unable to add build callback server")
+			os.Exit(1)
+		}
+		imageBuilder = webhookBuilder
+
+	case "none":
+	default:
+		log.Fatalf("unknown builder %q, must be one of job, webhook or none.", builderKind)
+	}
+
 	if err = (&controllers.CRUDReconciler{
-		Client:        mgr.GetClient(),
-		Log:           ctrl.Log.WithName("controllers").WithName("CRUD"),
-		Scheme:        mgr.GetScheme(),
-		RootDomain:    rootDomain,
-		ClusterIssuer: clusterIssuer,
+		Client:              mgr.GetClient(),
+		Log:                 ctrl.Log.WithName("controllers").WithName("CRUD"),
+		Scheme:              mgr.GetScheme(),
+		RootDomain:          rootDomain,
+		ClusterIssuer:       clusterIssuer,
+		Recorder:            mgr.GetEventRecorderFor("crud-controller"),
+		BackupImage:         backupImage,
+		Builder:             imageBuilder,
+		DefaultStorageClass: defaultStorageClass,
+		PodReader:           mgr.GetAPIReader(),
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "CRUD")
 		os.Exit(1)
 	}
+	if err = (&controllers.CRUDRestoreReconciler{
+		Client:      mgr.GetClient(),
+		Log:         ctrl.Log.WithName("controllers").WithName("CRUDRestore"),
+		Scheme:      mgr.GetScheme(),
+		BackupImage: backupImage,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "CRUDRestore")
+		os.Exit(1)
+	}
+	if err = (&controllers.DatabasePoolReconciler{
+		Client: mgr.GetClient(),
+		Log:    ctrl.Log.WithName("controllers").WithName("DatabasePool"),
+		Scheme: mgr.GetScheme(),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "DatabasePool")
+		os.Exit(1)
+	}
+	if os.Getenv("ENABLE_WEBHOOKS") != "false" {
+		if err = (&apiv1.CRUD{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "CRUD")
+			os.Exit(1)
+		}
+	}
 	// +kubebuilder:scaffold:builder
 
 	setupLog.Info("starting manager")
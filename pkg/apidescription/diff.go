@@ -0,0 +1,201 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apidescription
+
+import (
+	"fmt"
+	"reflect"
+
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// ChangeKind classifies a change between two descriptions by its effect on
+// the data.
+type ChangeKind string
+
+const (
+	// Additive changes only add tables or columns.
+	Additive ChangeKind = "Additive"
+	// Compatible changes keep every stored value, e.g. API only changes or
+	// widening a column.
+	Compatible ChangeKind = "Compatible"
+	// Destructive changes drop tables, columns or relations, or convert
+	// values in a way that can lose them.
+	Destructive ChangeKind = "Destructive"
+)
+
+// Change is a difference between two descriptions.
+type Change struct {
+	Kind ChangeKind
+	// Path locates the change, e.g. apps[todo].models[List].fields[title].
+	Path    string
+	Message string
+}
+
+// widenings are the field type changes that keep every stored value.
+var widenings = map[string][]string{
+	CharField:            {TextField},
+	EmailField:           {CharField, TextField},
+	SlugField:            {CharField, TextField},
+	URLField:             {CharField, TextField},
+	SmallIntegerField:    {IntegerField, BigIntegerField},
+	IntegerField:         {BigIntegerField},
+	PositiveIntegerField: {IntegerField, BigIntegerField},
+	OneToOneField:        {ForeignKey},
+}
+
+// Diff lists the changes from one description to another, apps, models and
+// fields being matched by name.
+func Diff(from, to *Description) []Change {
+	changes := []Change{}
+	add := func(kind ChangeKind, path *field.Path, format string, args ...interface{}) {
+		changes = append(changes, Change{Kind: kind, Path: path.String(), Message: fmt.Sprintf(format, args...)})
+	}
+
+	root := field.NewPath("apps")
+	toApps := map[string]*App{}
+	for i := range to.Apps {
+		toApps[to.Apps[i].Name] = &to.Apps[i]
+	}
+	fromApps := map[string]bool{}
+	for i := range from.Apps {
+		old := &from.Apps[i]
+		fromApps[old.Name] = true
+		app, ok := toApps[old.Name]
+		if !ok {
+			add(Destructive, root.Key(old.Name), "app removed, dropping its tables")
+			continue
+		}
+		changes = append(changes, diffApp(old, app, root.Key(old.Name))...)
+	}
+	for _, app := range to.Apps {
+		if !fromApps[app.Name] {
+			add(Additive, root.Key(app.Name), "app added")
+		}
+	}
+
+	if from.DeployStrategy != to.DeployStrategy {
+		add(Compatible, field.NewPath("deploy_strategy"), "deploy strategy changed")
+	}
+	return changes
+}
+
+func diffApp(from, to *App, fldPath *field.Path) []Change {
+	changes := []Change{}
+	add := func(kind ChangeKind, path *field.Path, format string, args ...interface{}) {
+		changes = append(changes, Change{Kind: kind, Path: path.String(), Message: fmt.Sprintf(format, args...)})
+	}
+
+	toModels := map[string]*Model{}
+	for i := range to.Models {
+		toModels[to.Models[i].Name] = &to.Models[i]
+	}
+	fromModels := map[string]bool{}
+	for i := range from.Models {
+		old := &from.Models[i]
+		fromModels[old.Name] = true
+		modelPath := fldPath.Child("models").Key(old.Name)
+		model, ok := toModels[old.Name]
+		if !ok {
+			add(Destructive, modelPath, "model removed, dropping table %s", TableName(from, old))
+			continue
+		}
+		changes = append(changes, diffFields(old, model, modelPath)...)
+		if !reflect.DeepEqual(old.Serializers, model.Serializers) {
+			add(Compatible, modelPath.Child("serializers"), "serializers changed")
+		}
+	}
+	for _, model := range to.Models {
+		if !fromModels[model.Name] {
+			add(Additive, fldPath.Child("models").Key(model.Name), "model added")
+		}
+	}
+
+	if !reflect.DeepEqual(from.Endpoints, to.Endpoints) {
+		add(Compatible, fldPath.Child("endpoints"), "endpoints changed")
+	}
+	return changes
+}
+
+func diffFields(from, to *Model, fldPath *field.Path) []Change {
+	changes := []Change{}
+	add := func(kind ChangeKind, path *field.Path, format string, args ...interface{}) {
+		changes = append(changes, Change{Kind: kind, Path: path.String(), Message: fmt.Sprintf(format, args...)})
+	}
+
+	toFields := map[string]*Field{}
+	for i := range to.Fields {
+		toFields[to.Fields[i].Name] = &to.Fields[i]
+	}
+	fromFields := map[string]bool{}
+	for i := range from.Fields {
+		old := &from.Fields[i]
+		fromFields[old.Name] = true
+		fieldPath := fldPath.Child("fields").Key(old.Name)
+		f, ok := toFields[old.Name]
+		switch {
+		case !ok && old.IsRelation():
+			add(Destructive, fieldPath, "%s removed, dropping the relation", old.FieldType)
+		case !ok:
+			add(Destructive, fieldPath, "field removed, dropping its column")
+		case old.FieldType != f.FieldType && !isWidening(old.FieldType, f.FieldType):
+			add(Destructive, fieldPath.Child("field_type"), "type changed from %s to %s", old.FieldType, f.FieldType)
+		case old.FieldType != f.FieldType:
+			add(Compatible, fieldPath.Child("field_type"), "type widened from %s to %s", old.FieldType, f.FieldType)
+		case old.IsRelation() && old.Target != f.Target:
+			add(Destructive, fieldPath.Child("target"), "relation target changed from %s to %s", old.Target, f.Target)
+		}
+		if !ok {
+			continue
+		}
+		if old.MaxLength != nil && f.MaxLength != nil && *old.MaxLength != *f.MaxLength {
+			kind := Compatible
+			if *f.MaxLength < *old.MaxLength {
+				kind = Destructive
+			}
+			add(kind, fieldPath.Child("max_length"), "max_length changed from %d to %d", *old.MaxLength, *f.MaxLength)
+		}
+		if old.RelatedName != f.RelatedName {
+			add(Compatible, fieldPath.Child("related_name"), "related_name changed")
+		}
+	}
+	for _, f := range to.Fields {
+		if !fromFields[f.Name] {
+			add(Additive, fldPath.Child("fields").Key(f.Name), "%s added", f.FieldType)
+		}
+	}
+	return changes
+}
+
+func isWidening(from, to string) bool {
+	for _, t := range widenings[from] {
+		if t == to {
+			return true
+		}
+	}
+	return false
+}
+
+// HasDestructive reports whether one of changes is destructive.
+func HasDestructive(changes []Change) bool {
+	for _, change := range changes {
+		if change.Kind == Destructive {
+			return true
+		}
+	}
+	return false
+}
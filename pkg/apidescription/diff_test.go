@@ -0,0 +1,98 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apidescription
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Diff", func() {
+	var from, to *Description
+
+	BeforeEach(func() {
+		from, to = loadSample(), loadSample()
+	})
+
+	kinds := func(changes []Change) map[string]ChangeKind {
+		kinds := map[string]ChangeKind{}
+		for _, change := range changes {
+			kinds[change.Path] = change.Kind
+		}
+		return kinds
+	}
+
+	It("finds no change between identical descriptions", func() {
+		Expect(Diff(from, to)).To(BeEmpty())
+	})
+
+	It("classifies added models and fields as additive", func() {
+		to.Apps[0].Models = append(to.Apps[0].Models, Model{Name: "Tag"})
+		to.Apps[0].Models[0].Fields = append(to.Apps[0].Models[0].Fields, Field{Name: "due", FieldType: DateField})
+		Expect(kinds(Diff(from, to))).To(Equal(map[string]ChangeKind{
+			"apps[todo].models[Tag]":                  Additive,
+			"apps[todo].models[ListItem].fields[due]": Additive,
+		}))
+		Expect(HasDestructive(Diff(from, to))).To(BeFalse())
+	})
+
+	It("classifies removed models, fields and relations as destructive", func() {
+		to.Apps[0].Models[0].Fields = to.Apps[0].Models[0].Fields[1:2]
+		to.Apps[0].Models = to.Apps[0].Models[:1]
+		Expect(kinds(Diff(from, to))).To(Equal(map[string]ChangeKind{
+			"apps[todo].models[List]":                  Destructive,
+			"apps[todo].models[ListItem].fields[text]": Destructive,
+			"apps[todo].models[ListItem].fields[list]": Destructive,
+		}))
+		Expect(HasDestructive(Diff(from, to))).To(BeTrue())
+	})
+
+	It("tells widening from narrowing a column", func() {
+		to.Apps[0].Models[1].Fields[0].FieldType = TextField
+		to.Apps[0].Models[1].Fields[0].MaxLength = nil
+		longer, shorter := int32(400), int32(10)
+		to.Apps[0].Models[0].Fields[0].MaxLength = &longer
+		to.Apps[0].Models[1].Fields[1].MaxLength = &shorter
+		Expect(kinds(Diff(from, to))).To(Equal(map[string]ChangeKind{
+			"apps[todo].models[List].fields[title].field_type":       Compatible,
+			"apps[todo].models[ListItem].fields[text].max_length":    Compatible,
+			"apps[todo].models[List].fields[description].max_length": Destructive,
+		}))
+	})
+
+	It("classifies converting values and retargeting relations as destructive", func() {
+		to.Apps[0].Models[0].Fields[1].FieldType = CharField
+		to.Apps[0].Models[0].Fields[2].Target = "todo.ListItem"
+		Expect(kinds(Diff(from, to))).To(Equal(map[string]ChangeKind{
+			"apps[todo].models[ListItem].fields[checked].field_type": Destructive,
+			"apps[todo].models[ListItem].fields[list].target":        Destructive,
+		}))
+	})
+
+	It("classifies API changes as compatible", func() {
+		to.Apps[0].Models[0].Fields[2].RelatedName = "entries"
+		to.Apps[0].Models[0].Serializers[0].Fields = []string{"id", "text"}
+		to.Apps[0].Endpoints[0].Path = "todolists"
+		to.DeployStrategy.Port = 8000
+		Expect(kinds(Diff(from, to))).To(Equal(map[string]ChangeKind{
+			"apps[todo].models[ListItem].fields[list].related_name": Compatible,
+			"apps[todo].models[ListItem].serializers":               Compatible,
+			"apps[todo].endpoints":                                  Compatible,
+			"deploy_strategy":                                       Compatible,
+		}))
+	})
+})
@@ -0,0 +1,57 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apidescription
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Hash", func() {
+	const raw = `{"name": "todolist", "deploy_strategy": {"port": 8080, "hostname": "api"}}`
+
+	hash := func(raw string) string {
+		h, err := Hash(raw)
+		Expect(err).NotTo(HaveOccurred())
+		return h
+	}
+
+	It("ignores whitespace and key order", func() {
+		reordered := `{
+  "deploy_strategy": {"hostname": "api", "port": 8080},
+  "name": "todolist"
+}`
+		Expect(hash(reordered)).To(Equal(hash(raw)))
+	})
+
+	It("changes with the content", func() {
+		Expect(hash(`{"name": "todolist", "deploy_strategy": {"port": 8081, "hostname": "api"}}`)).NotTo(Equal(hash(raw)))
+	})
+
+	It("keeps numbers as written", func() {
+		canonical, err := Canonicalize(`{"b": 1.50, "a": 12345678901234567890}`)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(canonical)).To(Equal(`{"a":12345678901234567890,"b":1.50}`))
+	})
+
+	It("rejects invalid JSON", func() {
+		_, err := Hash(`{"name": `)
+		Expect(err).To(HaveOccurred())
+		_, err = Hash(`{} {}`)
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,70 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apidescription
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// Parse decodes raw into a Description and validates it. Errors are
+// reported relative to fldPath, which should point at the JSON string
+// itself, e.g. field.NewPath("spec", "apiDescription").
+func Parse(raw string, fldPath *field.Path) (*Description, field.ErrorList) {
+	desc, err := Decode(raw)
+	if err != nil {
+		return nil, field.ErrorList{decodeError(err, fldPath)}
+	}
+	if errs := Validate(desc, fldPath); len(errs) > 0 {
+		return nil, errs
+	}
+	return desc, nil
+}
+
+// Decode decodes raw into a Description without validating it. Unknown
+// keys are rejected so that a misspelled key is not silently ignored.
+func Decode(raw string) (*Description, error) {
+	desc := &Description{}
+	decoder := json.NewDecoder(strings.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(desc); err != nil {
+		return nil, err
+	}
+	if decoder.More() {
+		return nil, fmt.Errorf("unexpected data after the top-level object at offset %d", decoder.InputOffset())
+	}
+	return desc, nil
+}
+
+func decodeError(err error, fldPath *field.Path) *field.Error {
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		return field.Invalid(fldPath, "", fmt.Sprintf("invalid JSON at offset %d: %v", e.Offset, e))
+	case *json.UnmarshalTypeError:
+		path := fldPath
+		if e.Field != "" {
+			parts := strings.Split(e.Field, ".")
+			path = path.Child(parts[0], parts[1:]...)
+		}
+		return field.Invalid(path, e.Value, fmt.Sprintf("must be of type %s", e.Type))
+	default:
+		return field.Invalid(fldPath, "", err.Error())
+	}
+}
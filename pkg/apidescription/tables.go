@@ -0,0 +1,63 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apidescription
+
+import (
+	"sort"
+	"strings"
+)
+
+// TableName is the name of the database table Django creates for model.
+func TableName(app *App, model *Model) string {
+	return strings.ToLower(app.Name + "_" + model.Name)
+}
+
+// Tables returns the sorted names of the database tables of desc: one per
+// model and one per many-to-many field.
+func (d *Description) Tables() []string {
+	tables := []string{}
+	for a := range d.Apps {
+		app := &d.Apps[a]
+		for m := range app.Models {
+			model := &app.Models[m]
+			table := TableName(app, model)
+			tables = append(tables, table)
+			for _, f := range model.Fields {
+				if f.FieldType == ManyToManyField {
+					tables = append(tables, table+"_"+strings.ToLower(f.Name))
+				}
+			}
+		}
+	}
+	sort.Strings(tables)
+	return tables
+}
+
+// DroppedTables returns the tables of from that to does not have.
+func DroppedTables(from, to *Description) []string {
+	kept := map[string]bool{}
+	for _, table := range to.Tables() {
+		kept[table] = true
+	}
+	dropped := []string{}
+	for _, table := range from.Tables() {
+		if !kept[table] {
+			dropped = append(dropped, table)
+		}
+	}
+	return dropped
+}
@@ -0,0 +1,42 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apidescription
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Tables", func() {
+	It("names the tables like Django", func() {
+		Expect(loadSample().Tables()).To(Equal([]string{"todo_list", "todo_listitem"}))
+	})
+
+	It("includes the many-to-many tables", func() {
+		desc := loadSample()
+		desc.Apps[0].Models[0].Fields = append(desc.Apps[0].Models[0].Fields,
+			Field{Name: "Tags", FieldType: ManyToManyField, Target: "List"})
+		Expect(desc.Tables()).To(Equal([]string{"todo_list", "todo_listitem", "todo_listitem_tags"}))
+	})
+
+	It("lists the tables a change would drop", func() {
+		from, to := loadSample(), loadSample()
+		to.Apps[0].Models = to.Apps[0].Models[1:]
+		Expect(DroppedTables(from, to)).To(Equal([]string{"todo_listitem"}))
+		Expect(DroppedTables(to, from)).To(BeEmpty())
+	})
+})
@@ -0,0 +1,129 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package apidescription contains the typed model of the crudgen API
+// description that is carried as JSON in CRUDSpec.APIDescription.
+package apidescription
+
+// Description is the root of an API description.
+type Description struct {
+	Name           string         `json:"name"`
+	Version        string         `json:"version,omitempty"`
+	DeployStrategy DeployStrategy `json:"deploy_strategy"`
+	Apps           []App          `json:"apps"`
+}
+
+// DeployStrategy describes how the generated service listens.
+type DeployStrategy struct {
+	Hostname string `json:"hostname,omitempty"`
+	Port     int32  `json:"port"`
+}
+
+// App is a group of models and the endpoints that expose them.
+type App struct {
+	Name      string     `json:"name"`
+	Namespace string     `json:"namespace,omitempty"`
+	Models    []Model    `json:"models"`
+	Endpoints []Endpoint `json:"endpoints,omitempty"`
+}
+
+// Model is a database table of an app.
+type Model struct {
+	Name        string       `json:"name"`
+	Fields      []Field      `json:"fields"`
+	Serializers []Serializer `json:"serializers,omitempty"`
+}
+
+// Field is a column, or a relation for the relation field types, of a model.
+type Field struct {
+	Name        string `json:"name"`
+	FieldType   string `json:"field_type"`
+	MaxLength   *int32 `json:"max_length,omitempty"`
+	Target      string `json:"target,omitempty"`
+	RelatedName string `json:"related_name,omitempty"`
+}
+
+// Serializer selects the fields of a model exposed by an endpoint.
+type Serializer struct {
+	Name   string                     `json:"name"`
+	Fields []string                   `json:"fields"`
+	Extras map[string]SerializerExtra `json:"extras,omitempty"`
+}
+
+// SerializerExtra overrides how a single serializer field is rendered.
+type SerializerExtra struct {
+	Serializer string `json:"serializer,omitempty"`
+}
+
+// Endpoint exposes a model of an app under a path.
+type Endpoint struct {
+	Path         string   `json:"path"`
+	EndpointType string   `json:"endpoint_type"`
+	Model        string   `json:"model"`
+	Serializer   string   `json:"serializer"`
+	Actions      []Action `json:"actions,omitempty"`
+}
+
+// Action is an endpoint nested below another endpoint.
+type Action struct {
+	Path         string `json:"path"`
+	EndpointType string `json:"endpoint_type"`
+	Model        string `json:"model"`
+	Serializer   string `json:"serializer"`
+	ParentField  string `json:"parent_field,omitempty"`
+}
+
+// Field types understood by the generator.
+const (
+	AutoField            = "AutoField"
+	BigIntegerField      = "BigIntegerField"
+	BooleanField         = "BooleanField"
+	CharField            = "CharField"
+	DateField            = "DateField"
+	DateTimeField        = "DateTimeField"
+	DecimalField         = "DecimalField"
+	EmailField           = "EmailField"
+	FloatField           = "FloatField"
+	IntegerField         = "IntegerField"
+	JSONField            = "JSONField"
+	PositiveIntegerField = "PositiveIntegerField"
+	SlugField            = "SlugField"
+	SmallIntegerField    = "SmallIntegerField"
+	TextField            = "TextField"
+	TimeField            = "TimeField"
+	URLField             = "URLField"
+	UUIDField            = "UUIDField"
+	ForeignKey           = "ForeignKey"
+	OneToOneField        = "OneToOneField"
+	ManyToManyField      = "ManyToManyField"
+)
+
+// FieldTypes lists every supported value of Field.FieldType.
+var FieldTypes = []string{
+	AutoField, BigIntegerField, BooleanField, CharField, DateField,
+	DateTimeField, DecimalField, EmailField, FloatField, IntegerField,
+	JSONField, PositiveIntegerField, SlugField, SmallIntegerField, TextField,
+	TimeField, URLField, UUIDField, ForeignKey, OneToOneField, ManyToManyField,
+}
+
+// IsRelation reports whether the field points at another model.
+func (f *Field) IsRelation() bool {
+	switch f.FieldType {
+	case ForeignKey, OneToOneField, ManyToManyField:
+		return true
+	}
+	return false
+}
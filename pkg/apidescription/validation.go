@@ -0,0 +1,317 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apidescription
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// PrimaryKeyField is the implicit primary key every model gets.
+const PrimaryKeyField = "id"
+
+var identifierRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// index resolves model and serializer names across the whole description.
+type index struct {
+	models      map[string]*Model
+	serializers map[string]map[string]*Model
+	// reverse holds the related names other models add to a model.
+	reverse map[*Model]map[string]bool
+}
+
+func buildIndex(desc *Description) *index {
+	idx := &index{
+		models:      map[string]*Model{},
+		serializers: map[string]map[string]*Model{},
+		reverse:     map[*Model]map[string]bool{},
+	}
+	for a := range desc.Apps {
+		app := &desc.Apps[a]
+		idx.serializers[app.Name] = map[string]*Model{}
+		for m := range app.Models {
+			model := &app.Models[m]
+			idx.models[app.Name+"."+model.Name] = model
+			for _, s := range model.Serializers {
+				idx.serializers[app.Name][s.Name] = model
+			}
+		}
+	}
+	for _, app := range desc.Apps {
+		for _, model := range app.Models {
+			for _, f := range model.Fields {
+				if !f.IsRelation() || f.RelatedName == "" {
+					continue
+				}
+				if target := idx.resolve(app.Name, f.Target); target != nil {
+					if idx.reverse[target] == nil {
+						idx.reverse[target] = map[string]bool{}
+					}
+					idx.reverse[target][f.RelatedName] = true
+				}
+			}
+		}
+	}
+	return idx
+}
+
+// resolve looks up a relation target, either "app.Model" or a bare "Model"
+// of the current app.
+func (idx *index) resolve(app, target string) *Model {
+	if !strings.Contains(target, ".") {
+		target = app + "." + target
+	}
+	return idx.models[target]
+}
+
+// Validate checks that desc is complete and that every name it references
+// resolves.
+func Validate(desc *Description, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+
+	if desc.Name == "" {
+		allErrs = append(allErrs, field.Required(fldPath.Child("name"), ""))
+	}
+	portPath := fldPath.Child("deploy_strategy", "port")
+	if desc.DeployStrategy.Port < 1 || desc.DeployStrategy.Port > 65535 {
+		allErrs = append(allErrs, field.Invalid(portPath, desc.DeployStrategy.Port, "must be between 1 and 65535"))
+	}
+	if len(desc.Apps) == 0 {
+		allErrs = append(allErrs, field.Required(fldPath.Child("apps"), "at least one app is required"))
+	}
+
+	idx := buildIndex(desc)
+	apps := map[string]bool{}
+	for i := range desc.Apps {
+		app := &desc.Apps[i]
+		appPath := fldPath.Child("apps").Index(i)
+		allErrs = append(allErrs, validateIdentifier(app.Name, appPath.Child("name"))...)
+		if apps[app.Name] {
+			allErrs = append(allErrs, field.Duplicate(appPath.Child("name"), app.Name))
+		}
+		apps[app.Name] = true
+		allErrs = append(allErrs, validateApp(idx, app, appPath)...)
+	}
+	return allErrs
+}
+
+func validateApp(idx *index, app *App, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+
+	models := map[string]bool{}
+	serializers := map[string]bool{}
+	for i := range app.Models {
+		model := &app.Models[i]
+		modelPath := fldPath.Child("models").Index(i)
+		allErrs = append(allErrs, validateIdentifier(model.Name, modelPath.Child("name"))...)
+		if models[model.Name] {
+			allErrs = append(allErrs, field.Duplicate(modelPath.Child("name"), model.Name))
+		}
+		models[model.Name] = true
+
+		allErrs = append(allErrs, validateFields(idx, app, model, modelPath)...)
+		for j := range model.Serializers {
+			serializerPath := modelPath.Child("serializers").Index(j)
+			name := model.Serializers[j].Name
+			if serializers[name] {
+				allErrs = append(allErrs, field.Duplicate(serializerPath.Child("name"), name))
+			}
+			serializers[name] = true
+			allErrs = append(allErrs, validateSerializer(idx, app, model, &model.Serializers[j], serializerPath)...)
+		}
+	}
+
+	for i := range app.Endpoints {
+		endpoint := &app.Endpoints[i]
+		endpointPath := fldPath.Child("endpoints").Index(i)
+		if endpoint.Path == "" {
+			allErrs = append(allErrs, field.Required(endpointPath.Child("path"), ""))
+		}
+		if endpoint.EndpointType == "" {
+			allErrs = append(allErrs, field.Required(endpointPath.Child("endpoint_type"), ""))
+		}
+		model := idx.resolve(app.Name, endpoint.Model)
+		allErrs = append(allErrs, validateEndpointRefs(idx, app, model, endpoint.Model, endpoint.Serializer, endpointPath)...)
+
+		for j := range endpoint.Actions {
+			action := &endpoint.Actions[j]
+			actionPath := endpointPath.Child("actions").Index(j)
+			if action.Path == "" {
+				allErrs = append(allErrs, field.Required(actionPath.Child("path"), ""))
+			}
+			if action.EndpointType == "" {
+				allErrs = append(allErrs, field.Required(actionPath.Child("endpoint_type"), ""))
+			}
+			actionModel := idx.resolve(app.Name, action.Model)
+			allErrs = append(allErrs, validateEndpointRefs(idx, app, actionModel, action.Model, action.Serializer, actionPath)...)
+			if action.ParentField != "" && actionModel != nil && model != nil {
+				allErrs = append(allErrs, validateParentField(idx, app, actionModel, model, action.ParentField, actionPath.Child("parent_field"))...)
+			}
+		}
+	}
+	return allErrs
+}
+
+func validateFields(idx *index, app *App, model *Model, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+
+	if len(model.Fields) == 0 {
+		allErrs = append(allErrs, field.Required(fldPath.Child("fields"), "at least one field is required"))
+	}
+	names := map[string]bool{}
+	for i := range model.Fields {
+		f := &model.Fields[i]
+		fieldPath := fldPath.Child("fields").Index(i)
+		allErrs = append(allErrs, validateIdentifier(f.Name, fieldPath.Child("name"))...)
+		if names[f.Name] {
+			allErrs = append(allErrs, field.Duplicate(fieldPath.Child("name"), f.Name))
+		}
+		names[f.Name] = true
+
+		if !isFieldType(f.FieldType) {
+			allErrs = append(allErrs, field.NotSupported(fieldPath.Child("field_type"), f.FieldType, FieldTypes))
+			continue
+		}
+		if f.MaxLength != nil && *f.MaxLength < 1 {
+			allErrs = append(allErrs, field.Invalid(fieldPath.Child("max_length"), *f.MaxLength, "must be greater than 0"))
+		}
+		if f.FieldType == CharField && f.MaxLength == nil {
+			allErrs = append(allErrs, field.Required(fieldPath.Child("max_length"), "required for "+CharField))
+		}
+
+		switch {
+		case f.IsRelation() && f.Target == "":
+			allErrs = append(allErrs, field.Required(fieldPath.Child("target"), "required for "+f.FieldType))
+		case f.IsRelation() && idx.resolve(app.Name, f.Target) == nil:
+			allErrs = append(allErrs, field.NotFound(fieldPath.Child("target"), f.Target))
+		case !f.IsRelation() && f.Target != "":
+			allErrs = append(allErrs, field.Forbidden(fieldPath.Child("target"), "only allowed for relation fields"))
+		}
+		if f.RelatedName != "" {
+			allErrs = append(allErrs, validateIdentifier(f.RelatedName, fieldPath.Child("related_name"))...)
+		}
+	}
+	return allErrs
+}
+
+func validateSerializer(idx *index, app *App, model *Model, s *Serializer, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+
+	if s.Name == "" {
+		allErrs = append(allErrs, field.Required(fldPath.Child("name"), ""))
+	}
+	listed := map[string]bool{}
+	for i, name := range s.Fields {
+		if !hasAttribute(idx, model, name) {
+			allErrs = append(allErrs, field.NotFound(fldPath.Child("fields").Index(i), name))
+		}
+		listed[name] = true
+	}
+	extras := make([]string, 0, len(s.Extras))
+	for name := range s.Extras {
+		extras = append(extras, name)
+	}
+	sort.Strings(extras)
+	for _, name := range extras {
+		extra := s.Extras[name]
+		extraPath := fldPath.Child("extras").Key(name)
+		if !listed[name] {
+			allErrs = append(allErrs, field.Invalid(extraPath, name, "must be listed in fields"))
+		}
+		if extra.Serializer != "" {
+			if _, ok := idx.serializers[app.Name][extra.Serializer]; !ok {
+				allErrs = append(allErrs, field.NotFound(extraPath.Child("serializer"), extra.Serializer))
+			}
+		}
+	}
+	return allErrs
+}
+
+func validateEndpointRefs(idx *index, app *App, model *Model, modelName, serializer string, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+
+	switch {
+	case modelName == "":
+		allErrs = append(allErrs, field.Required(fldPath.Child("model"), ""))
+	case model == nil:
+		allErrs = append(allErrs, field.NotFound(fldPath.Child("model"), modelName))
+	}
+
+	serializerPath := fldPath.Child("serializer")
+	owner, ok := idx.serializers[app.Name][serializer]
+	switch {
+	case serializer == "":
+		allErrs = append(allErrs, field.Required(serializerPath, ""))
+	case !ok:
+		allErrs = append(allErrs, field.NotFound(serializerPath, serializer))
+	case model != nil && owner != model:
+		allErrs = append(allErrs, field.Invalid(serializerPath, serializer,
+			fmt.Sprintf("serializer belongs to model %q, not %q", owner.Name, modelName)))
+	}
+	return allErrs
+}
+
+func validateParentField(idx *index, app *App, model, parent *Model, name string, fldPath *field.Path) field.ErrorList {
+	for _, f := range model.Fields {
+		if f.Name != name {
+			continue
+		}
+		if !f.IsRelation() || idx.resolve(app.Name, f.Target) != parent {
+			return field.ErrorList{field.Invalid(fldPath, name,
+				fmt.Sprintf("must be a relation to %q", parent.Name))}
+		}
+		return nil
+	}
+	return field.ErrorList{field.NotFound(fldPath, name)}
+}
+
+func validateIdentifier(name string, fldPath *field.Path) field.ErrorList {
+	if name == "" {
+		return field.ErrorList{field.Required(fldPath, "")}
+	}
+	if !identifierRegexp.MatchString(name) {
+		return field.ErrorList{field.Invalid(fldPath, name, "must be a valid identifier (letters, digits and '_', not starting with a digit)")}
+	}
+	return nil
+}
+
+// hasAttribute reports whether name is a field of model, its primary key or
+// the related name of a relation pointing at it.
+func hasAttribute(idx *index, model *Model, name string) bool {
+	if name == PrimaryKeyField || idx.reverse[model][name] {
+		return true
+	}
+	for _, f := range model.Fields {
+		if f.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func isFieldType(t string) bool {
+	for _, known := range FieldTypes {
+		if t == known {
+			return true
+		}
+	}
+	return false
+}
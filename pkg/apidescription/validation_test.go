@@ -0,0 +1,139 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apidescription
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+var rootPath = field.NewPath("spec", "apiDescription")
+
+func loadSample() *Description {
+	raw, err := ioutil.ReadFile(filepath.Join("testdata", "todolist.json"))
+	Expect(err).NotTo(HaveOccurred())
+	desc, err := Decode(string(raw))
+	Expect(err).NotTo(HaveOccurred())
+	return desc
+}
+
+func errorFields(errs field.ErrorList) []string {
+	fields := []string{}
+	for _, err := range errs {
+		fields = append(fields, err.Field)
+	}
+	return fields
+}
+
+var _ = Describe("Parse", func() {
+	It("accepts the sample description", func() {
+		raw, err := ioutil.ReadFile(filepath.Join("testdata", "todolist.json"))
+		Expect(err).NotTo(HaveOccurred())
+
+		desc, errs := Parse(string(raw), rootPath)
+		Expect(errs).To(BeEmpty())
+		Expect(desc.DeployStrategy.Port).To(Equal(int32(8080)))
+		Expect(desc.Apps[0].Models[0].Fields[2].Target).To(Equal("todo.List"))
+	})
+
+	It("rejects malformed JSON", func() {
+		_, errs := Parse(`{"name": `, rootPath)
+		Expect(errorFields(errs)).To(Equal([]string{"spec.apiDescription"}))
+	})
+
+	It("rejects misspelled keys", func() {
+		_, errs := Parse(`{"name": "x", "field_typ": "CharField"}`, rootPath)
+		Expect(errs).To(HaveLen(1))
+		Expect(errs[0].Detail).To(ContainSubstring("field_typ"))
+	})
+
+	It("reports type mismatches at their path", func() {
+		_, errs := Parse(`{"deploy_strategy": {"port": "8080"}}`, rootPath)
+		Expect(errorFields(errs)).To(Equal([]string{"spec.apiDescription.deploy_strategy.port"}))
+	})
+})
+
+var _ = Describe("Validate", func() {
+	var desc *Description
+
+	BeforeEach(func() {
+		desc = loadSample()
+	})
+
+	It("rejects unknown field types", func() {
+		desc.Apps[0].Models[0].Fields[1].FieldType = "BoolField"
+		errs := Validate(desc, rootPath)
+		Expect(errorFields(errs)).To(Equal([]string{
+			"spec.apiDescription.apps[0].models[0].fields[1].field_type",
+		}))
+		Expect(errs[0].Type).To(Equal(field.ErrorTypeNotSupported))
+	})
+
+	It("rejects relation targets that do not resolve", func() {
+		desc.Apps[0].Models[0].Fields[2].Target = "todo.Lists"
+		errs := Validate(desc, rootPath)
+		Expect(errorFields(errs)).To(ContainElement("spec.apiDescription.apps[0].models[0].fields[2].target"))
+	})
+
+	It("resolves relation targets relative to the app", func() {
+		desc.Apps[0].Models[0].Fields[2].Target = "List"
+		Expect(Validate(desc, rootPath)).To(BeEmpty())
+	})
+
+	It("rejects serializer fields missing from the model", func() {
+		desc.Apps[0].Models[1].Serializers[0].Fields[3] = "entries"
+		errs := Validate(desc, rootPath)
+		Expect(errorFields(errs)).To(ConsistOf(
+			"spec.apiDescription.apps[0].models[1].serializers[0].fields[3]",
+			"spec.apiDescription.apps[0].models[1].serializers[0].extras[items]",
+		))
+	})
+
+	It("rejects endpoints referencing unknown models and serializers", func() {
+		desc.Apps[0].Endpoints[0].Model = "Lists"
+		desc.Apps[0].Endpoints[0].Actions[0].Serializer = "ItemSerializer"
+		errs := Validate(desc, rootPath)
+		Expect(errorFields(errs)).To(ConsistOf(
+			"spec.apiDescription.apps[0].endpoints[0].model",
+			"spec.apiDescription.apps[0].endpoints[0].actions[0].serializer",
+		))
+	})
+
+	It("rejects serializers that belong to another model", func() {
+		desc.Apps[0].Endpoints[0].Serializer = "ListItemSerializer"
+		errs := Validate(desc, rootPath)
+		Expect(errorFields(errs)).To(Equal([]string{"spec.apiDescription.apps[0].endpoints[0].serializer"}))
+	})
+
+	It("rejects a missing port", func() {
+		desc.DeployStrategy.Port = 0
+		errs := Validate(desc, rootPath)
+		Expect(errorFields(errs)).To(Equal([]string{"spec.apiDescription.deploy_strategy.port"}))
+	})
+
+	It("round-trips through JSON", func() {
+		raw, err := json.Marshal(desc)
+		Expect(err).NotTo(HaveOccurred())
+		_, errs := Parse(string(raw), rootPath)
+		Expect(errs).To(BeEmpty())
+	})
+})